@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authConfig is the file given with -auth-config, e.g.
+//
+//	{"tokens": [
+//	  {"name": "server", "token": "...", "read": [""], "write": ["object261", "team/"]},
+//	  {"name": "ops", "token": "...", "read": [""], "write": [""], "admin": true}
+//	]}
+//
+// Read and write scopes are prefixes of the path below /db/, so "team/"
+// covers the namespace team and "" covers everything. Admin tokens may also
+// manage namespaces, replication and Raft membership; peers use one as their
+// -peer-token.
+type authConfig struct {
+	Tokens []tokenConfig `json:"tokens"`
+}
+
+type tokenConfig struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	Admin bool     `json:"admin"`
+}
+
+// identity is what a token grants.
+type identity struct {
+	name  string
+	read  []string
+	write []string
+	admin bool
+}
+
+var anonymous = &identity{name: "anonymous"}
+
+func (id *identity) canRead(path string) bool {
+	return id.admin || hasScope(id.read, path)
+}
+
+func (id *identity) canWrite(path string) bool {
+	return id.admin || hasScope(id.write, path)
+}
+
+func hasScope(scopes []string, path string) bool {
+	for _, scope := range scopes {
+		if strings.HasPrefix(path, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errBadToken     = errors.New("invalid token")
+)
+
+type authenticator struct {
+	// tokens is keyed by the token hash, so lookups do not compare secrets
+	// byte by byte.
+	tokens map[[sha256.Size]byte]*identity
+}
+
+func loadAuth(path string) (*authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth config: %w", err)
+	}
+	var config authConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config: %w", err)
+	}
+	a := &authenticator{tokens: make(map[[sha256.Size]byte]*identity)}
+	for i, t := range config.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("auth config: token %d needs a name and a token", i)
+		}
+		hash := sha256.Sum256([]byte(t.Token))
+		if _, ok := a.tokens[hash]; ok {
+			return nil, fmt.Errorf("auth config: token of %s is used twice", t.Name)
+		}
+		a.tokens[hash] = &identity{name: t.Name, read: t.Read, write: t.Write, admin: t.Admin}
+	}
+	return a, nil
+}
+
+func (a *authenticator) identify(token string) (*identity, error) {
+	if token == "" {
+		return nil, errMissingToken
+	}
+	id, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errBadToken
+	}
+	return id, nil
+}
+
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authorize checks the request against its token. It returns the caller and
+// 0, or 401 or 403.
+func (s *server) authorize(r *http.Request) (*identity, int) {
+	if s.auth == nil {
+		return anonymous, 0
+	}
+	id, err := s.auth.identify(bearerToken(r))
+	if err != nil {
+		return anonymous, http.StatusUnauthorized
+	}
+	if !allowed(id, r) {
+		return id, http.StatusForbidden
+	}
+	return id, 0
+}
+
+// allowed maps the request to the permission it needs.
+func allowed(id *identity, r *http.Request) bool {
+	path := r.URL.Path
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case path == "/db/_watch", path == "/watch", path == "/keys", path == "/scan":
+		// Listing a prefix needs a read scope covering all of it.
+		return id.canRead(r.URL.Query().Get("prefix"))
+	case strings.HasPrefix(path, "/db/"):
+		scope := strings.TrimPrefix(path, "/db/")
+		if readOnly {
+			return id.canRead(scope)
+		}
+		return id.canWrite(scope)
+	case path == "/replication/log", path == "/replication/snapshot":
+		return id.canRead("")
+	case path == "/stats", path == "/replication/status", path == "/raft/status":
+		return true
+	case path == "/namespaces" || strings.HasPrefix(path, "/namespaces/"):
+		return readOnly || id.admin
+	}
+	return id.admin
+}
+
+// peerTransport adds the -peer-token to the requests this node sends to
+// other db nodes.
+type peerTransport struct{}
+
+func (peerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if *peerToken != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+*peerToken)
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Op       string    `json:"op"`
+	Target   string    `json:"target"`
+	Remote   string    `json:"remote"`
+	Status   int       `json:"status"`
+}
+
+// auditLog appends a JSON line for every write, delete and admin request,
+// denied ones included. A nil auditLog records nothing.
+type auditLog struct {
+	mu  sync.Mutex
+	out *os.File
+	enc *json.Encoder
+}
+
+// openAuditLog opens the audit log at path; "-" logs to stderr.
+func openAuditLog(path string) (*auditLog, error) {
+	out := os.Stderr
+	if path != "-" {
+		var err error
+		if out, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+	return &auditLog{out: out, enc: json.NewEncoder(out)}, nil
+}
+
+func (a *auditLog) record(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enc.Encode(rec)
+}
+
+func (a *auditLog) close() error {
+	if a == nil || a.out == os.Stderr {
+		return nil
+	}
+	return a.out.Close()
+}
+
+// audited reports whether a request changes data or settings. Raft traffic
+// between peers is left out.
+func audited(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.URL.Path != "/raft/message"
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+)
+
+const testAuthConfig = `{"tokens": [
+  {"name": "server", "token": "server-secret", "read": ["team/"], "write": ["team/"]},
+  {"name": "ops", "token": "ops-secret", "read": [""], "write": [""], "admin": true}
+]}`
+
+func startAuthNode(t *testing.T) (*testNode, string) {
+	t.Helper()
+	node := startNode(t)
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "auth.json")
+	if err := os.WriteFile(configPath, []byte(testAuthConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := loadAuth(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditPath := filepath.Join(dir, "audit.log")
+	audit, err := openAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.close() })
+	node.srv.auth = auth
+	node.srv.audit = audit
+	return node, auditPath
+}
+
+func authRequest(t *testing.T, method, url, token, body string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAuth(t *testing.T) {
+	node, auditPath := startAuthNode(t)
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/db/team/a", "", http.StatusUnauthorized},
+		{http.MethodGet, "/db/team/a", "wrong", http.StatusUnauthorized},
+		{http.MethodPut, "/db/team/a", "server-secret", http.StatusNoContent},
+		{http.MethodGet, "/db/team/a", "server-secret", http.StatusOK},
+		{http.MethodPut, "/db/other", "server-secret", http.StatusForbidden},
+		{http.MethodGet, "/db/other", "server-secret", http.StatusForbidden},
+		{http.MethodGet, "/keys?prefix=team/", "server-secret", http.StatusOK},
+		{http.MethodGet, "/keys", "server-secret", http.StatusForbidden},
+		{http.MethodGet, "/db/_watch?prefix=team/&timeout=1ms", "server-secret", http.StatusOK},
+		{http.MethodGet, "/db/_watch?timeout=1ms", "server-secret", http.StatusForbidden},
+		{http.MethodGet, "/stats", "server-secret", http.StatusOK},
+		{http.MethodPut, "/db/other", "ops-secret", http.StatusNoContent},
+		{http.MethodGet, "/keys", "ops-secret", http.StatusOK},
+		{http.MethodPost, "/replication/promote", "server-secret", http.StatusForbidden},
+	} {
+		if got := authRequest(t, tc.method, node.url+tc.path, tc.token, `{"value": "v"}`); got != tc.want {
+			t.Errorf("%s %s with %q: status %d, want %d", tc.method, tc.path, tc.token, got, tc.want)
+		}
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	lines := bufio.NewScanner(strings.NewReader(string(data)))
+	for lines.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+			t.Fatalf("bad audit line %q: %v", lines.Text(), err)
+		}
+		got = append(got, rec.Identity+" "+rec.Op+" "+rec.Target+" "+http.StatusText(rec.Status))
+	}
+	want := []string{
+		"server PUT /db/team/a No Content",
+		"server PUT /db/other Forbidden",
+		"ops PUT /db/other No Content",
+		"server POST /replication/promote Forbidden",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("audit log\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestAuthBinaryProtocol(t *testing.T) {
+	node, auditPath := startAuthNode(t)
+	client := startTCP(t, node)
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, "team/a"); !errors.Is(err, dbclient.ErrUnauthorized) {
+		t.Errorf("get before auth: got %v, want ErrUnauthorized", err)
+	}
+	if err := client.Authenticate(ctx, "wrong"); !errors.Is(err, dbclient.ErrUnauthorized) {
+		t.Errorf("bad token: got %v, want ErrUnauthorized", err)
+	}
+	if err := client.Authenticate(ctx, "server-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(ctx, "team/a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(ctx, "other", "v"); !errors.Is(err, dbclient.ErrForbidden) {
+		t.Errorf("put outside scope: got %v, want ErrForbidden", err)
+	}
+	if value, err := client.Get(ctx, "team/a"); err != nil || value != "v" {
+		t.Errorf("get: %q, %v", value, err)
+	}
+	if data, _ := os.ReadFile(auditPath); !strings.Contains(string(data), `"identity":"server","op":"PUT","target":"/db/other"`) {
+		t.Errorf("denied binary put missing from the audit log:\n%s", data)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+const octetStream = "application/octet-stream"
+
+// errEmptyValue answers octet-stream writes without a body.
+const errEmptyValue = "empty value, use DELETE to remove a key"
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+type putRequest struct {
+	Value string `json:"value"`
+}
+
+// getResponse carries a value in JSON. Values that are not valid UTF-8
+// would be mangled by the encoder, so they are sent base64 encoded with
+// Encoding set to "base64".
+type getResponse struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newGetResponse(key, value string) getResponse {
+	if utf8.ValidString(value) {
+		return getResponse{Key: key, Value: value}
+	}
+	return getResponse{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value)), Encoding: "base64"}
+}
+
+type server struct {
+	ds  *datastore.SegmentedDatastore
+	dir string
+	mux *http.ServeMux
+
+	replication
+	raft       *raftServer
+	namespaces *namespaces
+	auth       *authenticator
+	audit      *auditLog
+}
+
+func newServer(ds *datastore.SegmentedDatastore, dir string) *server {
+	s := &server{
+		ds:  ds,
+		dir: dir,
+		mux: http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/db/", s.handleDb)
+	s.mux.HandleFunc("/keys", s.handleKeys)
+	s.mux.HandleFunc("/scan", s.handleScan)
+	s.mux.HandleFunc("/watch", s.handleWatch)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	s.mux.HandleFunc("/replication/log", s.handleLog)
+	s.mux.HandleFunc("/replication/snapshot", s.handleSnapshot)
+	s.mux.HandleFunc("/replication/status", s.handleStatus)
+	s.mux.HandleFunc("/replication/promote", s.handlePromote)
+	return s
+}
+
+// enableRaft routes writes through the Raft log instead of writing to the
+// datastore directly.
+func (s *server) enableRaft(rs *raftServer) {
+	s.raft = rs
+	s.mux.HandleFunc("/raft/message", rs.handleMessage)
+	s.mux.HandleFunc("/raft/status", rs.handleStatus)
+	s.mux.HandleFunc("/raft/members", rs.handleMembers)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, status := s.authorize(r)
+	if audited(r) {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			s.audit.record(auditRecord{
+				Identity: id.name,
+				Op:       r.Method,
+				Target:   r.URL.RequestURI(),
+				Remote:   r.RemoteAddr,
+				Status:   rec.status,
+			})
+		}()
+	}
+	switch status {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+		http.Error(w, "unauthorized", status)
+		return
+	case http.StatusForbidden:
+		http.Error(w, "forbidden", status)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *server) handleDb(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if key == "_watch" {
+		s.handleWatch(w, r)
+		return
+	}
+	if ns, nsKey, ok := s.namespaces.resolve(key); ok {
+		s.handleNamespaceKey(w, r, ns, nsKey)
+		return
+	}
+	if !checkKey(w, key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getKey(w, r, s.ds, key)
+	case http.MethodPost, http.MethodPut:
+		if s.rejectFollowerWrite(w) {
+			return
+		}
+		if s.raft != nil {
+			s.raftPut(w, r, key)
+			return
+		}
+		putKey(w, r, s.ds, key)
+	case http.MethodDelete:
+		if s.rejectFollowerWrite(w) {
+			return
+		}
+		if s.raft != nil {
+			if s.raft.rejectFollowerWrite(w) {
+				return
+			}
+			s.raft.write(w, r, raftCommand{Op: "delete", Key: key})
+			return
+		}
+		deleteKey(w, s.ds, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func checkKey(w http.ResponseWriter, key string) bool {
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return false
+	}
+	if len(key) > *maxKeySize {
+		http.Error(w, "key too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+func getKey(w http.ResponseWriter, r *http.Request, ds *datastore.SegmentedDatastore, key string) {
+	if accepts(r, octetStream) {
+		serveRaw(w, r, ds, key)
+		return
+	}
+	value, err := ds.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read %q: %v", key, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	resp := newGetResponse(key, value)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func putKey(w http.ResponseWriter, r *http.Request, ds *datastore.SegmentedDatastore, key string) {
+	if isOctetStream(r) {
+		putRaw(w, r, ds, key)
+		return
+	}
+	// A JSON string may escape every byte as \uXXXX, so allow for that
+	// before the datastore checks the decoded value.
+	r.Body = http.MaxBytesReader(w, r.Body, int64(*maxValueSize)*6+1024)
+	var req putRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := ds.Put(key, req.Value); err != nil {
+		writePutError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteKey(w http.ResponseWriter, ds *datastore.SegmentedDatastore, key string) {
+	if err := ds.Delete(key); err != nil {
+		log.Printf("failed to delete %q: %v", key, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleKeys lists the live keys, optionally only those with the given
+// prefix, in sorted order. A prefix starting with "{ns}/" lists the keys of
+// namespace ns, like /db/ paths.
+func (s *server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	k, _, err := s.keyspace(prefix, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer k.done()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.sortedKeys(prefix, ""))
+}
+
+// sortedKeys returns the keys of k with their /db/ paths.
+func (k keyspace) sortedKeys(prefix, after string) []string {
+	keys := []string{}
+	for _, key := range k.ds.Keys() {
+		if key = k.name + key; strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// handleScan returns up to limit key-value pairs with the given prefix that
+// sort after the after key, so a client can page through a large range. The
+// prefix selects a namespace as in handleKeys.
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultScanLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxScanLimit)
+	}
+
+	prefix := query.Get("prefix")
+	k, _, err := s.keyspace(prefix, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer k.done()
+	items := []getResponse{}
+	for _, key := range k.sortedKeys(prefix, query.Get("after")) {
+		if len(items) == limit {
+			break
+		}
+		value, err := k.ds.Get(strings.TrimPrefix(key, k.name))
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to read %q: %v", key, err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, newGetResponse(key, value))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleStats reports the stats of the default namespace, or of the one named
+// by ?namespace=.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	k := keyspace{ds: s.ds}
+	if name := r.URL.Query().Get("namespace"); name != "" && name != defaultNamespace {
+		var err error
+		if k, _, err = s.keyspace(name+"/", true); err != nil || k.ns == nil {
+			http.Error(w, errNamespaceNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		defer k.done()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.ds.Stats())
+}
+
+// raftPut reads the whole value, since log entries are kept in memory, and
+// proposes it on the leader.
+func (s *server) raftPut(w http.ResponseWriter, r *http.Request, key string) {
+	if s.raft.rejectFollowerWrite(w) {
+		return
+	}
+	var value []byte
+	if isOctetStream(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(*maxValueSize))
+		var err error
+		if value, err = io.ReadAll(r.Body); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if len(value) == 0 {
+			http.Error(w, errEmptyValue, http.StatusBadRequest)
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(*maxValueSize)*6+1024)
+		var req putRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if len(req.Value) > *maxValueSize {
+			http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		value = []byte(req.Value)
+	}
+	s.raft.write(w, r, raftCommand{Op: "put", Key: key, Value: value})
+}
+
+// serveRaw streams the value straight from the segment file.
+func serveRaw(w http.ResponseWriter, r *http.Request, ds *datastore.SegmentedDatastore, key string) {
+	value, size, err := ds.GetReader(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read %q: %v", key, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	defer value.Close()
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err := io.Copy(w, value); err != nil {
+		log.Printf("failed to send %q: %v", key, err)
+	}
+}
+
+// putRaw streams the request body straight into the segment file. The size
+// has to be known up front because it is written before the value. An empty
+// body is rejected rather than stored as a tombstone; deletes use DELETE.
+func putRaw(w http.ResponseWriter, r *http.Request, ds *datastore.SegmentedDatastore, key string) {
+	if r.ContentLength < 0 {
+		http.Error(w, "content length required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength == 0 {
+		http.Error(w, errEmptyValue, http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > int64(*maxValueSize) {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := ds.PutStream(key, r.Body, r.ContentLength); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			http.Error(w, "incomplete body", http.StatusBadRequest)
+			return
+		}
+		writePutError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isOctetStream reports whether the request body carries a raw value.
+func isOctetStream(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == octetStream
+}
+
+// accepts reports whether the client asked for the given media type, such
+// as the raw value instead of the JSON envelope.
+func accepts(r *http.Request, want string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == want {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBodyError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "bad request", http.StatusBadRequest)
+}
+
+func writePutError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrKeyTooLarge):
+		http.Error(w, "key too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+func TestDeleteAndKeys(t *testing.T) {
+	node := startNode(t)
+	for _, key := range []string{"b-1", "a-1", "a-2"} {
+		if status := putValue(t, node.url, key, "v"); status != http.StatusNoContent {
+			t.Fatalf("put %s: status %d", key, status)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, node.url+"/db/a-2", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if _, status := getValue(node.url, "a-2"); status != http.StatusNotFound {
+		t.Errorf("deleted key: status %d", status)
+	}
+
+	for prefix, want := range map[string][]string{
+		"":   {"a-1", "b-1"},
+		"a-": {"a-1"},
+		"c":  {},
+	} {
+		resp, err := http.Get(node.url + "/keys?prefix=" + prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		json.NewDecoder(resp.Body).Decode(&keys)
+		resp.Body.Close()
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("keys with prefix %q: got %v, want %v", prefix, keys, want)
+		}
+	}
+}
+
+func TestScanAndStats(t *testing.T) {
+	node := startNode(t)
+	for _, key := range []string{"user/3", "user/1", "user/2", "other"} {
+		putValue(t, node.url, key, key+"-value")
+	}
+
+	resp, err := http.Get(node.url + "/scan?prefix=user/&after=user/1&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []getResponse
+	json.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if want := []getResponse{{Key: "user/2", Value: "user/2-value"}}; !reflect.DeepEqual(items, want) {
+		t.Errorf("scan: got %v, want %v", items, want)
+	}
+
+	resp, err = http.Get(node.url + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats datastore.Stats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if stats.Keys != 4 || stats.Segments == 0 || stats.Size == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	node := startNode(t)
+	if err := node.ds.Put("bin", "\xff\x00a"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(node.url + "/db/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got getResponse
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if want := (getResponse{Key: "bin", Value: "/wBh", Encoding: "base64"}); got != want {
+		t.Errorf("binary value: got %+v, want %+v", got, want)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, node.url+"/db/bin", strings.NewReader(""))
+	req.Header.Set("Content-Type", octetStream)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty octet-stream put: status %d, want 400", resp.StatusCode)
+	}
+	if value, err := node.ds.Get("bin"); err != nil || value != "\xff\x00a" {
+		t.Errorf("empty put changed the value: %q, %v", value, err)
+	}
+}
@@ -1,65 +1,160 @@
 package main
 
 import (
-  "encoding/json"
-  "log"
-  "net/http"
-  "strings"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-  "github.com/DmytroHalai/achitecture-practice-5/datastore"
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+	"github.com/DmytroHalai/achitecture-practice-5/raft"
 )
 
-var db *datastore.Db
+var (
+	port           = flag.Int("port", 8083, "db server port")
+	tcpPort        = flag.Int("tcp-port", 8093, "port of the binary protocol listener, 0 disables it")
+	dataDir        = flag.String("dir", "out/db", "data directory")
+	maxSegmentSize = flag.Int64("max-segment-size", 10<<20, "segment size in bytes after which a new segment is started")
+	maxKeySize     = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "maximum key size in bytes")
+	maxValueSize   = flag.Int("max-value-size", datastore.DefaultMaxValueSize, "maximum value size in bytes")
+	mergeSegments  = flag.Int("merge-segments", 0, "merge the default namespace once it has this many segments, 0 disables automatic merges; also the default for new namespaces")
+	mergeInterval  = flag.Duration("merge-interval", 10*time.Second, "how often namespaces are checked for automatic merges")
+	keyFile        = flag.String("encryption-key-file", "", "file with the id:hex-key AES keys values are encrypted with, the last one being current; only values at rest are encrypted, replication carries plaintext; overrides $"+keysEnv)
 
-type putRequest struct {
-    Value string `json:"value"`
-}
+	authConfigPath = flag.String("auth-config", "", "JSON file with the bearer tokens and their scopes; empty disables authentication")
+	auditLogPath   = flag.String("audit-log", "", "file that writes and deletes are logged to, - for stderr; empty disables the audit log")
+	peerToken      = flag.String("peer-token", "", "bearer token this node sends to other db nodes for replication and Raft")
+
+	leaderAddr   = flag.String("leader", "", "leader base URL, e.g. http://db:8083; when set the node starts as a read-only follower")
+	pollInterval = flag.Duration("poll-interval", 500*time.Millisecond, "how often a follower polls the leader for new records")
+
+	raftID              = flag.String("raft-id", "", "base URL of this node, e.g. http://db1:8083; enables the Raft replicated mode")
+	raftPeers           = flag.String("raft-peers", "", "comma separated base URLs of the initial cluster members, this node included; leave empty to join an existing cluster")
+	raftTick            = flag.Duration("raft-tick", 100*time.Millisecond, "Raft tick interval; elections time out after 10-20 ticks")
+	raftSnapshotEntries = flag.Uint64("raft-snapshot-entries", 1000, "applied entries after which the Raft log is compacted into a snapshot and the segments are merged")
+)
+
+// keysEnv holds the encryption keys if no -encryption-key-file is given.
+const keysEnv = "DB_ENCRYPTION_KEYS"
 
-type getResponse struct {
-    Key   string `json:"key"`
-    Value string `json:"value"`
+// loadKeys returns the encryption keys from -encryption-key-file or
+// $DB_ENCRYPTION_KEYS, or nil if neither is set.
+func loadKeys() (*datastore.KeyRing, error) {
+	text := os.Getenv(keysEnv)
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		text = string(data)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	return datastore.ParseKeyRing(text)
 }
 
 func main() {
-    var err error
-    db, err = datastore.Open("out/db")
-    if err != nil {
-        log.Fatalf("failed to open db: %v", err)
-    }
-    defer db.Close()
+	flag.Parse()
 
-    http.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
-        key := strings.TrimPrefix(r.URL.Path, "/db/")
-        if key == "" {
-            http.Error(w, "missing key", http.StatusBadRequest)
-            return
-        }
-        switch r.Method {
-        case http.MethodGet:
-            value, err := db.Get(key)
-            if err != nil {
-                http.NotFound(w, r)
-                return
-            }
-            resp := getResponse{Key: key, Value: value}
-            w.Header().Set("Content-Type", "application/json")
-            json.NewEncoder(w).Encode(resp)
-        case http.MethodPost:
-            var req putRequest
-            if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                http.Error(w, "bad request", http.StatusBadRequest)
-                return
-            }
-            if err := db.Put(key, req.Value); err != nil {
-                http.Error(w, "db error", http.StatusInternalServerError)
-                return
-            }
-            w.WriteHeader(http.StatusNoContent)
-        default:
-            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-        }
-    })
+	opts := []datastore.Option{
+		datastore.WithMaxKeySize(*maxKeySize),
+		datastore.WithMaxValueSize(*maxValueSize),
+	}
+	keys, err := loadKeys()
+	if err != nil {
+		log.Fatalf("failed to load encryption keys: %v", err)
+	}
+	if keys != nil {
+		opts = append(opts, datastore.WithEncryption(keys))
+	}
+	ds, err := datastore.NewSegmentedDatastore(*dataDir, *maxSegmentSize, opts...)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer ds.Close()
+
+	defSettings := namespaceSettings{MaxSegmentSize: *maxSegmentSize, MergeSegments: *mergeSegments}
+	nss, err := openNamespaces(*dataDir, ds, defSettings, opts...)
+	if err != nil {
+		log.Fatalf("failed to open namespaces: %v", err)
+	}
+	defer nss.close()
+	go nss.mergeLoop(*mergeInterval)
+
+	srv := newServer(ds, *dataDir)
+	srv.enableNamespaces(nss)
+	if *authConfigPath != "" {
+		if srv.auth, err = loadAuth(*authConfigPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *auditLogPath != "" {
+		if srv.audit, err = openAuditLog(*auditLogPath); err != nil {
+			log.Fatal(err)
+		}
+		defer srv.audit.close()
+	}
+	if *raftID != "" {
+		if *leaderAddr != "" {
+			log.Fatal("-leader and -raft-id are mutually exclusive")
+		}
+		rs, err := startRaft(ds)
+		if err != nil {
+			log.Fatalf("failed to start raft: %v", err)
+		}
+		defer rs.close()
+		srv.enableRaft(rs)
+		log.Printf("Raft node %s started", *raftID)
+	}
+	if *leaderAddr != "" {
+		srv.follow(*leaderAddr, *pollInterval)
+		log.Printf("Following leader %s", *leaderAddr)
+	}
+
+	if *tcpPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *tcpPort))
+		if err != nil {
+			log.Fatalf("failed to listen on :%d: %v", *tcpPort, err)
+		}
+		go func() { log.Fatal(srv.serveTCP(l)) }()
+		log.Printf("DB binary protocol listener started on :%d", *tcpPort)
+	}
+
+	log.Printf("DB HTTP server started on :%d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), srv))
+}
 
-    log.Println("DB HTTP server started on :8083")
-    log.Fatal(http.ListenAndServe(":8083", nil))
+func startRaft(ds *datastore.SegmentedDatastore) (*raftServer, error) {
+	storage, err := raft.NewFileStorage(filepath.Join(*dataDir, "raft"))
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	if *raftPeers != "" {
+		peers = strings.Split(*raftPeers, ",")
+	}
+	node, err := raft.NewNode(raft.Config{
+		ID:              *raftID,
+		Peers:           peers,
+		ElectionTicks:   raftElectionTicks,
+		HeartbeatTicks:  1,
+		SnapshotEntries: *raftSnapshotEntries,
+		StateMachine:    datastoreMachine{ds: ds},
+		// The datastore keeps what was applied, so a restart only
+		// replays the entries after it.
+		PersistentStateMachine: true,
+		Storage:                storage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs := newRaftServer(node, *raftID)
+	go rs.run(*raftTick)
+	return rs, nil
 }
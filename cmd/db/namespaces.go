@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+const (
+	defaultNamespace = "default"
+	// namespacesDir holds one datastore directory per namespace next to the
+	// segments of the default namespace.
+	namespacesDir    = "namespaces"
+	settingsFileName = "namespace.json"
+)
+
+var (
+	namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+	errNamespaceExists   = errors.New("namespace already exists")
+	errNamespaceNotFound = errors.New("namespace not found")
+	errBadNamespace      = errors.New("namespace names are 1-64 characters of a-z, 0-9, _ and -, starting with a letter or digit")
+)
+
+type namespaceSettings struct {
+	MaxSegmentSize int64 `json:"max_segment_size"`
+	// MergeSegments merges the namespace once it has this many segments;
+	// 0 disables automatic merges.
+	MergeSegments int `json:"merge_segments"`
+}
+
+type namespace struct {
+	name     string
+	settings namespaceSettings
+
+	// mu is held for reading while a request uses ds and for writing while
+	// the namespace is dropped.
+	mu      sync.RWMutex
+	ds      *datastore.SegmentedDatastore
+	dropped bool
+}
+
+type namespaceInfo struct {
+	Name string `json:"name"`
+	namespaceSettings
+	Stats datastore.Stats `json:"stats"`
+}
+
+func (ns *namespace) info() namespaceInfo {
+	return namespaceInfo{Name: ns.name, namespaceSettings: ns.settings, Stats: ns.ds.Stats()}
+}
+
+// namespaces keeps a SegmentedDatastore with its own directory and manifest
+// for every namespace. The default namespace is the datastore in the data
+// directory itself; it always exists and is not kept in byName.
+type namespaces struct {
+	dir  string
+	opts []datastore.Option
+	def  *namespace
+
+	mu     sync.RWMutex
+	byName map[string]*namespace
+}
+
+// openNamespaces opens every namespace found under dir/namespaces.
+func openNamespaces(dir string, def *datastore.SegmentedDatastore, defSettings namespaceSettings, opts ...datastore.Option) (*namespaces, error) {
+	n := &namespaces{
+		dir:    filepath.Join(dir, namespacesDir),
+		opts:   opts,
+		def:    &namespace{name: defaultNamespace, settings: defSettings, ds: def},
+		byName: make(map[string]*namespace),
+	}
+	entries, err := os.ReadDir(n.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !namespaceName.MatchString(entry.Name()) {
+			continue
+		}
+		ns, err := n.open(entry.Name())
+		if err != nil {
+			n.close()
+			return nil, err
+		}
+		n.byName[ns.name] = ns
+	}
+	return n, nil
+}
+
+func (n *namespaces) open(name string) (*namespace, error) {
+	dir := filepath.Join(n.dir, name)
+	data, err := os.ReadFile(filepath.Join(dir, settingsFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings of namespace %s: %w", name, err)
+	}
+	var settings namespaceSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse settings of namespace %s: %w", name, err)
+	}
+	ds, err := datastore.NewSegmentedDatastore(dir, settings.MaxSegmentSize, n.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open namespace %s: %w", name, err)
+	}
+	return &namespace{name: name, settings: settings, ds: ds}, nil
+}
+
+// resolve splits a /db/ path into a namespace and a key. The first path
+// element names a namespace only if that namespace exists; otherwise the
+// whole path is a key of the default namespace.
+func (n *namespaces) resolve(path string) (*namespace, string, bool) {
+	if n == nil {
+		return nil, "", false
+	}
+	name, key, ok := strings.Cut(path, "/")
+	if !ok {
+		return nil, "", false
+	}
+	ns := n.get(name)
+	return ns, key, ns != nil
+}
+
+// keyspace is the datastore a key or prefix of the /db/ path space lives in.
+// For a namespace, name is "{ns}/", which its own keys are stored without.
+type keyspace struct {
+	ds   *datastore.SegmentedDatastore
+	ns   *namespace
+	name string
+}
+
+// keyspace resolves path the way /db/ paths are resolved and returns the rest
+// of it within the keyspace. The caller must call done once it is finished
+// with the datastore, unless hold is false: long-lived requests must not keep
+// a namespace from being dropped.
+func (s *server) keyspace(path string, hold bool) (keyspace, string, error) {
+	ns, rest, ok := s.namespaces.resolve(path)
+	if !ok {
+		return keyspace{ds: s.ds}, path, nil
+	}
+	ns.mu.RLock()
+	if ns.dropped {
+		ns.mu.RUnlock()
+		return keyspace{}, "", errNamespaceNotFound
+	}
+	k := keyspace{ds: ns.ds, ns: ns, name: ns.name + "/"}
+	if !hold {
+		ns.mu.RUnlock()
+		k.ns = nil
+	}
+	return k, rest, nil
+}
+
+func (k keyspace) done() {
+	if k.ns != nil {
+		k.ns.mu.RUnlock()
+	}
+}
+
+func (n *namespaces) get(name string) *namespace {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.byName[name]
+}
+
+// list returns the default namespace followed by the others in name order.
+func (n *namespaces) list() []*namespace {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	list := make([]*namespace, 0, len(n.byName)+1)
+	for _, ns := range n.byName {
+		list = append(list, ns)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return append([]*namespace{n.def}, list...)
+}
+
+func (n *namespaces) create(name string, settings namespaceSettings) (*namespace, error) {
+	if !namespaceName.MatchString(name) || name == defaultNamespace {
+		return nil, errBadNamespace
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.byName[name]; ok {
+		return nil, errNamespaceExists
+	}
+	// The new namespace would hide these keys from /db/ paths.
+	for _, key := range n.def.ds.Keys() {
+		if strings.HasPrefix(key, name+"/") {
+			return nil, fmt.Errorf("%w: the default namespace has keys under %s/", errNamespaceExists, name)
+		}
+	}
+
+	dir := filepath.Join(n.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, settingsFileName), data, 0644); err != nil {
+		return nil, err
+	}
+	ns, err := n.open(name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	n.byName[name] = ns
+	return ns, nil
+}
+
+// drop closes a namespace once its requests in flight are done and deletes
+// its data.
+func (n *namespaces) drop(name string) error {
+	n.mu.Lock()
+	ns, ok := n.byName[name]
+	delete(n.byName, name)
+	n.mu.Unlock()
+	if !ok {
+		return errNamespaceNotFound
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.dropped = true
+	if err := ns.ds.Close(); err != nil {
+		log.Printf("failed to close namespace %s: %v", name, err)
+	}
+	return os.RemoveAll(filepath.Join(n.dir, name))
+}
+
+func (n *namespaces) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ns := range n.byName {
+		ns.ds.Close()
+	}
+}
+
+// mergeLoop merges every namespace that has reached its MergeSegments.
+func (n *namespaces) mergeLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, ns := range n.list() {
+			ns.maybeMerge()
+		}
+	}
+}
+
+func (ns *namespace) maybeMerge() {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if ns.dropped || ns.settings.MergeSegments <= 0 || ns.ds.SegmentCount() < ns.settings.MergeSegments {
+		return
+	}
+	if err := ns.ds.Merge(); err != nil {
+		log.Printf("failed to merge namespace %s: %v", ns.name, err)
+	}
+}
+
+// enableNamespaces routes /db/{ns}/{key} to the namespaces and serves the
+// admin endpoints under /namespaces.
+func (s *server) enableNamespaces(n *namespaces) {
+	s.namespaces = n
+	s.mux.HandleFunc("/namespaces", s.handleNamespaces)
+	s.mux.HandleFunc("/namespaces/", s.handleNamespaces)
+}
+
+// replicated reports whether writes to the default namespace go through
+// replication. Other namespaces are local to the node, so they cannot be
+// written in that case.
+func (s *server) replicated() bool {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	return s.raft != nil || s.leader != ""
+}
+
+// handleNamespaces lists namespaces (GET /namespaces), shows one
+// (GET /namespaces/{ns}), creates one with optional settings in the body
+// (POST /namespaces/{ns}) or drops one with all its data
+// (DELETE /namespaces/{ns}).
+func (s *server) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/namespaces"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		infos := []namespaceInfo{}
+		for _, ns := range s.namespaces.list() {
+			infos = append(infos, ns.info())
+		}
+		writeJSON(w, http.StatusOK, infos)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ns := s.namespaces.get(name)
+		if name == defaultNamespace {
+			ns = s.namespaces.def
+		}
+		if ns == nil {
+			http.Error(w, errNamespaceNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, ns.info())
+	case http.MethodPost:
+		if s.replicated() {
+			http.Error(w, "namespaces are not replicated", http.StatusNotImplemented)
+			return
+		}
+		settings := namespaceSettings{MaxSegmentSize: *maxSegmentSize, MergeSegments: *mergeSegments}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&settings); err != nil {
+				http.Error(w, "bad settings", http.StatusBadRequest)
+				return
+			}
+		}
+		if settings.MaxSegmentSize <= 0 || settings.MergeSegments < 0 {
+			http.Error(w, "bad settings", http.StatusBadRequest)
+			return
+		}
+		ns, err := s.namespaces.create(name, settings)
+		switch {
+		case errors.Is(err, errBadNamespace):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errNamespaceExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			log.Printf("failed to create namespace %s: %v", name, err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusCreated, ns.info())
+		}
+	case http.MethodDelete:
+		if name == defaultNamespace {
+			http.Error(w, "the default namespace cannot be dropped", http.StatusBadRequest)
+			return
+		}
+		err := s.namespaces.drop(name)
+		switch {
+		case errors.Is(err, errNamespaceNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			log.Printf("failed to drop namespace %s: %v", name, err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleNamespaceKey(w http.ResponseWriter, r *http.Request, ns *namespace, key string) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if ns.dropped {
+		http.Error(w, errNamespaceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if !checkKey(w, key) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getKey(w, r, ns.ds, key)
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		if s.replicated() {
+			http.Error(w, "namespaces are not replicated", http.StatusNotImplemented)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			deleteKey(w, ns.ds, key)
+		} else {
+			putKey(w, r, ns.ds, key)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := datastore.NewSegmentedDatastore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	nss, err := openNamespaces(dir, ds, namespaceSettings{MaxSegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ds, dir)
+	srv.enableNamespaces(nss)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	putValue(t, ts.URL, "taken/key", "v")
+	if resp := doRequest(t, http.MethodPost, ts.URL+"/namespaces/taken", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("namespace shadowing default keys: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, ts.URL+"/namespaces/Bad!", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad name: status %d", resp.StatusCode)
+	}
+	resp := doRequest(t, http.MethodPost, ts.URL+"/namespaces/team", `{"max_segment_size": 32, "merge_segments": 3}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, ts.URL+"/namespaces/team", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("create twice: status %d", resp.StatusCode)
+	}
+
+	for _, key := range []string{"a", "b/c", "d", "e", "f"} {
+		if status := putValue(t, ts.URL, "team/"+key, "team-"+key); status != http.StatusNoContent {
+			t.Fatalf("put team/%s: status %d", key, status)
+		}
+	}
+	waitForValue(t, ts.URL, "team/b/c", "team-b/c", http.StatusOK)
+	if _, status := getValue(ts.URL, "a"); status != http.StatusNotFound {
+		t.Errorf("namespaced key visible in the default namespace: status %d", status)
+	}
+
+	team := nss.get("team")
+	if team.ds.SegmentCount() < 3 {
+		t.Fatalf("%d segments with a 32 byte segment size", team.ds.SegmentCount())
+	}
+	team.maybeMerge()
+	if n := team.ds.SegmentCount(); n != 1 {
+		t.Errorf("%d segments after merge", n)
+	}
+
+	var infos []namespaceInfo
+	json.NewDecoder(doRequest(t, http.MethodGet, ts.URL+"/namespaces", "").Body).Decode(&infos)
+	if len(infos) != 2 || infos[0].Name != defaultNamespace || infos[1].Name != "team" ||
+		infos[1].Stats.Keys != 5 || infos[1].MaxSegmentSize != 32 || infos[1].MergeSegments != 3 {
+		t.Errorf("unexpected list %+v", infos)
+	}
+
+	// The binary protocol and the listings resolve namespaces like /db/.
+	client := startTCP(t, &testNode{srv: srv, ds: ds, url: ts.URL})
+	if err := client.Put(context.Background(), "team/tcp", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := team.ds.Get("tcp"); err != nil || value != "v" {
+		t.Errorf("TCP put into the namespace: %q, %v", value, err)
+	}
+	if _, err := ds.Get("team/tcp"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("TCP put landed in the default namespace: %v", err)
+	}
+	var keys []string
+	json.NewDecoder(doRequest(t, http.MethodGet, ts.URL+"/keys?prefix=team/b", "").Body).Decode(&keys)
+	if strings.Join(keys, ",") != "team/b/c" {
+		t.Errorf("keys of the namespace: %v", keys)
+	}
+	var items []getResponse
+	json.NewDecoder(doRequest(t, http.MethodGet, ts.URL+"/scan?prefix=team/&after=team/e&limit=1", "").Body).Decode(&items)
+	if len(items) != 1 || items[0] != (getResponse{Key: "team/f", Value: "team-f"}) {
+		t.Errorf("scan of the namespace: %+v", items)
+	}
+	var stats datastore.Stats
+	json.NewDecoder(doRequest(t, http.MethodGet, ts.URL+"/stats?namespace=team", "").Body).Decode(&stats)
+	if stats.Keys != 6 {
+		t.Errorf("stats of the namespace: %+v", stats)
+	}
+	var changes watchResponse
+	json.NewDecoder(doRequest(t, http.MethodGet, ts.URL+"/db/_watch?prefix=team/t&since=0&timeout=1ms", "").Body).Decode(&changes)
+	if len(changes.Changes) != 1 || changes.Changes[0].Key != "team/tcp" {
+		t.Errorf("changes of the namespace: %+v", changes)
+	}
+
+	// Namespaces are found again after a restart.
+	nss.close()
+	if nss, err = openNamespaces(dir, ds, namespaceSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	defer nss.close()
+	srv = newServer(ds, dir)
+	srv.enableNamespaces(nss)
+	ts = httptest.NewServer(srv)
+	defer ts.Close()
+	waitForValue(t, ts.URL, "team/a", "team-a", http.StatusOK)
+
+	if resp := doRequest(t, http.MethodDelete, ts.URL+"/namespaces/team", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("drop: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, ts.URL+"/namespaces/team", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("dropped namespace: status %d", resp.StatusCode)
+	}
+	if _, status := getValue(ts.URL, "team/a"); status != http.StatusNotFound {
+		t.Errorf("key of a dropped namespace: status %d", status)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+	"github.com/DmytroHalai/achitecture-practice-5/raft"
+)
+
+const (
+	raftElectionTicks = 10
+	proposalTimeout   = 5 * time.Second
+	peerQueueSize     = 256
+)
+
+var errCommitTimeout = errors.New("timed out waiting for commit")
+
+// raftCommand is the payload of a log entry.
+type raftCommand struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// datastoreMachine applies committed commands to the SegmentedDatastore.
+type datastoreMachine struct {
+	ds *datastore.SegmentedDatastore
+}
+
+func (m datastoreMachine) Apply(data []byte) error {
+	var cmd raftCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case "put":
+		// The leader checked the sizes before it proposed the entry.
+		return m.ds.PutReplicated(cmd.Key, string(cmd.Value))
+	case "delete":
+		return m.ds.Delete(cmd.Key)
+	}
+	return errors.New("unknown command " + cmd.Op)
+}
+
+// Snapshot pins the current segments; they are read while new entries are
+// applied. Once the snapshot is encoded the segments are merged, so the
+// datastore shrinks along with the Raft log.
+func (m datastoreMachine) Snapshot() (func() ([]byte, error), error) {
+	view := m.ds.View()
+	return func() ([]byte, error) {
+		data, err := view.Snapshot()
+		view.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := m.ds.Merge(); err != nil {
+			log.Printf("failed to merge segments after a Raft snapshot: %v", err)
+		}
+		return data, nil
+	}, nil
+}
+
+func (m datastoreMachine) Restore(data []byte) error {
+	return m.ds.ApplySnapshot(data)
+}
+
+// raftServer runs a raft.Node over HTTP. Node IDs are the base URLs of the
+// db servers, so a follower can point clients at the leader directly.
+type raftServer struct {
+	node   *raft.Node
+	id     string
+	client *http.Client
+
+	mu     sync.Mutex
+	peers  map[string]chan raft.Message
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newRaftServer(node *raft.Node, id string) *raftServer {
+	return &raftServer{
+		node:   node,
+		id:     id,
+		client: &http.Client{Timeout: 5 * time.Second, Transport: peerTransport{}},
+		peers:  make(map[string]chan raft.Message),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (rs *raftServer) run(tick time.Duration) {
+	defer close(rs.done)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			if err := rs.node.Tick(); err != nil {
+				log.Printf("raft tick failed: %v", err)
+			}
+			rs.flush()
+		}
+	}
+}
+
+func (rs *raftServer) close() {
+	close(rs.stop)
+	<-rs.done
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.closed = true
+	for id, ch := range rs.peers {
+		close(ch)
+		delete(rs.peers, id)
+	}
+}
+
+// flush hands pending messages to per-peer senders. A peer that does not
+// keep up loses messages, which Raft tolerates by retrying.
+func (rs *raftServer) flush() {
+	msgs := rs.node.ReadMessages()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return
+	}
+	for _, m := range msgs {
+		select {
+		case rs.peerQueue(m.To) <- m:
+		default:
+		}
+	}
+}
+
+// peerQueue returns the send queue of a peer. The caller must hold rs.mu.
+func (rs *raftServer) peerQueue(id string) chan raft.Message {
+	ch, ok := rs.peers[id]
+	if !ok {
+		ch = make(chan raft.Message, peerQueueSize)
+		rs.peers[id] = ch
+		go rs.send(id, ch)
+	}
+	return ch
+}
+
+func (rs *raftServer) send(id string, ch chan raft.Message) {
+	for m := range ch {
+		body, err := json.Marshal(m)
+		if err != nil {
+			continue
+		}
+		resp, err := rs.client.Post(id+"/raft/message", "application/json", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func (rs *raftServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var m raft.Message
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "bad message", http.StatusBadRequest)
+		return
+	}
+	if err := rs.node.Step(m); err != nil {
+		log.Printf("raft step failed: %v", err)
+		http.Error(w, "raft error", http.StatusInternalServerError)
+		return
+	}
+	rs.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rs *raftServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs.node.Status())
+}
+
+// handleMembers adds (POST) or removes (DELETE) the node given by ?id=.
+func (rs *raftServer) handleMembers(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	var propose func(string) (<-chan error, error)
+	switch r.Method {
+	case http.MethodPost:
+		propose = rs.node.AddNode
+	case http.MethodDelete:
+		propose = rs.node.RemoveNode
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rs.rejectFollowerWrite(w) {
+		return
+	}
+	rs.wait(w, r.Context(), func() (<-chan error, error) { return propose(id) })
+}
+
+// rejectFollowerWrite answers requests that only the leader can serve with
+// 421 and the leader address, like a replication follower does. Clients
+// resend them to the leader themselves, with their credentials.
+func (rs *raftServer) rejectFollowerWrite(w http.ResponseWriter) bool {
+	st := rs.node.Status()
+	if st.State == "leader" {
+		return false
+	}
+	if st.Leader == "" {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set(leaderHeader, st.Leader)
+	http.Error(w, "not the raft leader, write to the leader", http.StatusMisdirectedRequest)
+	return true
+}
+
+// write proposes a command and answers once it is applied.
+func (rs *raftServer) write(w http.ResponseWriter, r *http.Request, cmd raftCommand) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	rs.wait(w, r.Context(), func() (<-chan error, error) { return rs.node.Propose(data) })
+}
+
+func (rs *raftServer) wait(w http.ResponseWriter, ctx context.Context, propose func() (<-chan error, error)) {
+	ch, err := propose()
+	if errors.Is(err, raft.ErrNotLeader) {
+		http.Error(w, "leadership changed, retry", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	err = rs.await(ctx, ch)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, raft.ErrProposalDropped):
+		http.Error(w, "leadership changed, retry", http.StatusServiceUnavailable)
+	case errors.Is(err, errCommitTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		writePutError(w, err)
+	}
+}
+
+// await sends out the proposal and waits until it is applied.
+func (rs *raftServer) await(ctx context.Context, ch <-chan error) error {
+	rs.flush()
+	ctx, cancel := context.WithTimeout(ctx, proposalTimeout)
+	defer cancel()
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return errCommitTimeout
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+	"github.com/DmytroHalai/achitecture-practice-5/raft"
+)
+
+type raftTestNode struct {
+	ts *httptest.Server
+	rs *raftServer
+}
+
+func startRaftCluster(t *testing.T, size int) []*raftTestNode {
+	t.Helper()
+	nodes := make([]*raftTestNode, size)
+	var peers []string
+	for i := range nodes {
+		nodes[i] = &raftTestNode{ts: httptest.NewUnstartedServer(nil)}
+		peers = append(peers, "http://"+nodes[i].ts.Listener.Addr().String())
+	}
+	for i, n := range nodes {
+		dir := t.TempDir()
+		ds, err := datastore.NewSegmentedDatastore(dir, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := raft.NewNode(raft.Config{
+			ID:                     peers[i],
+			Peers:                  peers,
+			ElectionTicks:          raftElectionTicks,
+			SnapshotEntries:        20,
+			StateMachine:           datastoreMachine{ds: ds},
+			PersistentStateMachine: true,
+			Storage:                raft.NewMemoryStorage(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := newServer(ds, dir)
+		n.rs = newRaftServer(node, peers[i])
+		srv.enableRaft(n.rs)
+		n.ts.Config.Handler = srv
+		n.ts.Start()
+		go n.rs.run(10 * time.Millisecond)
+		t.Cleanup(func() {
+			n.stop()
+			ds.Close()
+		})
+	}
+	return nodes
+}
+
+func (n *raftTestNode) stop() {
+	select {
+	case <-n.rs.done:
+		return
+	default:
+	}
+	n.rs.close()
+	n.ts.Close()
+}
+
+func waitForLeader(t *testing.T, nodes []*raftTestNode) *raftTestNode {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			select {
+			case <-n.rs.done:
+				continue
+			default:
+			}
+			if n.rs.node.Status().State == "leader" && knownLeader(nodes, n.rs.id) {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// knownLeader reports whether every running node follows the given leader,
+// so a write sent to any of them names it.
+func knownLeader(nodes []*raftTestNode, leader string) bool {
+	for _, n := range nodes {
+		select {
+		case <-n.rs.done:
+			continue
+		default:
+		}
+		if n.rs.node.Status().Leader != leader {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRaftCluster(t *testing.T) {
+	nodes := startRaftCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	var follower *raftTestNode
+	for _, n := range nodes {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+
+	// A follower names the leader, and dbclient resends the write there.
+	body, _ := json.Marshal(putRequest{Value: "value"})
+	resp, err := http.Post(follower.ts.URL+"/db/key", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest || resp.Header.Get(leaderHeader) != leader.rs.id {
+		t.Fatalf("put on follower: status %d, leader %q", resp.StatusCode, resp.Header.Get(leaderHeader))
+	}
+	if err := dbclient.New(follower.ts.URL).Put(context.Background(), "key", "value"); err != nil {
+		t.Fatalf("put through follower: %v", err)
+	}
+	for _, n := range nodes {
+		waitForValue(t, n.ts.URL, "key", "value", http.StatusOK)
+	}
+
+	for i := 0; i < 30; i++ {
+		putValue(t, leader.ts.URL, "counter", "v")
+	}
+	if st := leader.rs.node.Status(); st.Snapshot == 0 {
+		t.Errorf("leader did not take a snapshot: %+v", st)
+	}
+
+	// Losing the leader leaves a majority that elects a new one.
+	leader.stop()
+	var rest []*raftTestNode
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	newLeader := waitForLeader(t, rest)
+	if status := putValue(t, newLeader.ts.URL, "key", "after-failover"); status != http.StatusNoContent {
+		t.Fatalf("put after failover: status %d", status)
+	}
+	for _, n := range rest {
+		waitForValue(t, n.ts.URL, "key", "after-failover", http.StatusOK)
+	}
+
+	resp, err = http.Get(newLeader.ts.URL + "/raft/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st raft.Status
+	json.NewDecoder(resp.Body).Decode(&st)
+	if st.State != "leader" || len(st.Peers) != 3 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestDatastoreMachine(t *testing.T) {
+	ds, err := datastore.NewSegmentedDatastore(t.TempDir(), 64, datastore.WithMaxValueSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	m := datastoreMachine{ds: ds}
+
+	// The leader accepted the entries, so the local limit does not apply.
+	for i := 0; i < 10; i++ {
+		data, _ := json.Marshal(raftCommand{Op: "put", Key: fmt.Sprint("key", i%3), Value: []byte("a long value")})
+		if err := m.Apply(data); err != nil {
+			t.Fatalf("apply %d: %v", i, err)
+		}
+	}
+	if ds.SegmentCount() < 2 {
+		t.Fatalf("%d segments before the snapshot", ds.SegmentCount())
+	}
+
+	encode, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ds.SegmentCount(); n != 1 {
+		t.Errorf("%d segments after the snapshot, want them merged", n)
+	}
+
+	restored, err := datastore.NewSegmentedDatastore(t.TempDir(), 64, datastore.WithMaxValueSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := (datastoreMachine{ds: restored}).Restore(data); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if value, err := restored.Get("key2"); err != nil || value != "a long value" {
+		t.Errorf("restored key2: %q, %v", value, err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+const (
+	logSegmentHeader = "Db-Log-Segment"
+	logOffsetHeader  = "Db-Log-Offset"
+	leaderHeader     = "Db-Leader"
+
+	// positionFileName keeps the follower's place in the leader's log, so a
+	// restarted follower continues where it stopped.
+	positionFileName = "replication.json"
+	maxLogChunk      = 1 << 20
+)
+
+var replicationClient = &http.Client{Timeout: 10 * time.Second, Transport: peerTransport{}}
+
+// replication is the follower side state of a server. A server that does not
+// follow a leader is itself the leader and accepts writes.
+type replication struct {
+	replMu   sync.Mutex
+	leader   string
+	position datastore.LogPosition
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type statusResponse struct {
+	Role     string                `json:"role"`
+	Leader   string                `json:"leader,omitempty"`
+	Position datastore.LogPosition `json:"position"`
+}
+
+// handleLog ships the records following the requested position.
+func (s *server) handleLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pos := datastore.LogPosition{Segment: r.URL.Query().Get("segment")}
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		var err error
+		if pos.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			http.Error(w, "bad offset", http.StatusBadRequest)
+			return
+		}
+	}
+	data, next, err := s.ds.ReadLog(pos, maxLogChunk)
+	if errors.Is(err, datastore.ErrPositionGone) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read log at %s: %v", pos, err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeLogResponse(w, data, next)
+}
+
+// handleSnapshot ships the full current state for followers whose position
+// was merged away.
+func (s *server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, pos, err := s.ds.Snapshot()
+	if err != nil {
+		log.Printf("failed to take snapshot: %v", err)
+		http.Error(w, "db error", http.StatusInternalServerError)
+		return
+	}
+	writeLogResponse(w, data, pos)
+}
+
+func writeLogResponse(w http.ResponseWriter, data []byte, next datastore.LogPosition) {
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set(logSegmentHeader, next.Segment)
+	w.Header().Set(logOffsetHeader, strconv.FormatInt(next.Offset, 10))
+	w.Write(data)
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// handlePromote turns a follower into a leader. The follower stops tailing
+// after the batch it is applying and starts accepting writes.
+func (s *server) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.promote()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+func (s *server) status() statusResponse {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	resp := statusResponse{Role: "leader", Leader: s.leader, Position: s.position}
+	if s.leader != "" {
+		resp.Role = "follower"
+	}
+	return resp
+}
+
+// rejectFollowerWrite answers writes sent to a follower with 421 and the
+// leader address.
+func (s *server) rejectFollowerWrite(w http.ResponseWriter) bool {
+	s.replMu.Lock()
+	leader := s.leader
+	s.replMu.Unlock()
+	if leader == "" {
+		return false
+	}
+	w.Header().Set(leaderHeader, leader)
+	http.Error(w, "read-only follower, write to the leader", http.StatusMisdirectedRequest)
+	return true
+}
+
+// follow starts tailing the leader's log in the background.
+func (s *server) follow(leader string, interval time.Duration) {
+	pos, err := loadPosition(s.dir)
+	if err != nil {
+		log.Printf("failed to load replication position, starting from scratch: %v", err)
+	}
+
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	s.leader = leader
+	s.position = pos
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.tail(leader, interval, s.stop, s.done)
+}
+
+func (s *server) promote() {
+	s.replMu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.replMu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	s.replMu.Lock()
+	log.Printf("Promoted to leader at %s, was following %s", s.position, s.leader)
+	s.leader = ""
+	s.replMu.Unlock()
+}
+
+func (s *server) tail(leader string, interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		caughtUp, err := s.pull(leader)
+		if err != nil {
+			log.Printf("replication from %s failed: %v", leader, err)
+		}
+		wait := time.Duration(0)
+		if caughtUp || err != nil {
+			wait = interval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pull applies one batch of records from the leader and reports whether the
+// follower has caught up.
+func (s *server) pull(leader string) (bool, error) {
+	s.replMu.Lock()
+	pos := s.position
+	s.replMu.Unlock()
+
+	query := url.Values{}
+	query.Set("segment", pos.Segment)
+	query.Set("offset", strconv.FormatInt(pos.Offset, 10))
+	data, next, status, err := fetchLog(leader + "/replication/log?" + query.Encode())
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusGone {
+		log.Printf("position %s is gone on the leader, resyncing from a snapshot", pos)
+		return false, s.resync(leader)
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d from the leader", status)
+	}
+	if err := s.ds.ApplyLog(data); err != nil {
+		return false, fmt.Errorf("failed to apply records at %s: %w", pos, err)
+	}
+	if next == pos {
+		return true, nil
+	}
+	return false, s.setPosition(next)
+}
+
+func (s *server) resync(leader string) error {
+	data, next, status, err := fetchLog(leader + "/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from the leader", status)
+	}
+	if err := s.ds.ApplySnapshot(data); err != nil {
+		return fmt.Errorf("failed to apply snapshot: %w", err)
+	}
+	return s.setPosition(next)
+}
+
+func fetchLog(u string) ([]byte, datastore.LogPosition, int, error) {
+	resp, err := replicationClient.Get(u)
+	if err != nil {
+		return nil, datastore.LogPosition{}, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, datastore.LogPosition{}, resp.StatusCode, nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, datastore.LogPosition{}, 0, err
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(logOffsetHeader), 10, 64)
+	if err != nil {
+		return nil, datastore.LogPosition{}, 0, fmt.Errorf("bad %s header: %w", logOffsetHeader, err)
+	}
+	next := datastore.LogPosition{Segment: resp.Header.Get(logSegmentHeader), Offset: offset}
+	return data, next, resp.StatusCode, nil
+}
+
+func (s *server) setPosition(pos datastore.LogPosition) error {
+	s.replMu.Lock()
+	s.position = pos
+	s.replMu.Unlock()
+	return savePosition(s.dir, pos)
+}
+
+func loadPosition(dir string) (datastore.LogPosition, error) {
+	var pos datastore.LogPosition
+	data, err := os.ReadFile(filepath.Join(dir, positionFileName))
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, err
+	}
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+func savePosition(dir string, pos datastore.LogPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, positionFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, positionFileName))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+type testNode struct {
+	srv *server
+	ds  *datastore.SegmentedDatastore
+	url string
+}
+
+func startNode(t testing.TB) *testNode {
+	t.Helper()
+	dir := t.TempDir()
+	ds, err := datastore.NewSegmentedDatastore(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ds, dir)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		srv.promote()
+		ts.Close()
+		ds.Close()
+	})
+	return &testNode{srv: srv, ds: ds, url: ts.URL}
+}
+
+func putValue(t *testing.T, baseURL, key, value string) int {
+	t.Helper()
+	body, _ := json.Marshal(putRequest{Value: value})
+	resp, err := http.Post(baseURL+"/db/"+key, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func getValue(baseURL, key string) (string, int) {
+	resp, err := http.Get(baseURL + "/db/" + key)
+	if err != nil {
+		return "", 0
+	}
+	defer resp.Body.Close()
+	var got getResponse
+	json.NewDecoder(resp.Body).Decode(&got)
+	return got.Value, resp.StatusCode
+}
+
+func waitForValue(t *testing.T, baseURL, key, want string, wantStatus int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		value, status := getValue(baseURL, key)
+		if status == wantStatus && value == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: got %q (status %d), wanted %q (status %d)", key, value, status, want, wantStatus)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader := startNode(t)
+	follower := startNode(t)
+	follower.srv.follow(leader.url, 10*time.Millisecond)
+
+	for i := 0; i < 30; i++ {
+		if status := putValue(t, leader.url, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); status != http.StatusNoContent {
+			t.Fatalf("put to leader: status %d", status)
+		}
+	}
+	waitForValue(t, follower.url, "key29", "value29", http.StatusOK)
+	waitForValue(t, follower.url, "key0", "value0", http.StatusOK)
+
+	if status := putValue(t, follower.url, "key0", "other"); status != http.StatusMisdirectedRequest {
+		t.Errorf("write to follower: expected 421, got %d", status)
+	}
+
+	if err := leader.ds.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, follower.url, "key1", "", http.StatusNotFound)
+
+	// A merge removes the segment the follower points at, so it has to
+	// resync from a snapshot.
+	if err := leader.ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	putValue(t, leader.url, "after-merge", "value")
+	waitForValue(t, follower.url, "after-merge", "value", http.StatusOK)
+	waitForValue(t, follower.url, "key1", "", http.StatusNotFound)
+	waitForValue(t, follower.url, "key2", "value2", http.StatusOK)
+
+	resp, err := http.Post(follower.url+"/replication/promote", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status statusResponse
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Role != "leader" {
+		t.Errorf("expected the follower to become the leader, got %+v", status)
+	}
+	if status := putValue(t, follower.url, "key0", "promoted"); status != http.StatusNoContent {
+		t.Errorf("write to promoted follower: status %d", status)
+	}
+	waitForValue(t, follower.url, "key0", "promoted", http.StatusOK)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+	"github.com/DmytroHalai/achitecture-practice-5/raft"
+)
+
+// serveTCP answers the binary protocol described in package dbclient on
+// every connection accepted from l.
+func (s *server) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn executes requests in the order they arrive. Responses are
+// buffered while more pipelined requests are already waiting, so a batch of
+// requests is answered with a single write.
+func (s *server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+	// Connections start unauthenticated if tokens are required.
+	id := anonymous
+	if s.auth != nil {
+		id = nil
+	}
+	for {
+		op, key, value, err := dbclient.ReadFrame(in,
+			datastore.WithMaxKeySize(*maxKeySize),
+			datastore.WithMaxValueSize(*maxValueSize))
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			// The stream cannot be resynchronised after a bad frame.
+			dbclient.WriteFrame(out, byte(dbclient.StatusFailed), "", err.Error())
+			out.Flush()
+			return
+		}
+		var status dbclient.Status
+		var payload string
+		if dbclient.Op(op) == dbclient.OpAuth {
+			status, id = s.authenticateConn(value, id)
+		} else {
+			status, payload = s.execute(id, dbclient.Op(op), key, value)
+			if op := dbclient.Op(op); op == dbclient.OpPut || op == dbclient.OpDelete {
+				s.auditConn(conn, id, op, key, status)
+			}
+		}
+		if err := dbclient.WriteFrame(out, byte(status), "", payload); err != nil {
+			return
+		}
+		if in.Buffered() == 0 {
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// authenticateConn switches the connection to the identity of token. A bad
+// token leaves the connection unauthenticated.
+func (s *server) authenticateConn(token string, id *identity) (dbclient.Status, *identity) {
+	if s.auth == nil {
+		return dbclient.StatusOK, id
+	}
+	newID, err := s.auth.identify(token)
+	if err != nil {
+		return dbclient.StatusUnauthorized, nil
+	}
+	return dbclient.StatusOK, newID
+}
+
+func (s *server) auditConn(conn net.Conn, id *identity, op dbclient.Op, key string, status dbclient.Status) {
+	if s.audit == nil {
+		return
+	}
+	if id == nil {
+		id = anonymous
+	}
+	// Recorded like the equivalent HTTP request.
+	method := http.MethodPut
+	if op == dbclient.OpDelete {
+		method = http.MethodDelete
+	}
+	s.audit.record(auditRecord{
+		Identity: id.name,
+		Op:       method,
+		Target:   "/db/" + key,
+		Remote:   conn.RemoteAddr().String(),
+		Status:   httpStatus[status],
+	})
+}
+
+// httpStatus maps binary statuses to HTTP ones for the audit log.
+var httpStatus = map[dbclient.Status]int{
+	dbclient.StatusOK:           http.StatusNoContent,
+	dbclient.StatusNotFound:     http.StatusNotFound,
+	dbclient.StatusTooLarge:     http.StatusRequestEntityTooLarge,
+	dbclient.StatusNotLeader:    http.StatusMisdirectedRequest,
+	dbclient.StatusFailed:       http.StatusInternalServerError,
+	dbclient.StatusUnauthorized: http.StatusUnauthorized,
+	dbclient.StatusForbidden:    http.StatusForbidden,
+}
+
+// execute runs a request. Keys are resolved into namespaces like /db/ paths.
+func (s *server) execute(id *identity, op dbclient.Op, key, value string) (dbclient.Status, string) {
+	if id == nil {
+		return dbclient.StatusUnauthorized, ""
+	}
+	if key == "" {
+		return dbclient.StatusFailed, "missing key"
+	}
+	if s.auth != nil && (op == dbclient.OpGet && !id.canRead(key) || op != dbclient.OpGet && !id.canWrite(key)) {
+		return dbclient.StatusForbidden, ""
+	}
+	k, nsKey, err := s.keyspace(key, true)
+	if err != nil {
+		return dbclient.StatusNotFound, ""
+	}
+	defer k.done()
+	if k.ns != nil {
+		return s.executeNamespace(k.ds, op, nsKey, value)
+	}
+	switch op {
+	case dbclient.OpGet:
+		value, err := s.ds.Get(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			return dbclient.StatusNotFound, ""
+		}
+		if err != nil {
+			log.Printf("failed to read %q: %v", key, err)
+			return dbclient.StatusFailed, "db error"
+		}
+		return dbclient.StatusOK, value
+	case dbclient.OpPut:
+		return s.executeWrite(raftCommand{Op: "put", Key: key, Value: []byte(value)})
+	case dbclient.OpDelete:
+		return s.executeWrite(raftCommand{Op: "delete", Key: key})
+	}
+	return dbclient.StatusFailed, "unknown op"
+}
+
+// executeNamespace runs a request against a namespace. Namespaces are local
+// to the node, so they cannot be written while it replicates.
+func (s *server) executeNamespace(ds *datastore.SegmentedDatastore, op dbclient.Op, key, value string) (dbclient.Status, string) {
+	if key == "" {
+		return dbclient.StatusFailed, "missing key"
+	}
+	if op != dbclient.OpGet && s.replicated() {
+		return dbclient.StatusFailed, "namespaces are not replicated"
+	}
+	var err error
+	switch op {
+	case dbclient.OpGet:
+		value, err := ds.Get(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			return dbclient.StatusNotFound, ""
+		}
+		if err != nil {
+			log.Printf("failed to read %q: %v", key, err)
+			return dbclient.StatusFailed, "db error"
+		}
+		return dbclient.StatusOK, value
+	case dbclient.OpPut:
+		err = ds.Put(key, value)
+	case dbclient.OpDelete:
+		err = ds.Delete(key)
+	default:
+		return dbclient.StatusFailed, "unknown op"
+	}
+	return writeStatus(err, key)
+}
+
+func (s *server) executeWrite(cmd raftCommand) (dbclient.Status, string) {
+	s.replMu.Lock()
+	leader := s.leader
+	s.replMu.Unlock()
+	if leader != "" {
+		return dbclient.StatusNotLeader, leader
+	}
+
+	var err error
+	switch {
+	case s.raft != nil:
+		err = s.raftWrite(cmd)
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrProposalDropped) {
+			return dbclient.StatusNotLeader, s.raft.node.Status().Leader
+		}
+	case cmd.Op == "put":
+		err = s.ds.Put(cmd.Key, string(cmd.Value))
+	default:
+		err = s.ds.Delete(cmd.Key)
+	}
+	return writeStatus(err, cmd.Key)
+}
+
+// writeStatus maps the result of a write to its binary status.
+func writeStatus(err error, key string) (dbclient.Status, string) {
+	switch {
+	case err == nil:
+		return dbclient.StatusOK, ""
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		return dbclient.StatusTooLarge, ""
+	default:
+		log.Printf("failed to write %q: %v", key, err)
+		return dbclient.StatusFailed, err.Error()
+	}
+}
+
+func (s *server) raftWrite(cmd raftCommand) error {
+	if len(cmd.Value) > *maxValueSize {
+		return datastore.ErrValueTooLarge
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	ch, err := s.raft.node.Propose(data)
+	if err != nil {
+		return err
+	}
+	return s.raft.await(context.Background(), ch)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+)
+
+func startTCP(tb testing.TB, node *testNode) *dbclient.TCPClient {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go node.srv.serveTCP(l)
+	client, err := dbclient.DialTCP(context.Background(), l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		l.Close()
+	})
+	return client
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	node := startNode(t)
+	client := startTCP(t, node)
+	ctx := context.Background()
+
+	if err := client.Put(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("get: %q, %v", value, err)
+	}
+	if value, _ := getValue(node.url, "key"); value != "value" {
+		t.Errorf("value written over TCP is not visible over HTTP: %q", value)
+	}
+	if err := client.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "key"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("get deleted key: got %v, want ErrNotFound", err)
+	}
+
+	var reqs []dbclient.Request
+	for i := 0; i < 100; i++ {
+		reqs = append(reqs, dbclient.Request{Op: dbclient.OpPut, Key: fmt.Sprintf("k%d", i), Value: fmt.Sprint(i)})
+		reqs = append(reqs, dbclient.Request{Op: dbclient.OpGet, Key: fmt.Sprintf("k%d", i)})
+	}
+	results, err := client.Do(ctx, reqs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if put := results[2*i]; put.Err != nil {
+			t.Fatalf("pipelined put %d: %v", i, put.Err)
+		}
+		if get := results[2*i+1]; get.Err != nil || get.Value != fmt.Sprint(i) {
+			t.Fatalf("pipelined get %d: %q, %v", i, get.Value, get.Err)
+		}
+	}
+
+	if err := client.Put(ctx, "big", strings.Repeat("x", *maxValueSize+1)); err == nil {
+		t.Error("oversized value was accepted")
+	}
+}
+
+func TestBinaryProtocolFollower(t *testing.T) {
+	leader := startNode(t)
+	follower := startNode(t)
+	follower.srv.follow(leader.url, 10*time.Millisecond)
+	client := startTCP(t, follower)
+
+	err := client.Put(context.Background(), "key", "value")
+	if !errors.Is(err, dbclient.ErrReadOnly) || !strings.Contains(err.Error(), leader.url) {
+		t.Errorf("write to a follower: got %v", err)
+	}
+}
+
+func benchmarkNode(b *testing.B) *testNode {
+	node := startNode(b)
+	for i := 0; i < 1000; i++ {
+		if err := node.ds.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return node
+}
+
+func BenchmarkGetHTTP(b *testing.B) {
+	client := dbclient.New(benchmarkNode(b).url)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Get(ctx, fmt.Sprintf("key%d", i%1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetTCP(b *testing.B) {
+	client := startTCP(b, benchmarkNode(b))
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Get(ctx, fmt.Sprintf("key%d", i%1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetTCPPipelined(b *testing.B) {
+	client := startTCP(b, benchmarkNode(b))
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 100 {
+		reqs := make([]dbclient.Request, min(100, b.N-i))
+		for j := range reqs {
+			reqs[j] = dbclient.Request{Op: dbclient.OpGet, Key: fmt.Sprintf("key%d", (i+j)%1000)}
+		}
+		if _, err := client.Do(ctx, reqs...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPutHTTP(b *testing.B) {
+	client := dbclient.New(startNode(b).url)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key%d", i%1000), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPutTCP(b *testing.B) {
+	client := startTCP(b, startNode(b))
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key%d", i%1000), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+const (
+	eventStream = "text/event-stream"
+
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+	// keepAliveInterval keeps idle event streams from being closed by
+	// proxies and lets clients learn how far the feed has moved.
+	keepAliveInterval = 15 * time.Second
+)
+
+// watchResponse is a page of the change feed. Reset is set when the changes
+// the client asked for are gone, because it fell behind or the node
+// restarted: it has to re-read the keys and continue from Next.
+type watchResponse struct {
+	Changes []datastore.Change `json:"changes"`
+	Next    uint64             `json:"next"`
+	Reset   bool               `json:"reset,omitempty"`
+}
+
+// handleWatch serves the change feed at /db/_watch, and at /watch for
+// clients that would rather not go through the key space. With Accept:
+// text/event-stream the changes are streamed as Server-Sent Events, otherwise
+// the request is a long poll that returns as soon as there are changes or the
+// timeout expires. The feed resumes after ?since=seq, or after the
+// Last-Event-ID of a reconnecting event stream; without either it starts at
+// the current end. A since that is too old or from before a restart is
+// answered with 410 Gone, reset set and the current sequence number; an event
+// stream ends with a reset event carrying the same body. A prefix starting
+// with "{ns}/" watches namespace ns, whose sequence numbers are its own.
+func (s *server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	// The request may wait for minutes, so it does not hold the namespace.
+	k, prefix, err := s.keyspace(query.Get("prefix"), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	since := k.ds.ChangeSeq()
+	if v := query.Get("since"); v != "" || r.Header.Get("Last-Event-ID") != "" {
+		if v == "" {
+			v = r.Header.Get("Last-Event-ID")
+		}
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, _, err := k.ds.Changes(since, prefix); errors.Is(err, datastore.ErrChangesGone) {
+		k.writeGone(w)
+		return
+	}
+
+	if accepts(r, eventStream) {
+		k.streamChanges(w, r, since, prefix)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if v := query.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, "bad timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxPollTimeout)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	changes, next, err := k.ds.WatchChanges(ctx, since, prefix)
+	switch {
+	case errors.Is(err, datastore.ErrChangesGone):
+		k.writeGone(w)
+		return
+	case err != nil && r.Context().Err() != nil:
+		return
+	}
+	writeJSON(w, http.StatusOK, watchResponse{Changes: k.paths(changes), Next: next})
+}
+
+// paths turns the keys of changes into their /db/ paths.
+func (k keyspace) paths(changes []datastore.Change) []datastore.Change {
+	out := make([]datastore.Change, len(changes))
+	for i, change := range changes {
+		change.Key = k.name + change.Key
+		out[i] = change
+	}
+	return out
+}
+
+func (k keyspace) streamChanges(w http.ResponseWriter, r *http.Request, since uint64, prefix string) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", eventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), keepAliveInterval)
+		changes, next, err := k.ds.WatchChanges(ctx, since, prefix)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+		if errors.Is(err, datastore.ErrChangesGone) {
+			// The client fell behind. It has to re-read the keys
+			// before it reconnects from the new sequence number.
+			data, _ := json.Marshal(k.resetResponse())
+			fmt.Fprintf(w, "event: reset\ndata: %s\n\n", data)
+			rc.Flush()
+			return
+		}
+		for _, change := range k.paths(changes) {
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, data)
+		}
+		if len(changes) == 0 {
+			// An event without data is not dispatched, but it moves the
+			// Last-Event-ID the client resumes from.
+			fmt.Fprintf(w, ": keep-alive\nid: %d\n\n", next)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		since = next
+	}
+}
+
+func (k keyspace) writeGone(w http.ResponseWriter) {
+	writeJSON(w, http.StatusGone, k.resetResponse())
+}
+
+func (k keyspace) resetResponse() watchResponse {
+	return watchResponse{Changes: []datastore.Change{}, Next: k.ds.ChangeSeq(), Reset: true}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
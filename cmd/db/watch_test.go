@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollChanges(t *testing.T, url string) (watchResponse, int) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got watchResponse
+	json.NewDecoder(resp.Body).Decode(&got)
+	return got, resp.StatusCode
+}
+
+func TestWatchLongPoll(t *testing.T) {
+	node := startNode(t)
+	start, status := pollChanges(t, node.url+"/db/_watch?timeout=1ms")
+	if status != http.StatusOK || len(start.Changes) != 0 {
+		t.Fatalf("empty poll: %+v, status %d", start, status)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		node.ds.Put("other", "v")
+		node.ds.Put("config/a", "v")
+	}()
+	url := fmt.Sprintf("%s/db/_watch?prefix=config/&since=%d", node.url, start.Next)
+	got, status := pollChanges(t, url)
+	if status != http.StatusOK || len(got.Changes) != 1 || got.Changes[0].Key != "config/a" {
+		t.Fatalf("got %+v, status %d", got, status)
+	}
+	if got.Next != start.Next+2 {
+		t.Errorf("next advanced by %d, want 2", got.Next-start.Next)
+	}
+
+	gone, status := pollChanges(t, fmt.Sprintf("%s/db/_watch?since=%d", node.url, got.Next+100))
+	if status != http.StatusGone || !gone.Reset || gone.Next != got.Next {
+		t.Errorf("unknown since: got %+v, status %d, want a reset to %d", gone, status, got.Next)
+	}
+
+	// _watch is the feed, not a key, and /watch serves the same feed.
+	if status := putValue(t, node.url, "_watch", "v"); status != http.StatusMethodNotAllowed {
+		t.Errorf("put _watch: status %d", status)
+	}
+	alias, status := pollChanges(t, fmt.Sprintf("%s/watch?since=%d&timeout=1ms", node.url, got.Next))
+	if status != http.StatusOK || alias.Next != got.Next {
+		t.Errorf("/watch: got %+v, status %d", alias, status)
+	}
+}
+
+func TestWatchEventStream(t *testing.T) {
+	node := startNode(t)
+	start, _ := pollChanges(t, node.url+"/db/_watch?timeout=1ms")
+	putValue(t, node.url, "config/a", "v")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, node.url+"/db/_watch?prefix=config/", nil)
+	req.Header.Set("Accept", eventStream)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(start.Next))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != eventStream {
+		t.Fatalf("content type %q", ct)
+	}
+
+	go node.ds.Delete("config/b")
+	lines := bufio.NewScanner(resp.Body)
+	var events []string
+	for len(events) < 2 && lines.Scan() {
+		if event, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+			lines.Scan()
+			events = append(events, event+" "+lines.Text())
+		}
+	}
+	want := []string{
+		`put data: {"seq":` + fmt.Sprint(start.Next+1) + `,"op":"put","key":"config/a"}`,
+		`delete data: {"seq":` + fmt.Sprint(start.Next+2) + `,"op":"delete","key":"config/b"}`,
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events\n%s\nwant\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+}
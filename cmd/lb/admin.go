@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+var (
+	// editMu serializes pool changes made through the admin API and config
+	// reloads.
+	editMu sync.Mutex
+	// overlay holds the changes made through the admin API.
+	overlay = newAdminOverlay()
+)
+
+// adminOverlay records the backends added and removed and the weights set
+// through the admin API, so they can be applied again on top of a config
+// that is reloaded from the file.
+type adminOverlay struct {
+	added   []string
+	removed map[string]bool
+	weights map[string]int
+}
+
+func newAdminOverlay() *adminOverlay {
+	return &adminOverlay{removed: make(map[string]bool), weights: make(map[string]int)}
+}
+
+func (o *adminOverlay) add(addr string) {
+	delete(o.removed, addr)
+	if !slices.Contains(o.added, addr) {
+		o.added = append(o.added, addr)
+	}
+}
+
+func (o *adminOverlay) remove(addr string) {
+	o.added = slices.DeleteFunc(o.added, func(b string) bool { return b == addr })
+	o.removed[addr] = true
+	delete(o.weights, addr)
+}
+
+// apply returns a copy of c with the recorded changes.
+func (o *adminOverlay) apply(c *config) *config {
+	next := *c
+	next.Backends = slices.DeleteFunc(slices.Clone(c.Backends), func(b string) bool { return o.removed[b] })
+	for _, addr := range o.added {
+		if !slices.Contains(next.Backends, addr) {
+			next.Backends = append(next.Backends, addr)
+		}
+	}
+	next.Weights = maps.Clone(c.Weights)
+	if next.Weights == nil {
+		next.Weights = make(map[string]int)
+	}
+	maps.Copy(next.Weights, o.weights)
+	maps.DeleteFunc(next.Weights, func(backend string, _ int) bool {
+		return !slices.Contains(next.Backends, backend)
+	})
+	return &next
+}
+
+// reloadConfig makes c, as loaded from the config file, the current config
+// with the admin API changes applied on top.
+func reloadConfig(c *config) error {
+	editMu.Lock()
+	defer editMu.Unlock()
+	next := overlay.apply(c)
+	if err := next.validate(); err != nil {
+		return fmt.Errorf("with the admin API changes: %w", err)
+	}
+	applyConfig(next)
+	return nil
+}
+
+// adminHandler serves the admin API:
+//
+//	GET    /backends                    pool members and their state
+//	POST   /backends                    add {"addr": "host:port"}
+//	DELETE /backends/{addr}             remove, draining its requests
+//	POST   /backends/{addr}/drain       stop sending new requests
+//	POST   /backends/{addr}/maintenance stop sending requests and probing
+//	POST   /backends/{addr}/activate    back to normal
+//	PUT    /backends/{addr}/weight      set {"weight": n}
+//
+// Backends added or removed and weights set here are kept across config
+// reloads: they are applied again on top of the reloaded file, so a backend
+// removed here stays removed even though the file lists it.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, poolStatus())
+	})
+	mux.HandleFunc("POST /backends", handleAddBackend)
+	mux.HandleFunc("DELETE /backends/{addr}", handleRemoveBackend)
+	mux.HandleFunc("PUT /backends/{addr}/weight", handleSetWeight)
+	for action, mode := range map[string]string{
+		"drain":       modeDraining,
+		"maintenance": modeMaintenance,
+		"activate":    modeActive,
+	} {
+		mux.HandleFunc("POST /backends/{addr}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			addr := r.PathValue("addr")
+			if err := setMode(addr, mode); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeMember(w, http.StatusOK, addr)
+		})
+	}
+	return mux
+}
+
+func handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Addr string `json:"addr"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil || body.Addr == "" {
+		http.Error(w, `expected {"addr": "host:port"}`, http.StatusBadRequest)
+		return
+	}
+	err := editBackends(func(backends []string) ([]string, error) {
+		if slices.Contains(backends, body.Addr) {
+			return nil, errBackendExists
+		}
+		return append(backends, body.Addr), nil
+	}, func(o *adminOverlay) { o.add(body.Addr) })
+	switch {
+	case errors.Is(err, errBackendExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeMember(w, http.StatusCreated, body.Addr)
+	}
+}
+
+func handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	err := editBackends(func(backends []string) ([]string, error) {
+		if !slices.Contains(backends, addr) {
+			return nil, errUnknownBackend
+		}
+		return slices.DeleteFunc(backends, func(b string) bool { return b == addr }), nil
+	}, func(o *adminOverlay) { o.remove(addr) })
+	switch {
+	case errors.Is(err, errUnknownBackend):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleSetWeight(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	var body struct {
+		Weight int `json:"weight"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, `expected {"weight": n}`, http.StatusBadRequest)
+		return
+	}
+	err := editConfig(func(c *config) error {
+		if !slices.Contains(c.Backends, addr) {
+			return errUnknownBackend
+		}
+		c.Weights[addr] = body.Weight
+		return nil
+	}, func(o *adminOverlay) { o.weights[addr] = body.Weight })
+	switch {
+	case errors.Is(err, errUnknownBackend):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeMember(w, http.StatusOK, addr)
+	}
+}
+
+var errBackendExists = errors.New("backend already exists")
+
+// editBackends applies a config whose backend list is changed by edit.
+// Removed backends lose their weight.
+func editBackends(edit func(backends []string) ([]string, error), record func(o *adminOverlay)) error {
+	return editConfig(func(c *config) error {
+		backends, err := edit(c.Backends)
+		if err != nil {
+			return err
+		}
+		c.Backends = backends
+		maps.DeleteFunc(c.Weights, func(backend string, _ int) bool {
+			return !slices.Contains(backends, backend)
+		})
+		return nil
+	}, record)
+}
+
+// editConfig applies a copy of the current config changed by edit and, if
+// it is valid, lets record add the change to the overlay.
+func editConfig(edit func(c *config) error, record func(o *adminOverlay)) error {
+	editMu.Lock()
+	defer editMu.Unlock()
+	next := *currentConfig()
+	next.Backends = slices.Clone(next.Backends)
+	next.Weights = maps.Clone(next.Weights)
+	if next.Weights == nil {
+		next.Weights = make(map[string]int)
+	}
+	if err := edit(&next); err != nil {
+		return err
+	}
+	if err := next.validate(); err != nil {
+		return err
+	}
+	record(overlay)
+	applyConfig(&next)
+	return nil
+}
+
+func writeMember(w http.ResponseWriter, status int, addr string) {
+	for _, m := range poolStatus() {
+		if m.Addr == addr {
+			writeJSON(w, status, m)
+			return
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
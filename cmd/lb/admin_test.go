@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method, url, body string) (*http.Response, memberStatus) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var m memberStatus
+	json.NewDecoder(resp.Body).Decode(&m)
+	return resp, m
+}
+
+func listBackends(t *testing.T, url string) map[string]memberStatus {
+	t.Helper()
+	resp, err := http.Get(url + "/backends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []memberStatus
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	byAddr := make(map[string]memberStatus)
+	for _, m := range list {
+		byAddr[m.Addr] = m
+	}
+	return byAddr
+}
+
+// startAdmin serves the admin API over cfg and forgets its changes when the
+// test ends.
+func startAdmin(t *testing.T, cfg *config) *httptest.Server {
+	t.Helper()
+	applyConfig(cfg)
+	ts := httptest.NewServer(adminHandler())
+	t.Cleanup(func() {
+		ts.Close()
+		editMu.Lock()
+		overlay = newAdminOverlay()
+		editMu.Unlock()
+		applyConfig(defaultConfig())
+	})
+	return ts
+}
+
+func healthy() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return slices.Clone(healthyServers)
+}
+
+func TestAdminAPI(t *testing.T) {
+	ts := startAdmin(t, testConfig("a:80", "b:80"))
+	probed("a:80", time.Millisecond, nil)
+	probed("b:80", 2*time.Millisecond, errors.New("connection refused"))
+	refreshHealthy()
+	begin("a:80")
+	end("a:80", errors.New("timeout"))
+
+	pool := listBackends(t, ts.URL)
+	a, b := pool["a:80"], pool["b:80"]
+	if a.State != "healthy" || a.Latency.Duration != time.Millisecond || a.Requests != 1 || a.Errors != 1 || a.LastProbe.IsZero() {
+		t.Errorf("unexpected a: %+v", a)
+	}
+	if b.State != "unhealthy" || b.LastProbeError != "connection refused" {
+		t.Errorf("unexpected b: %+v", b)
+	}
+
+	// Draining keeps requests in flight but takes no new ones.
+	begin("a:80")
+	if resp, m := adminRequest(t, http.MethodPost, ts.URL+"/backends/a:80/drain", ""); resp.StatusCode != http.StatusOK || m.State != "draining" {
+		t.Errorf("drain: status %d, %+v", resp.StatusCode, m)
+	}
+	if got := healthy(); len(got) != 0 {
+		t.Errorf("healthy servers %v while draining", got)
+	}
+	end("a:80", nil)
+	if m := listBackends(t, ts.URL)["a:80"]; m.State != "drained" {
+		t.Errorf("state %s after the last request ended", m.State)
+	}
+	adminRequest(t, http.MethodPost, ts.URL+"/backends/a:80/activate", "")
+	if got := healthy(); !slices.Equal(got, []string{"a:80"}) {
+		t.Errorf("healthy servers %v after activation", got)
+	}
+
+	if resp, m := adminRequest(t, http.MethodPost, ts.URL+"/backends/b:80/maintenance", ""); resp.StatusCode != http.StatusOK || m.State != "maintenance" {
+		t.Errorf("maintenance: status %d, %+v", resp.StatusCode, m)
+	}
+	if probing("b:80") {
+		t.Error("backend in maintenance is probed")
+	}
+	if resp, _ := adminRequest(t, http.MethodPost, ts.URL+"/backends/x:80/drain", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("drain of an unknown backend: status %d", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodPost, "/backends", `{"addr": "c:80"}`, http.StatusCreated},
+		{http.MethodPost, "/backends", `{"addr": "c:80"}`, http.StatusConflict},
+		{http.MethodPost, "/backends", `{"addr": "c"}`, http.StatusBadRequest},
+		{http.MethodPost, "/backends", `{}`, http.StatusBadRequest},
+		{http.MethodPut, "/backends/c:80/weight", `{"weight": 0}`, http.StatusBadRequest},
+		{http.MethodPut, "/backends/x:80/weight", `{"weight": 2}`, http.StatusNotFound},
+		{http.MethodPut, "/backends/c:80/weight", `{"weight": 3}`, http.StatusOK},
+		{http.MethodDelete, "/backends/c:80", "", http.StatusNoContent},
+		{http.MethodDelete, "/backends/c:80", "", http.StatusNotFound},
+	} {
+		if resp, _ := adminRequest(t, tc.method, ts.URL+tc.path, tc.body); resp.StatusCode != tc.want {
+			t.Errorf("%s %s %s: status %d, want %d", tc.method, tc.path, tc.body, resp.StatusCode, tc.want)
+		}
+	}
+
+	// A removed backend is listed while it drains.
+	begin("b:80")
+	adminRequest(t, http.MethodDelete, ts.URL+"/backends/b:80", "")
+	if m, ok := listBackends(t, ts.URL)["b:80"]; !ok || m.State != "removed" || m.InFlight != 1 {
+		t.Errorf("removed backend with a request in flight: %+v", m)
+	}
+	end("b:80", nil)
+	if _, ok := listBackends(t, ts.URL)["b:80"]; ok {
+		t.Error("removed backend still listed after draining")
+	}
+	if got := currentConfig().Backends; !slices.Equal(got, []string{"a:80"}) {
+		t.Errorf("backends %v", got)
+	}
+	if len(currentConfig().Weights) != 0 {
+		t.Errorf("weights %v kept for removed backends", currentConfig().Weights)
+	}
+}
+
+func TestAdminWeight(t *testing.T) {
+	ts := startAdmin(t, testConfig("a:80", "b:80"))
+
+	share := func() float64 {
+		n := 0
+		for i := 0; i < 3000; i++ {
+			if server, _ := getServerIndex(fmt.Sprintf("/path/%d", i)); server == "a:80" {
+				n++
+			}
+		}
+		return float64(n) / 3000
+	}
+	probed("a:80", time.Millisecond, nil)
+	probed("b:80", time.Millisecond, nil)
+	refreshHealthy()
+	before := share()
+
+	if resp, m := adminRequest(t, http.MethodPut, ts.URL+"/backends/a:80/weight", `{"weight": 3}`); resp.StatusCode != http.StatusOK || m.Weight != 3 {
+		t.Fatalf("set weight: status %d, %+v", resp.StatusCode, m)
+	}
+	if after := share(); after < 0.65 || after <= before {
+		t.Errorf("a:80 got %.0f%% of the paths with weight 3, %.0f%% with weight 1", 100*after, 100*before)
+	}
+	if m := listBackends(t, ts.URL)["b:80"]; m.Weight != 1 {
+		t.Errorf("b:80 has weight %d", m.Weight)
+	}
+}
+
+func TestAdminChangesSurviveReload(t *testing.T) {
+	ts := startAdmin(t, testConfig("a:80", "b:80"))
+	adminRequest(t, http.MethodDelete, ts.URL+"/backends/b:80", "")
+
+	// A reload that leaves no backends once the changes are applied fails.
+	if err := reloadConfig(testConfig("b:80")); err == nil {
+		t.Error("reload without backends applied")
+	}
+
+	adminRequest(t, http.MethodPost, ts.URL+"/backends", `{"addr": "c:80"}`)
+	adminRequest(t, http.MethodPut, ts.URL+"/backends/a:80/weight", `{"weight": 3}`)
+	// The file still lists b:80 and adds d:80.
+	if err := reloadConfig(testConfig("a:80", "b:80", "d:80")); err != nil {
+		t.Fatal(err)
+	}
+	c := currentConfig()
+	if want := []string{"a:80", "d:80", "c:80"}; !slices.Equal(c.Backends, want) {
+		t.Errorf("backends after reload %v, want %v", c.Backends, want)
+	}
+	if c.weight("a:80") != 3 {
+		t.Errorf("weight of a:80 after reload %d, want 3", c.weight("a:80"))
+	}
+
+	// Adding a backend back through the API undoes its removal.
+	adminRequest(t, http.MethodPost, ts.URL+"/backends", `{"addr": "b:80"}`)
+	if err := reloadConfig(testConfig("b:80")); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentConfig().Backends; !slices.Equal(got, []string{"b:80", "c:80"}) {
+		t.Errorf("backends after adding b:80 back %v", got)
+	}
+}
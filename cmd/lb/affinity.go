@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sources of the affinity key, the string a hashing strategy maps to a
+// backend. Query, header and cookie take a name after a colon, e.g.
+// "query:key" or "cookie:session".
+const (
+	affinityURI    = "uri"
+	affinityPath   = "path"
+	affinityQuery  = "query"
+	affinityHeader = "header"
+	affinityCookie = "cookie"
+	affinityIP     = "ip"
+)
+
+type affinityKey struct {
+	source string
+	name   string
+}
+
+func parseAffinityKey(spec string) (affinityKey, error) {
+	source, name, named := strings.Cut(spec, ":")
+	switch source {
+	case affinityURI, affinityPath, affinityIP:
+		if !named {
+			return affinityKey{source: source}, nil
+		}
+	case affinityQuery, affinityHeader, affinityCookie:
+		if named && name != "" {
+			return affinityKey{source: source, name: name}, nil
+		}
+	}
+	return affinityKey{}, fmt.Errorf("affinity key %q is not uri, path, ip, query:<name>, header:<name> or cookie:<name>", spec)
+}
+
+// of returns the affinity key of r. A request without the query parameter,
+// header or cookie is keyed by its path.
+func (k affinityKey) of(r *http.Request) string {
+	switch k.source {
+	case affinityPath:
+		return r.URL.Path
+	case affinityQuery:
+		if v := r.URL.Query().Get(k.name); v != "" {
+			return v
+		}
+	case affinityHeader:
+		if v := r.Header.Get(k.name); v != "" {
+			return v
+		}
+	case affinityCookie:
+		if c, err := r.Cookie(k.name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	case affinityIP:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	default:
+		return r.URL.RequestURI()
+	}
+	return r.URL.Path
+}
+
+// requestKey returns the affinity key of r under the current config.
+func requestKey(r *http.Request) string {
+	// validate made sure the key parses.
+	k, _ := parseAffinityKey(currentConfig().AffinityKey)
+	return k.of(r)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAffinityKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=user1&req=2", nil)
+	r.RemoteAddr = "10.0.0.7:51234"
+	r.Header.Set("X-User", "user2")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s3"})
+
+	for spec, want := range map[string]string{
+		"uri":            "/api/v1/some-data?key=user1&req=2",
+		"path":           "/api/v1/some-data",
+		"query:key":      "user1",
+		"header:X-User":  "user2",
+		"cookie:session": "s3",
+		"ip":             "10.0.0.7",
+		// Requests without the named value fall back to the path.
+		"query:missing":  "/api/v1/some-data",
+		"header:X-Other": "/api/v1/some-data",
+		"cookie:other":   "/api/v1/some-data",
+	} {
+		k, err := parseAffinityKey(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+			continue
+		}
+		if got := k.of(r); got != want {
+			t.Errorf("%s: got %q, want %q", spec, got, want)
+		}
+	}
+
+	for _, spec := range []string{"", "query", "query:", "path:x", "body:key"} {
+		if _, err := parseAffinityKey(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestAffinityKeySticky(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	c := testConfig("a:80", "b:80", "c:80")
+	c.AffinityKey = "query:key"
+	applyConfig(c)
+	setHealthyServers(c.Backends)
+
+	first, _ := getServerIndex(requestKey(httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=k1&req=1", nil)))
+	for _, query := range []string{"key=k1&req=2", "req=3&key=k1", "key=k1"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?"+query, nil)
+		if got, _ := getServerIndex(requestKey(r)); got != first {
+			t.Errorf("?%s went to %s, ?key=k1&req=1 to %s", query, got, first)
+		}
+	}
+}
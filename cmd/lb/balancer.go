@@ -4,10 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,21 +18,35 @@ import (
 var mu sync.RWMutex
 var healthyServers []string
 
+// strategy picks among healthyServers; it is the path hash until the config
+// says otherwise.
+var strategy Strategy = &hashStrategy{ring: newRing(), pool: livePool{}}
+
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
-	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	adminPort  = flag.Int("admin-port", 8091, "port of the admin API, 0 disables it")
+	configPath = flag.String("config", "", "JSON config file, see config; flags and LB_* environment variables override it")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
 
-	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
-)
+	backends         = flag.String("backends", "", "comma separated host:port list of the backends, overrides $LB_BACKENDS")
+	timeoutSec       = flag.Int("timeout-sec", 3, "request timeout time in seconds, overrides $LB_TIMEOUT")
+	healthPath       = flag.String("health-path", "/health", "path of the backend health check, overrides $LB_HEALTH_PATH")
+	healthInterval   = flag.Duration("health-interval", 10*time.Second, "how often backends are checked, overrides $LB_HEALTH_INTERVAL")
+	healthTimeout    = flag.Duration("health-timeout", 3*time.Second, "timeout of a health check, overrides $LB_HEALTH_TIMEOUT")
+	healthStatus     = flag.Int("health-status", http.StatusOK, "status of a healthy backend's health check, overrides $LB_HEALTH_STATUS")
+	healthRise       = flag.Int("health-rise", 2, "passed health checks in a row that make a backend healthy, overrides $LB_HEALTH_RISE")
+	healthFall       = flag.Int("health-fall", 3, "failed health checks in a row that make a backend unhealthy, overrides $LB_HEALTH_FALL")
+	strategyName     = flag.String("strategy", strategyHash, "balancing strategy: hash, round-robin, least-connections, weighted-round-robin or p2c; overrides $LB_STRATEGY")
+	weights          = flag.String("weights", "", "comma separated host:port=weight list, backends not listed have weight 1; overrides $LB_WEIGHTS")
+	affinityKeySpec  = flag.String("affinity-key", affinityURI, "what the hash strategy maps to a backend: uri, path, ip, query:<name>, header:<name> or cookie:<name>; overrides $LB_AFFINITY_KEY")
+	retries          = flag.Int("retries", 1, "how many other backends a failed GET or HEAD is tried on, overrides $LB_RETRIES")
+	retryBudgetRatio = flag.Float64("retry-budget", 0.2, "retries allowed per request on average, overrides $LB_RETRY_BUDGET")
+	breakerErrors    = flag.Int("breaker-errors", 5, "failed requests in a row that eject a backend, 0 disables; overrides $LB_BREAKER_ERRORS")
+	breakerErrorRate = flag.Float64("breaker-error-rate", 0.5, "share of failed recent requests that ejects a backend, 0 disables; overrides $LB_BREAKER_ERROR_RATE")
+	breakerOpenFor   = flag.Duration("breaker-open", 10*time.Second, "how long an ejected backend waits before it gets trial requests again, overrides $LB_BREAKER_OPEN")
+	configCheck      = flag.Duration("config-check-interval", 2*time.Second, "how often the -config file is checked for changes, 0 disables; SIGHUP always reloads")
 
-var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
-	}
+	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
 
 func scheme() string {
@@ -42,103 +56,155 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+// health checks dst and returns nil if it answered the health path with the
+// expected status.
+func health(dst string) error {
+	c := currentConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), c.HealthTimeout.Duration)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
+		fmt.Sprintf("%s://%s%s", scheme(), dst, c.HealthPath), nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false
+		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	resp.Body.Close()
+	if resp.StatusCode != c.HealthStatus {
+		return fmt.Errorf("status %d", resp.StatusCode)
 	}
-	return true
+	return nil
 }
 
 func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+	err := tryForward(dst, rw, r)
+	if err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return err
+}
+
+// tryForward is forward without the 503 on failure, so that the request can
+// be retried on another backend. Nothing is written to rw when it fails.
+func tryForward(dst string, rw http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), currentConfig().Timeout.Duration)
+	defer cancel()
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = dst
 
+	start := time.Now()
 	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
-		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
-		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
-		}
-		return nil
+	if r.Context().Err() != nil {
+		abandon(dst)
 	} else {
+		passive(dst, time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	}
+	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
 		return err
 	}
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	rw.WriteHeader(resp.StatusCode)
+	defer resp.Body.Close()
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+	return nil
 }
 
 func main() {
 	flag.Parse()
-	go monitorHealth()
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		server, ok := getServerIndex(r.URL.RequestURI())
-		if !ok {
-			http.Error(rw, "No healthy servers", http.StatusServiceUnavailable)
-			return
-		}
-		forward(server, rw, r)
-	}))
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf = c
+	s, err := newStrategy(c.Strategy, livePool{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	setStrategy(s)
+	log.Printf("Backends: %s, strategy: %s", strings.Join(c.Backends, ", "), c.Strategy)
+	go monitorHealth(context.Background())
+	go watchConfig(context.Background(), *configPath, *configCheck)
+	frontend := httptools.CreateServer(*port, http.HandlerFunc(serve))
+	if *adminPort != 0 {
+		httptools.CreateServer(*adminPort, adminHandler()).Start()
+	}
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
 }
 
-// monitorHealth This method monitors the status of all servers every 10 seconds.
-func monitorHealth() {
+// monitorHealth This method monitors the status of all servers every health interval,
+// and right away after a config reload.
+func monitorHealth(ctx context.Context) {
 	log.Println("Starting health monitor...")
 	for {
-		var newHealthy []string
-		for _, server := range serversPool {
-			isHealthy := health(server)
-			log.Println(server, "healthy:", isHealthy)
-			if isHealthy {
-				newHealthy = append(newHealthy, server)
-			}
+		c := currentConfig()
+		probeAll(c.Backends)
+		select {
+		case <-ctx.Done():
+			return
+		case <-probeNow:
+		case <-time.After(c.HealthInterval.Duration):
+		}
+	}
+}
+
+// probeAll checks servers all at once, so that a hung one holds the others
+// up by no more than the health timeout, and then refreshes healthyServers.
+func probeAll(servers []string) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if !probing(server) {
+			continue
 		}
-		mu.Lock()
-		healthyServers = newHealthy
-		mu.Unlock()
-		time.Sleep(10 * time.Second)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := health(server)
+			if probed(server, time.Since(start), err) {
+				log.Println(server, "healthy:", err == nil)
+			}
+		}()
 	}
+	wg.Wait()
+	refreshHealthy()
 }
 
-// hash This method hashes the string
-func hash(s string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return h.Sum32()
+// setHealthyServers replaces the servers getServerIndex picks from.
+func setHealthyServers(servers []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	healthyServers = servers
+	strategy.Update(servers)
 }
 
-// getServerIndex This method gets a path URL as a param and returns the server, which is to serve the user
-func getServerIndex(path string) (string, bool) {
+// setStrategy makes s pick the servers from now on.
+func setStrategy(s Strategy) {
+	mu.Lock()
+	defer mu.Unlock()
+	s.Update(healthyServers)
+	strategy = s
+}
+
+// getServerIndex This method gets the affinity key of a request as a param and returns the server, which is to serve the user
+func getServerIndex(key string) (string, bool) {
 	mu.RLock()
-	defer mu.RUnlock()
-	if len(healthyServers) == 0 {
-		return "", false
-	}
-	index := int(hash(path)) % len(healthyServers)
-	return healthyServers[index], true
+	s := strategy
+	mu.RUnlock()
+	return s.Pick(key)
 }
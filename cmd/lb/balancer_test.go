@@ -9,34 +9,33 @@ import (
 	"testing"
 )
 
-// Tests for hash()
+// Tests for the ring
 
-func TestHashDeterministic(t *testing.T) {
+func TestRingDeterministic(t *testing.T) {
 	input := "/user/42"
-	if hash(input) != hash(input) {
-		t.Error("Hash is not deterministic")
+	r := newRing("s1:8080", "s2:8080", "s3:8080")
+	if r.Get(input) != newRing("s3:8080", "s1:8080", "s2:8080").Get(input) {
+		t.Error("Ring is not deterministic")
 	}
 }
 
-func TestHashCollisionAvoidance(t *testing.T) {
+func TestRingSpreadsSimilarPaths(t *testing.T) {
 	paths := []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g", "/h", "/i"}
-	hashes := make(map[uint32]string)
+	r := newRing("s1:8080", "s2:8080", "s3:8080")
+	servers := make(map[string]bool)
 
 	for _, path := range paths {
-		h := hash(path)
-		if existing, ok := hashes[h]; ok {
-			t.Errorf("Hash collision: %s and %s have same hash %d", path, existing, h)
-		}
-		hashes[h] = path
+		servers[r.Get(path)] = true
+	}
+	if len(servers) < 2 {
+		t.Errorf("Expected similar paths on several servers, got %v", servers)
 	}
 }
 
 // Tests for getServerIndex()
 
 func TestGetServerIndexSingleServer(t *testing.T) {
-	mu.Lock()
-	healthyServers = []string{"server1:8080"}
-	mu.Unlock()
+	setHealthyServers([]string{"server1:8080"})
 
 	server, ok := getServerIndex("/test")
 	if !ok || server != "server1:8080" {
@@ -45,9 +44,7 @@ func TestGetServerIndexSingleServer(t *testing.T) {
 }
 
 func TestGetServerIndexEmptyList(t *testing.T) {
-	mu.Lock()
-	healthyServers = []string{}
-	mu.Unlock()
+	setHealthyServers([]string{})
 
 	_, ok := getServerIndex("/test")
 	if ok {
@@ -56,9 +53,7 @@ func TestGetServerIndexEmptyList(t *testing.T) {
 }
 
 func TestGetServerIndexDistribution(t *testing.T) {
-	mu.Lock()
-	healthyServers = []string{"s1:8080", "s2:8080", "s3:8080"}
-	mu.Unlock()
+	setHealthyServers([]string{"s1:8080", "s2:8080", "s3:8080"})
 
 	pathToServer := make(map[string]string)
 	paths := []string{"/a", "/b", "/c", "/d", "/e", "/f", "/g"}
@@ -77,9 +72,7 @@ func TestGetServerIndexDistribution(t *testing.T) {
 }
 
 func TestGetServerIndexConsistency(t *testing.T) {
-	mu.Lock()
-	healthyServers = []string{"s1:8080", "s2:8080", "s3:8080"}
-	mu.Unlock()
+	setHealthyServers([]string{"s1:8080", "s2:8080", "s3:8080"})
 
 	path := "/user/profile"
 	s1, ok1 := getServerIndex(path)
@@ -94,9 +87,7 @@ func TestGetServerIndexConsistency(t *testing.T) {
 }
 
 func TestGetServerIndexConcurrency(t *testing.T) {
-	mu.Lock()
-	healthyServers = []string{"s1:8080", "s2:8080"}
-	mu.Unlock()
+	setHealthyServers([]string{"s1:8080", "s2:8080"})
 
 	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
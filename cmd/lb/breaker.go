@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Circuit breaker states. An open breaker takes its backend out of
+// healthyServers. After a while it turns half-open and lets a few trial
+// requests through, closing once they all succeed.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breakerWindow is how many of the latest requests the error rate of a
+// backend is taken over.
+const breakerWindow = 20
+
+// breakerTrials is how many requests a half-open breaker lets through. It
+// closes when all of them succeed and opens again on the first failure.
+const breakerTrials = 3
+
+// breaker watches the requests forwarded to a backend. It is guarded by
+// poolMu along with its member.
+type breaker struct {
+	state       string
+	consecutive int
+	// window holds the latest outcomes, true for failures, starting over
+	// at next.
+	window   [breakerWindow]bool
+	next     int
+	seen     int
+	failures int
+	// admitted and passed count the trial requests of a half-open breaker.
+	admitted int
+	passed   int
+}
+
+// admit reports whether a request may go to the backend, taking one of the
+// trial requests of a half-open breaker.
+func (b *breaker) admit() bool {
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.admitted < breakerTrials {
+			b.admitted++
+			return true
+		}
+	}
+	return false
+}
+
+// release gives back a trial request whose outcome says nothing about the
+// backend.
+func (b *breaker) release() {
+	if b.state == breakerHalfOpen && b.admitted > 0 {
+		b.admitted--
+	}
+}
+
+// trial adds the outcome of a trial request of a half-open breaker and
+// reports whether it opened or closed the breaker.
+func (b *breaker) trial(failed bool) (opened, closed bool) {
+	if failed {
+		*b = breaker{state: breakerOpen}
+		return true, false
+	}
+	b.passed++
+	if b.passed < breakerTrials {
+		return false, false
+	}
+	*b = breaker{state: breakerClosed}
+	return false, true
+}
+
+// record adds the outcome of a request and reports whether it opened the
+// breaker.
+func (b *breaker) record(failed bool, c *config) bool {
+	if b.seen == breakerWindow && b.window[b.next] {
+		b.failures--
+	}
+	b.window[b.next] = failed
+	b.next = (b.next + 1) % breakerWindow
+	b.seen = min(b.seen+1, breakerWindow)
+	if !failed {
+		b.consecutive = 0
+		return false
+	}
+	b.failures++
+	b.consecutive++
+	if b.state != breakerClosed {
+		return false
+	}
+	if (c.BreakerErrors > 0 && b.consecutive >= c.BreakerErrors) ||
+		(c.BreakerErrorRate > 0 && b.seen == breakerWindow && float64(b.failures) >= c.BreakerErrorRate*breakerWindow) {
+		b.state = breakerOpen
+		return true
+	}
+	return false
+}
+
+// passive records a request forwarded to server that took latency and
+// failed if it got no response or a 5xx one. A backend whose breaker opens
+// is ejected at once, without waiting for the next active probe.
+func passive(server string, latency time.Duration, failed bool) {
+	c := currentConfig()
+	poolMu.Lock()
+	m := memberLocked(server)
+	if m.requestLatency == 0 {
+		m.requestLatency = latency
+	} else {
+		m.requestLatency += (latency - m.requestLatency) / 8
+	}
+	var opened, closed bool
+	if m.breaker.state == breakerHalfOpen {
+		opened, closed = m.breaker.trial(failed)
+	} else {
+		opened = m.breaker.record(failed, c)
+	}
+	forgetLocked(server)
+	poolMu.Unlock()
+
+	switch {
+	case opened:
+		log.Printf("Circuit breaker of %s opened, ejecting it for %s", server, c.BreakerOpen)
+		refreshHealthy()
+		time.AfterFunc(c.BreakerOpen.Duration, func() { halfOpen(server) })
+	case closed:
+		log.Printf("Circuit breaker of %s closed after %d trial requests", server, breakerTrials)
+	}
+}
+
+// admit reports whether a request may be forwarded to server. A half-open
+// backend only takes its trial requests; the others go elsewhere.
+func admit(server string) bool {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	return memberLocked(server).breaker.admit()
+}
+
+// abandon drops a request to server whose client went away before it got
+// an answer. It is neither a success nor a failure of the backend, so it is
+// left out of the breaker and a trial request it held is given back.
+func abandon(server string) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	memberLocked(server).breaker.release()
+	forgetLocked(server)
+}
+
+// halfOpen lets trial requests through to a backend whose breaker has been
+// open for a while. Their outcome decides, in passive, whether the breaker
+// closes or opens again.
+func halfOpen(server string) {
+	poolMu.Lock()
+	m, ok := members[server]
+	if !ok || m.breaker.state != breakerOpen {
+		poolMu.Unlock()
+		return
+	}
+	m.breaker = breaker{state: breakerHalfOpen}
+	poolMu.Unlock()
+
+	log.Printf("Circuit breaker of %s half-open, letting %d trial requests through", server, breakerTrials)
+	refreshHealthy()
+}
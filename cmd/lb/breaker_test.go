@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerRecord(t *testing.T) {
+	c := defaultConfig()
+	c.BreakerErrors, c.BreakerErrorRate = 3, 0
+	b := breaker{state: breakerClosed}
+	for i, failed := range []bool{true, true, false, true, true} {
+		if b.record(failed, c) {
+			t.Fatalf("opened after request %d", i)
+		}
+	}
+	if !b.record(true, c) || b.state != breakerOpen {
+		t.Errorf("not opened after 3 failures in a row, state %s", b.state)
+	}
+
+	// Every other request failing never makes 3 in a row, but is half of
+	// the window.
+	c.BreakerErrors, c.BreakerErrorRate = 3, 0.5
+	b = breaker{state: breakerClosed}
+	opened := 0
+	for i := 0; i < breakerWindow; i++ {
+		if b.record(i%2 == 1, c) {
+			opened = i + 1
+		}
+	}
+	if opened != breakerWindow {
+		t.Errorf("opened after %d requests, want %d", opened, breakerWindow)
+	}
+
+	// Failures that drop out of the window no longer count.
+	b = breaker{state: breakerClosed}
+	for i := 0; i < breakerWindow/2-1; i++ {
+		b.record(true, c)
+		b.record(false, c)
+	}
+	for i := 0; i < breakerWindow; i++ {
+		if b.record(false, c) {
+			t.Fatal("opened by successes")
+		}
+	}
+	if b.failures != 0 {
+		t.Errorf("%d failures in a window of successes", b.failures)
+	}
+}
+
+func TestBreakerTrials(t *testing.T) {
+	b := breaker{state: breakerOpen}
+	if b.admit() {
+		t.Error("open breaker admitted a request")
+	}
+	b = breaker{state: breakerHalfOpen}
+	for i := 0; i < breakerTrials; i++ {
+		if !b.admit() {
+			t.Fatalf("trial request %d not admitted", i+1)
+		}
+	}
+	if b.admit() {
+		t.Error("admitted more than the trial requests")
+	}
+	for i := 0; i < breakerTrials-1; i++ {
+		if opened, closed := b.trial(false); opened || closed {
+			t.Fatalf("trial %d decided the breaker", i+1)
+		}
+	}
+	if _, closed := b.trial(false); !closed || b.state != breakerClosed || !b.admit() {
+		t.Errorf("not closed after %d successful trials, state %s", breakerTrials, b.state)
+	}
+
+	b = breaker{state: breakerHalfOpen}
+	for i := 0; i < breakerTrials; i++ {
+		b.admit()
+	}
+	b.release()
+	if !b.admit() {
+		t.Error("released trial request not admitted again")
+	}
+
+	b = breaker{state: breakerHalfOpen}
+	b.admit()
+	b.trial(false)
+	if opened, _ := b.trial(true); !opened || b.state != breakerOpen {
+		t.Errorf("not opened by a failed trial, state %s", b.state)
+	}
+}
+
+func TestBreakerEjection(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	// The backend passes its health checks but fails requests until it
+	// recovers.
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" && failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	c := testConfig(addr)
+	c.BreakerErrors = 2
+	c.BreakerOpen.Duration = 50 * time.Millisecond
+	applyConfig(c)
+	probed(addr, time.Millisecond, nil)
+	refreshHealthy()
+
+	breakerState := func() memberStatus {
+		for _, m := range poolStatus() {
+			if m.Addr == addr {
+				return m
+			}
+		}
+		return memberStatus{}
+	}
+	waitHalfOpen := func() {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for breakerState().Breaker != breakerHalfOpen {
+			if time.Now().After(deadline) {
+				t.Fatalf("breaker of %s not half-open: %+v", addr, breakerState())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	request := func() int {
+		rr := httptest.NewRecorder()
+		serve(rr, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+		return rr.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		forward(addr, httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil))
+	}
+	if got := healthy(); len(got) != 0 {
+		t.Errorf("healthy servers %v after failed requests", got)
+	}
+	if m := breakerState(); m.State != "ejected" || m.Breaker != breakerOpen || m.RequestLatency.Duration == 0 {
+		t.Errorf("unexpected %s: %+v", addr, m)
+	}
+
+	// Passing health checks is not enough: a failed trial request opens
+	// the breaker again.
+	waitHalfOpen()
+	request()
+	if m := breakerState(); m.Breaker != breakerOpen {
+		t.Errorf("breaker %s after a failed trial request", m.Breaker)
+	}
+
+	// Once the trial requests succeed the breaker closes.
+	failing.Store(false)
+	waitHalfOpen()
+	for i := 0; i < breakerTrials; i++ {
+		if code := request(); code != http.StatusOK {
+			t.Fatalf("trial request %d: status %d", i+1, code)
+		}
+	}
+	if m := breakerState(); m.Breaker != breakerClosed {
+		t.Errorf("breaker %s after %d successful trial requests", m.Breaker, breakerTrials)
+	}
+	waitForHealthy(t, addr)
+}
+
+func TestBreakerIgnoresGoneClients(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	c := testConfig(addr)
+	c.BreakerErrors = 2
+	applyConfig(c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 2*c.BreakerErrors; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil).WithContext(ctx)
+		if err := tryForward(addr, httptest.NewRecorder(), r); err == nil {
+			t.Fatal("request with a cancelled context forwarded")
+		}
+	}
+	for _, m := range poolStatus() {
+		if m.Addr == addr && m.Breaker != breakerClosed {
+			t.Errorf("breaker %s after requests of gone clients", m.Breaker)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the balancer configuration. It is read from the -config file,
+// e.g.
+//
+//	{
+//	  "backends": ["server1:8080", "server2:8080", "server3:8080"],
+//	  "timeout": "3s",
+//	  "health_path": "/health",
+//	  "health_interval": "10s",
+//	  "health_timeout": "3s",
+//	  "health_status": 200,
+//	  "health_rise": 2,
+//	  "health_fall": 3,
+//	  "strategy": "hash",
+//	  "weights": {"server1:8080": 2},
+//	  "affinity_key": "query:key",
+//	  "retries": 1,
+//	  "retry_budget": 0.2,
+//	  "breaker_errors": 5,
+//	  "breaker_error_rate": 0.5,
+//	  "breaker_open": "10s"
+//	}
+//
+// and then overridden by LB_* environment variables and by flags given on
+// the command line.
+type config struct {
+	Backends       []string `json:"backends"`
+	Timeout        duration `json:"timeout"`
+	HealthPath     string   `json:"health_path"`
+	HealthInterval duration `json:"health_interval"`
+	HealthTimeout  duration `json:"health_timeout"`
+	// HealthStatus is the status a healthy backend answers HealthPath with.
+	HealthStatus int `json:"health_status"`
+	// A backend becomes healthy after HealthRise passed probes in a row and
+	// unhealthy after HealthFall failed ones; its first probe decides alone.
+	HealthRise int `json:"health_rise"`
+	HealthFall int `json:"health_fall"`
+	// Strategy is one of strategyNames.
+	Strategy string `json:"strategy"`
+	// Weights gives backends a share of the requests in proportion to
+	// their weight; backends not listed here have weight 1.
+	Weights map[string]int `json:"weights,omitempty"`
+	// AffinityKey is what the hash strategy maps to a backend, see
+	// parseAffinityKey.
+	AffinityKey string `json:"affinity_key"`
+	// Retries is how many other backends a failed GET or HEAD is tried on.
+	Retries int `json:"retries"`
+	// RetryBudget caps retries at this fraction of the requests, see
+	// retryBudget.
+	RetryBudget float64 `json:"retry_budget"`
+	// The circuit breaker of a backend opens after BreakerErrors failed
+	// requests in a row or when BreakerErrorRate of its last breakerWindow
+	// requests failed; 0 turns either off. After BreakerOpen an open breaker
+	// turns half-open and lets breakerTrials requests through.
+	BreakerErrors    int      `json:"breaker_errors"`
+	BreakerErrorRate float64  `json:"breaker_error_rate"`
+	BreakerOpen      duration `json:"breaker_open"`
+}
+
+// maxWeight keeps the hash ring at a sane size.
+const maxWeight = 100
+
+// weight returns the weight of server, 1 unless configured otherwise.
+func (c *config) weight(server string) int {
+	if w, ok := c.Weights[server]; ok {
+		return w
+	}
+	return 1
+}
+
+func defaultConfig() *config {
+	return &config{
+		Backends:         []string{"server1:8080", "server2:8080", "server3:8080"},
+		Timeout:          duration{3 * time.Second},
+		HealthPath:       "/health",
+		HealthInterval:   duration{10 * time.Second},
+		HealthTimeout:    duration{3 * time.Second},
+		HealthStatus:     http.StatusOK,
+		HealthRise:       2,
+		HealthFall:       3,
+		Strategy:         strategyHash,
+		AffinityKey:      affinityURI,
+		Retries:          1,
+		RetryBudget:      0.2,
+		BreakerErrors:    5,
+		BreakerErrorRate: 0.5,
+		BreakerOpen:      duration{10 * time.Second},
+	}
+}
+
+// loadConfig reads the config file at path, if any, over the defaults and
+// applies the environment and flag overrides.
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := c.applyFlags(set); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) applyEnv(lookup func(string) (string, bool)) error {
+	if v, ok := lookup("LB_BACKENDS"); ok {
+		c.Backends = splitList(v)
+	}
+	if v, ok := lookup("LB_HEALTH_PATH"); ok {
+		c.HealthPath = v
+	}
+	if v, ok := lookup("LB_STRATEGY"); ok {
+		c.Strategy = v
+	}
+	if v, ok := lookup("LB_AFFINITY_KEY"); ok {
+		c.AffinityKey = v
+	}
+	for name, n := range map[string]*int{
+		"LB_HEALTH_STATUS":  &c.HealthStatus,
+		"LB_HEALTH_RISE":    &c.HealthRise,
+		"LB_HEALTH_FALL":    &c.HealthFall,
+		"LB_RETRIES":        &c.Retries,
+		"LB_BREAKER_ERRORS": &c.BreakerErrors,
+	} {
+		v, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("bad %s: %w", name, err)
+		}
+		*n = parsed
+	}
+	if v, ok := lookup("LB_RETRY_BUDGET"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("bad LB_RETRY_BUDGET: %w", err)
+		}
+		c.RetryBudget = f
+	}
+	if v, ok := lookup("LB_BREAKER_ERROR_RATE"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("bad LB_BREAKER_ERROR_RATE: %w", err)
+		}
+		c.BreakerErrorRate = f
+	}
+	if v, ok := lookup("LB_WEIGHTS"); ok {
+		weights, err := parseWeights(v)
+		if err != nil {
+			return fmt.Errorf("bad LB_WEIGHTS: %w", err)
+		}
+		c.Weights = weights
+	}
+	for name, d := range map[string]*duration{
+		"LB_TIMEOUT":         &c.Timeout,
+		"LB_HEALTH_INTERVAL": &c.HealthInterval,
+		"LB_HEALTH_TIMEOUT":  &c.HealthTimeout,
+		"LB_BREAKER_OPEN":    &c.BreakerOpen,
+	} {
+		v, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("bad %s: %w", name, err)
+		}
+		d.Duration = parsed
+	}
+	return nil
+}
+
+// applyFlags overrides the settings whose flags are in set.
+func (c *config) applyFlags(set map[string]bool) error {
+	if set["backends"] {
+		c.Backends = splitList(*backends)
+	}
+	if set["timeout-sec"] {
+		c.Timeout.Duration = time.Duration(*timeoutSec) * time.Second
+	}
+	if set["health-path"] {
+		c.HealthPath = *healthPath
+	}
+	if set["health-interval"] {
+		c.HealthInterval.Duration = *healthInterval
+	}
+	if set["health-timeout"] {
+		c.HealthTimeout.Duration = *healthTimeout
+	}
+	if set["health-status"] {
+		c.HealthStatus = *healthStatus
+	}
+	if set["health-rise"] {
+		c.HealthRise = *healthRise
+	}
+	if set["health-fall"] {
+		c.HealthFall = *healthFall
+	}
+	if set["strategy"] {
+		c.Strategy = *strategyName
+	}
+	if set["affinity-key"] {
+		c.AffinityKey = *affinityKeySpec
+	}
+	if set["retries"] {
+		c.Retries = *retries
+	}
+	if set["retry-budget"] {
+		c.RetryBudget = *retryBudgetRatio
+	}
+	if set["breaker-errors"] {
+		c.BreakerErrors = *breakerErrors
+	}
+	if set["breaker-error-rate"] {
+		c.BreakerErrorRate = *breakerErrorRate
+	}
+	if set["breaker-open"] {
+		c.BreakerOpen.Duration = *breakerOpenFor
+	}
+	if set["weights"] {
+		parsed, err := parseWeights(*weights)
+		if err != nil {
+			return fmt.Errorf("bad -weights: %w", err)
+		}
+		c.Weights = parsed
+	}
+	return nil
+}
+
+func (c *config) validate() error {
+	var errs []error
+	if len(c.Backends) == 0 {
+		errs = append(errs, errors.New("no backends configured"))
+	}
+	seen := make(map[string]bool)
+	for _, backend := range c.Backends {
+		if _, port, err := net.SplitHostPort(backend); err != nil || port == "" {
+			errs = append(errs, fmt.Errorf("backend %q is not host:port", backend))
+		}
+		if seen[backend] {
+			errs = append(errs, fmt.Errorf("backend %s is listed twice", backend))
+		}
+		seen[backend] = true
+	}
+	if !strings.HasPrefix(c.HealthPath, "/") {
+		errs = append(errs, fmt.Errorf("health path %q does not start with /", c.HealthPath))
+	}
+	if c.HealthStatus < 100 || c.HealthStatus > 599 {
+		errs = append(errs, fmt.Errorf("health status %d is not an HTTP status", c.HealthStatus))
+	}
+	if c.HealthRise < 1 || c.HealthFall < 1 {
+		errs = append(errs, errors.New("health rise and fall must be at least 1"))
+	}
+	if !slices.Contains(strategyNames, c.Strategy) {
+		errs = append(errs, fmt.Errorf("unknown strategy %q, want one of %v", c.Strategy, strategyNames))
+	}
+	if _, err := parseAffinityKey(c.AffinityKey); err != nil {
+		errs = append(errs, err)
+	}
+	for backend, w := range c.Weights {
+		if w < 1 || w > maxWeight {
+			errs = append(errs, fmt.Errorf("weight %d of %s is not between 1 and %d", w, backend, maxWeight))
+		}
+	}
+	if c.Retries < 0 {
+		errs = append(errs, errors.New("retries must not be negative"))
+	}
+	if c.RetryBudget < 0 || c.RetryBudget > 1 {
+		errs = append(errs, fmt.Errorf("retry budget %g is not between 0 and 1", c.RetryBudget))
+	}
+	if c.BreakerErrors < 0 {
+		errs = append(errs, errors.New("breaker errors must not be negative"))
+	}
+	if c.BreakerErrorRate < 0 || c.BreakerErrorRate > 1 {
+		errs = append(errs, fmt.Errorf("breaker error rate %g is not between 0 and 1", c.BreakerErrorRate))
+	}
+	if c.BreakerOpen.Duration <= 0 {
+		errs = append(errs, errors.New("breaker open time must be positive"))
+	}
+	if c.Timeout.Duration <= 0 {
+		errs = append(errs, errors.New("timeout must be positive"))
+	}
+	if c.HealthInterval.Duration <= 0 {
+		errs = append(errs, errors.New("health interval must be positive"))
+	}
+	if c.HealthTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("health timeout must be positive"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseWeights parses host:port=weight pairs separated by commas.
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range splitList(s) {
+		backend, w, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not host:port=weight", item)
+		}
+		n, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not host:port=weight", item)
+		}
+		weights[backend] = n
+	}
+	return weights, nil
+}
+
+// duration is a time.Duration written as a string such as "3s" in JSON.
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings such as \"3s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lb.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Backends) != 3 || c.Timeout.Duration != 3*time.Second || c.HealthPath != "/health" {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := writeConfig(t, `{
+		"backends": ["a:80", "b:80"],
+		"timeout": "5s",
+		"health_path": "/ready",
+		"health_interval": "2s"
+	}`)
+	t.Setenv("LB_TIMEOUT", "7s")
+	t.Setenv("LB_HEALTH_PATH", "/live")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Backends, ",") != "a:80,b:80" || c.HealthInterval.Duration != 2*time.Second {
+		t.Errorf("file settings not applied: %+v", c)
+	}
+	if c.Timeout.Duration != 7*time.Second || c.HealthPath != "/live" {
+		t.Errorf("environment overrides not applied: %+v", c)
+	}
+
+	*backends = "c:80"
+	*timeoutSec = 9
+	defer func() { *backends, *timeoutSec = "", 3 }()
+	c.applyFlags(map[string]bool{"backends": true, "timeout-sec": true})
+	if strings.Join(c.Backends, ",") != "c:80" || c.Timeout.Duration != 9*time.Second || c.HealthPath != "/live" {
+		t.Errorf("flag overrides not applied: %+v", c)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"no backends":      `{"backends": []}`,
+		"bad backend":      `{"backends": ["server1"]}`,
+		"duplicate":        `{"backends": ["a:80", "a:80"]}`,
+		"bad health path":  `{"health_path": "health"}`,
+		"zero timeout":     `{"timeout": "0s"}`,
+		"bad duration":     `{"health_interval": 10}`,
+		"unknown field":    `{"backend": ["a:80"]}`,
+		"zero weight":      `{"weights": {"server1:8080": 0}}`,
+		"huge weight":      `{"weights": {"server1:8080": 1000}}`,
+		"negative retries": `{"retries": -1}`,
+		"retry budget":     `{"retry_budget": 1.5}`,
+		"breaker rate":     `{"breaker_error_rate": 2}`,
+		"breaker open":     `{"breaker_open": "0s"}`,
+		"health status":    `{"health_status": 42}`,
+		"health rise":      `{"health_rise": 0}`,
+	} {
+		if _, err := loadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: config accepted", name)
+		}
+	}
+
+	t.Setenv("LB_HEALTH_INTERVAL", "soon")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("bad LB_HEALTH_INTERVAL accepted")
+	}
+}
+
+func TestLoadConfigWeights(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{"backends": ["a:80", "b:80"], "weights": {"a:80": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.weight("a:80") != 2 || c.weight("b:80") != 1 {
+		t.Errorf("weights %v", c.Weights)
+	}
+
+	t.Setenv("LB_WEIGHTS", "a:80=1, b:80=4")
+	if c, err = loadConfig(""); err != nil {
+		t.Fatal(err)
+	}
+	if c.weight("a:80") != 1 || c.weight("b:80") != 4 {
+		t.Errorf("LB_WEIGHTS not applied: %v", c.Weights)
+	}
+
+	t.Setenv("LB_WEIGHTS", "a:80")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("LB_WEIGHTS without a weight accepted")
+	}
+}
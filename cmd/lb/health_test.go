@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeAllParallel(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	ok := healthyBackend(t)
+
+	c := testConfig(strings.TrimPrefix(hung.URL, "http://"), ok)
+	c.HealthTimeout.Duration = 300 * time.Millisecond
+	applyConfig(c)
+
+	// The hung backend is probed three times so that probing one after
+	// another would take three health timeouts.
+	start := time.Now()
+	probeAll([]string{c.Backends[0], c.Backends[0], c.Backends[0], ok})
+	if elapsed := time.Since(start); elapsed > 2*c.HealthTimeout.Duration {
+		t.Errorf("probing took %s with a health timeout of %s", elapsed, c.HealthTimeout)
+	}
+	if got := healthy(); len(got) != 1 || got[0] != ok {
+		t.Errorf("healthy servers %v, want %s", got, ok)
+	}
+}
+
+func TestHealthExpectedStatus(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c := testConfig(addr)
+	applyConfig(c)
+	if err := health(addr); err == nil {
+		t.Error("healthy with the default path and status")
+	}
+	c = testConfig(addr)
+	c.HealthPath = "/ready"
+	applyConfig(c)
+	if err := health(addr); err == nil {
+		t.Error("204 accepted when 200 is expected")
+	}
+	c.HealthStatus = http.StatusNoContent
+	applyConfig(c)
+	if err := health(addr); err != nil {
+		t.Errorf("unhealthy with the expected status: %s", err)
+	}
+}
+
+func TestHealthRiseFall(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	var up atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c := testConfig(addr)
+	c.HealthRise, c.HealthFall = 2, 3
+	applyConfig(c)
+
+	for i, step := range []struct {
+		up      bool
+		healthy bool
+	}{
+		{true, true}, // the first probe decides alone
+		{false, true},
+		{false, true},
+		{true, true}, // a pass in between starts the count over
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{false, false},
+		{true, false},
+		{true, true},
+	} {
+		up.Store(step.up)
+		probeAll(c.Backends)
+		if got := len(healthy()) == 1; got != step.healthy {
+			t.Fatalf("probe %d: healthy %t, want %t", i+1, got, step.healthy)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Modes an operator can put a backend into through the admin API.
+const (
+	modeActive = "active"
+	// modeDraining takes no new requests but finishes the ones in flight.
+	modeDraining = "draining"
+	// modeMaintenance takes no requests and is not probed.
+	modeMaintenance = "maintenance"
+)
+
+var errUnknownBackend = errors.New("unknown backend")
+
+// member is what the balancer knows about a backend.
+type member struct {
+	mode       string
+	healthy    bool
+	lastProbe  time.Time
+	probeError string
+	latency    time.Duration
+	requests   int64
+	errors     int64
+	inflight   int
+	// passes and fails count the latest probes that agree.
+	passes int
+	fails  int
+	// requestLatency is a moving average over forwarded requests.
+	requestLatency time.Duration
+	breaker        breaker
+}
+
+var (
+	// poolMu guards members. It is taken before mu when both are needed.
+	poolMu sync.Mutex
+	// members holds the configured backends and removed ones that still
+	// have requests in flight.
+	members = make(map[string]*member)
+)
+
+// memberLocked returns the member for server, creating it if needed. The
+// caller must hold poolMu.
+func memberLocked(server string) *member {
+	m, ok := members[server]
+	if !ok {
+		m = &member{mode: modeActive, breaker: breaker{state: breakerClosed}}
+		members[server] = m
+	}
+	return m
+}
+
+// forgetLocked drops the state of a backend that is neither configured nor
+// busy. The caller must hold poolMu.
+func forgetLocked(server string) {
+	if m, ok := members[server]; ok && m.inflight == 0 && !slices.Contains(currentConfig().Backends, server) {
+		delete(members, server)
+	}
+}
+
+// begin and end count a request forwarded to server; err is what forward
+// returned.
+func begin(server string) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	m := memberLocked(server)
+	m.requests++
+	m.inflight++
+}
+
+func end(server string, err error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	m := memberLocked(server)
+	m.inflight--
+	if err != nil {
+		m.errors++
+	}
+	forgetLocked(server)
+}
+
+func inflightRequests(server string) int {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if m, ok := members[server]; ok {
+		return m.inflight
+	}
+	return 0
+}
+
+// waitDrained waits until server has no requests in flight, at most for
+// timeout.
+func waitDrained(server string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for inflightRequests(server) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// probed records the result of a health check of server and reports
+// whether it changed the health of server. The first probe decides at once;
+// after that it takes HealthRise passed or HealthFall failed probes in a row.
+func probed(server string, latency time.Duration, err error) bool {
+	c := currentConfig()
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	m := memberLocked(server)
+	first := m.lastProbe.IsZero()
+	m.lastProbe = time.Now()
+	m.latency = latency
+	m.probeError = ""
+	if err != nil {
+		m.probeError = err.Error()
+		m.passes = 0
+		m.fails++
+	} else {
+		m.fails = 0
+		m.passes++
+	}
+	was := m.healthy
+	switch {
+	case first:
+		m.healthy = err == nil
+	case m.passes >= c.HealthRise:
+		m.healthy = true
+	case m.fails >= c.HealthFall:
+		m.healthy = false
+	}
+	return first || m.healthy != was
+}
+
+// probing reports whether monitorHealth should check server.
+func probing(server string) bool {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	return memberLocked(server).mode != modeMaintenance
+}
+
+// setMode changes the mode of a configured backend.
+func setMode(server, mode string) error {
+	if !slices.Contains(currentConfig().Backends, server) {
+		return errUnknownBackend
+	}
+	poolMu.Lock()
+	memberLocked(server).mode = mode
+	poolMu.Unlock()
+	refreshHealthy()
+	return nil
+}
+
+// refreshHealthy rebuilds healthyServers from the configured backends that
+// are healthy, active and not ejected by an open breaker, in config order.
+// Half-open backends are listed, admit limits them to their trial requests.
+func refreshHealthy() {
+	backends := currentConfig().Backends
+	poolMu.Lock()
+	var healthy []string
+	for _, server := range backends {
+		if m := memberLocked(server); m.healthy && m.mode == modeActive && m.breaker.state != breakerOpen {
+			healthy = append(healthy, server)
+		}
+	}
+	for server := range members {
+		forgetLocked(server)
+	}
+	poolMu.Unlock()
+	// Strategies look at the pool while picking, so the healthy servers are
+	// set without holding poolMu.
+	setHealthyServers(healthy)
+}
+
+// memberStatus is a backend as reported by the admin API.
+type memberStatus struct {
+	Addr string `json:"addr"`
+	// State is healthy, unhealthy, ejected by the breaker, draining,
+	// drained, maintenance or removed for backends dropped from the config
+	// that are still busy.
+	State          string    `json:"state"`
+	Mode           string    `json:"mode"`
+	Weight         int       `json:"weight"`
+	Healthy        bool      `json:"healthy"`
+	LastProbe      time.Time `json:"last_probe,omitzero"`
+	LastProbeError string    `json:"last_probe_error,omitempty"`
+	Latency        duration  `json:"latency"`
+	Requests       int64     `json:"requests"`
+	Errors         int64     `json:"errors"`
+	InFlight       int       `json:"in_flight"`
+	RequestLatency duration  `json:"request_latency"`
+	Breaker        string    `json:"breaker"`
+}
+
+// poolStatus lists the configured backends in config order followed by
+// removed ones that are still draining.
+func poolStatus() []memberStatus {
+	c := currentConfig()
+	backends := c.Backends
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	list := []memberStatus{}
+	for _, server := range backends {
+		status := statusLocked(server, memberLocked(server), false)
+		status.Weight = c.weight(server)
+		list = append(list, status)
+	}
+	var removed []string
+	for server := range members {
+		if !slices.Contains(backends, server) {
+			removed = append(removed, server)
+		}
+	}
+	slices.Sort(removed)
+	for _, server := range removed {
+		list = append(list, statusLocked(server, members[server], true))
+	}
+	return list
+}
+
+func statusLocked(server string, m *member, removed bool) memberStatus {
+	status := memberStatus{
+		Addr:           server,
+		Mode:           m.mode,
+		Healthy:        m.healthy,
+		LastProbe:      m.lastProbe,
+		LastProbeError: m.probeError,
+		Latency:        duration{m.latency},
+		Requests:       m.requests,
+		Errors:         m.errors,
+		InFlight:       m.inflight,
+		RequestLatency: duration{m.requestLatency},
+		Breaker:        m.breaker.state,
+	}
+	switch {
+	case removed:
+		status.State = "removed"
+	case m.mode == modeDraining && m.inflight == 0:
+		status.State = "drained"
+	case m.mode != modeActive:
+		status.State = m.mode
+	case m.healthy && m.breaker.state != breakerClosed:
+		status.State = "ejected"
+	case m.healthy:
+		status.State = "healthy"
+	default:
+		status.State = "unhealthy"
+	}
+	return status
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	ossignal "os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	confMu sync.RWMutex
+	// conf is set from loadConfig before the balancer starts and replaced
+	// on every reload.
+	conf = defaultConfig()
+
+	// probeNow wakes monitorHealth up before its interval is over.
+	probeNow = make(chan struct{}, 1)
+)
+
+func currentConfig() *config {
+	confMu.RLock()
+	defer confMu.RUnlock()
+	return conf
+}
+
+// applyConfig makes c the current config. Backends that are no longer listed
+// stop getting new requests at once and drain the ones in flight; new
+// backends are probed right away and get requests once they are healthy.
+func applyConfig(c *config) {
+	confMu.Lock()
+	old := conf
+	conf = c
+	confMu.Unlock()
+
+	if c.Strategy != old.Strategy {
+		// validate made sure the name is known.
+		s, _ := newStrategy(c.Strategy, livePool{})
+		setStrategy(s)
+	}
+	refreshHealthy()
+
+	for _, server := range old.Backends {
+		if !slices.Contains(c.Backends, server) {
+			log.Printf("Removing %s, draining its requests", server)
+			go func() {
+				if waitDrained(server, c.Timeout.Duration) {
+					log.Printf("%s drained", server)
+				} else {
+					log.Printf("%s still has requests in flight after %s", server, c.Timeout)
+				}
+			}()
+		}
+	}
+	select {
+	case probeNow <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the contents of the
+// config file change, checking every interval; 0 only reloads on SIGHUP.
+// The changes made through the admin API are applied on top of the reloaded
+// config. A config that fails to load or validate is logged and the current
+// one stays in effect.
+func watchConfig(ctx context.Context, path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	ossignal.Notify(hup, syscall.SIGHUP)
+	defer ossignal.Stop(hup)
+
+	var tick <-chan time.Time
+	if path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last, _ := os.ReadFile(path)
+	reload := func(reason string) {
+		c, err := loadConfig(path)
+		if err == nil {
+			err = reloadConfig(c)
+		}
+		if err != nil {
+			log.Printf("Config reload (%s) failed, keeping the current config: %s", reason, err)
+			return
+		}
+		log.Printf("Config reloaded (%s), backends: %v", reason, currentConfig().Backends)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last, _ = os.ReadFile(path)
+			reload("SIGHUP")
+		case <-tick:
+			data, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			reload("file changed")
+		}
+	}
+}
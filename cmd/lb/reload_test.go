@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func healthyBackend(t *testing.T) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(ts.Close)
+	return strings.TrimPrefix(ts.URL, "http://")
+}
+
+func testConfig(backends ...string) *config {
+	c := defaultConfig()
+	c.Backends = backends
+	c.HealthInterval.Duration = time.Hour
+	return c
+}
+
+func waitForHealthy(t *testing.T, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.RLock()
+		got := slices.Clone(healthyServers)
+		mu.RUnlock()
+		if slices.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("healthy servers %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadProbesNewBackends(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	a, b := healthyBackend(t), healthyBackend(t)
+	applyConfig(testConfig(a))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		monitorHealth(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	waitForHealthy(t, a)
+
+	// The health interval is an hour, so b is only probed because of the
+	// reload.
+	applyConfig(testConfig(a, b))
+	waitForHealthy(t, a, b)
+
+	applyConfig(testConfig(b))
+	mu.RLock()
+	got := slices.Clone(healthyServers)
+	mu.RUnlock()
+	if !slices.Equal(got, []string{b}) {
+		t.Errorf("healthy servers %v right after removing %s", got, a)
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	begin("s1:8080")
+	done := make(chan bool)
+	go func() { done <- waitDrained("s1:8080", 5*time.Second) }()
+	select {
+	case <-done:
+		t.Fatal("drained with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	end("s1:8080", nil)
+	if !<-done {
+		t.Error("not drained after the request ended")
+	}
+
+	begin("s2:8080")
+	defer end("s2:8080", nil)
+	if waitDrained("s2:8080", 10*time.Millisecond) {
+		t.Error("drained with a request in flight")
+	}
+}
+
+func TestWatchConfigFileChange(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	path := writeConfig(t, `{"backends": ["a:80"]}`)
+	applyConfig(testConfig("a:80"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, path, 10*time.Millisecond)
+
+	// An invalid config is ignored.
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(`{"backends": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := currentConfig().Backends; !slices.Equal(got, []string{"a:80"}) {
+		t.Fatalf("invalid config applied: %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"backends": ["a:80", "b:80"], "timeout": "1s"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(currentConfig().Backends, []string{"a:80", "b:80"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("config not reloaded: %v", currentConfig().Backends)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if currentConfig().Timeout.Duration != time.Second {
+		t.Errorf("timeout %s after reload", currentConfig().Timeout)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// retryBurst is how many retries the budget holds when the balancer starts
+// or has been idle, so that a failure in a quiet period can still be
+// retried.
+const retryBurst = 10
+
+// retryBudget keeps retries from multiplying the load on backends that are
+// already failing: every request adds the configured ratio of a retry to the
+// budget, up to retryBurst, and every retry takes a whole one.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+var budget = &retryBudget{tokens: retryBurst}
+
+func (b *retryBudget) deposit(ratio float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+ratio, retryBurst)
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryable reports whether r can be sent again after a failed attempt.
+// Only GET and HEAD without a body are, since nothing of them reached the
+// client and sending them twice does no harm.
+func retryable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.ContentLength == 0
+}
+
+// nextServer returns the healthy server after the last one in tried that
+// has not been tried yet.
+func nextServer(tried []string) (string, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	start := 0
+	if i := slices.Index(healthyServers, tried[len(tried)-1]); i >= 0 {
+		start = i + 1
+	}
+	for i := range healthyServers {
+		server := healthyServers[(start+i)%len(healthyServers)]
+		if !slices.Contains(tried, server) {
+			return server, true
+		}
+	}
+	return "", false
+}
+
+// serve forwards r to the backend picked for it and, if that fails before
+// anything is written, retries idempotent requests on the next healthy
+// backends as far as the config and the retry budget allow. A half-open
+// backend that has all its trial requests out is passed over.
+func serve(rw http.ResponseWriter, r *http.Request) {
+	c := currentConfig()
+	server, ok := getServerIndex(requestKey(r))
+	if !ok {
+		http.Error(rw, "No healthy servers", http.StatusServiceUnavailable)
+		return
+	}
+	budget.deposit(c.RetryBudget)
+	// tried holds the backends tried or passed over, attempts counts the
+	// ones tried.
+	var tried []string
+	attempts := 0
+	for {
+		if !admit(server) {
+			tried = append(tried, server)
+			if server, ok = nextServer(tried); !ok {
+				break
+			}
+			continue
+		}
+		attempts++
+		begin(server)
+		err := tryForward(server, rw, r)
+		end(server, err)
+		if err == nil {
+			return
+		}
+		tried = append(tried, server)
+		if !retryable(r) || attempts > c.Retries || r.Context().Err() != nil {
+			break
+		}
+		next, ok := nextServer(tried)
+		if !ok {
+			break
+		}
+		if !budget.withdraw() {
+			log.Printf("Retry budget exhausted, not retrying %s %s", r.Method, r.URL)
+			break
+		}
+		log.Printf("Retrying %s %s on %s", r.Method, r.URL, next)
+		server = next
+	}
+	rw.WriteHeader(http.StatusServiceUnavailable)
+}
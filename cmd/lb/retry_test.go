@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// refusingBackend returns the address of a port nothing listens on.
+func refusingBackend(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestRetry(t *testing.T) {
+	defer applyConfig(defaultConfig())
+	defer func(b *retryBudget) { budget = b }(budget)
+	refused := refusingBackend(t)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer ok.Close()
+	good := strings.TrimPrefix(ok.URL, "http://")
+
+	// Least connections picks the first idle server, the refusing one. The
+	// breaker is off so that it stays in the pool.
+	retryConfig := func(backends ...string) *config {
+		c := testConfig(backends...)
+		c.Strategy = strategyLeastConnections
+		c.BreakerErrors, c.BreakerErrorRate = 0, 0
+		return c
+	}
+	c := retryConfig(refused, good)
+	applyConfig(c)
+	setHealthyServers(c.Backends)
+
+	do := func(method string) (int, string) {
+		rr := httptest.NewRecorder()
+		serve(rr, httptest.NewRequest(method, "/api/v1/some-data", nil))
+		return rr.Code, rr.Body.String()
+	}
+
+	budget = &retryBudget{tokens: retryBurst}
+	if code, body := do(http.MethodGet); code != http.StatusOK || body != "ok" {
+		t.Errorf("GET: got %d %q, want it retried on %s", code, body, good)
+	}
+	if code, _ := do(http.MethodHead); code != http.StatusOK {
+		t.Errorf("HEAD: got %d, want it retried", code)
+	}
+	if code, _ := do(http.MethodPost); code != http.StatusServiceUnavailable {
+		t.Errorf("POST: got %d, want 503 without a retry", code)
+	}
+
+	// Without a budget left the request fails like without retries.
+	budget = &retryBudget{}
+	if code, _ := do(http.MethodGet); code != http.StatusServiceUnavailable {
+		t.Errorf("GET with an empty budget: got %d, want 503", code)
+	}
+
+	budget = &retryBudget{tokens: retryBurst}
+	c = retryConfig(refused, good)
+	c.Retries = 0
+	applyConfig(c)
+	setHealthyServers(c.Backends)
+	if code, _ := do(http.MethodGet); code != http.StatusServiceUnavailable {
+		t.Errorf("GET with retries off: got %d, want 503", code)
+	}
+
+	// Every backend refusing ends in a 503 after trying each once.
+	c = retryConfig(refused, refusingBackend(t))
+	c.Retries = 5
+	applyConfig(c)
+	setHealthyServers(c.Backends)
+	if code, _ := do(http.MethodGet); code != http.StatusServiceUnavailable {
+		t.Errorf("GET with all backends down: got %d, want 503", code)
+	}
+	if got := budget.tokens; got < retryBurst-2 {
+		t.Errorf("%.1f tokens left, want at most one retry spent per other backend", got)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{}
+	if b.withdraw() {
+		t.Error("retry allowed with an empty budget")
+	}
+	// With a ratio of 0.25 every fourth request earns a retry.
+	for i := 0; i < 4; i++ {
+		b.deposit(0.25)
+	}
+	if !b.withdraw() {
+		t.Error("no retry after four requests")
+	}
+	if b.withdraw() {
+		t.Error("second retry after four requests")
+	}
+	for i := 0; i < 1000; i++ {
+		b.deposit(1)
+	}
+	if b.tokens != retryBurst {
+		t.Errorf("budget grew to %.0f, want at most %d", b.tokens, retryBurst)
+	}
+}
+
+func TestNextServer(t *testing.T) {
+	defer setHealthyServers(nil)
+	setHealthyServers([]string{"a", "b", "c"})
+	for _, tc := range []struct {
+		tried []string
+		want  string
+	}{
+		{[]string{"a"}, "b"},
+		{[]string{"c"}, "a"},
+		{[]string{"b", "c"}, "a"},
+		{[]string{"gone"}, "a"},
+		{[]string{"a", "b", "c"}, ""},
+	} {
+		if got, _ := nextServer(tc.tried); got != tc.want {
+			t.Errorf("after %v: got %q, want %q", tc.tried, got, tc.want)
+		}
+	}
+}
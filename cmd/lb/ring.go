@@ -0,0 +1,24 @@
+package main
+
+import "github.com/DmytroHalai/achitecture-practice-5/hashring"
+
+// newRing places servers on a consistent-hash ring, so a backend going down
+// or coming back only moves the keys next to its points. The ring is not
+// changed afterwards, so it is safe for concurrent use.
+func newRing(servers ...string) *hashring.Ring {
+	return newWeightedRing(nil, servers...)
+}
+
+// newWeightedRing gives every server points in proportion to its weight; a
+// nil weight counts every server as 1.
+func newWeightedRing(weight func(server string) int, servers ...string) *hashring.Ring {
+	r := hashring.New(hashring.DefaultReplicas)
+	for _, server := range servers {
+		w := 1
+		if weight != nil {
+			w = weight(server)
+		}
+		r.AddWeighted(server, w)
+	}
+	return r
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testServers(n int) []string {
+	servers := make([]string, n)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("server%d:8080", i+1)
+	}
+	return servers
+}
+
+func TestRingRemapping(t *testing.T) {
+	const keys = 10000
+	servers := testServers(5)
+	before := newRing(servers...)
+	after := newRing(append(servers[:2:2], servers[3:]...)...)
+
+	moved, owned := 0, 0
+	for i := 0; i < keys; i++ {
+		path := fmt.Sprintf("/api/v1/some-data/%d", i)
+		old, now := before.Get(path), after.Get(path)
+		if old == servers[2] {
+			owned++
+			continue
+		}
+		if old != now {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("%d paths of the remaining backends moved", moved)
+	}
+	// The removed backend owned about a fifth of the paths; with modulo
+	// hashing about four fifths of all paths would move instead.
+	if owned < keys/10 || owned > keys*3/10 {
+		t.Errorf("removed backend owned %d of %d paths", owned, keys)
+	}
+	t.Logf("removing 1 of 5 backends moved %.1f%% of the paths", 100*float64(owned)/keys)
+}
+
+func TestRingBalance(t *testing.T) {
+	const keys = 30000
+	servers := testServers(3)
+	r := newRing(servers...)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[r.Get(fmt.Sprintf("/path/%d", i))]++
+	}
+	for _, server := range servers {
+		if share := float64(counts[server]) / keys; share < 0.2 || share > 0.46 {
+			t.Errorf("%s got %.0f%% of the paths", server, 100*share)
+		}
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	if got := newRing().Get("/a"); got != "" {
+		t.Errorf("empty ring returned %q", got)
+	}
+}
+
+func TestWeightedRing(t *testing.T) {
+	const keys = 30000
+	servers := testServers(3)
+	weights := map[string]int{servers[0]: 2}
+	weight := func(server string) int { return max(weights[server], 1) }
+	before := newWeightedRing(weight, servers...)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[before.Get(fmt.Sprintf("/path/%d", i))]++
+	}
+	// Weights 2, 1 and 1 should give a half and two quarters.
+	if share := float64(counts[servers[0]]) / keys; share < 0.4 || share > 0.6 {
+		t.Errorf("%s of weight 2 got %.0f%% of the paths", servers[0], 100*share)
+	}
+
+	// Raising a weight only moves paths to the reweighted server.
+	weights[servers[1]] = 2
+	after := newWeightedRing(weight, servers...)
+	for i := 0; i < keys; i++ {
+		path := fmt.Sprintf("/path/%d", i)
+		if old, now := before.Get(path), after.Get(path); old != now && now != servers[1] {
+			t.Fatalf("%s moved from %s to %s", path, old, now)
+		}
+	}
+}
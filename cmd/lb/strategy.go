@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DmytroHalai/achitecture-practice-5/hashring"
+)
+
+// Strategy decides which healthy backend serves a request.
+type Strategy interface {
+	// Update replaces the servers to pick from. It is called whenever the
+	// healthy servers change.
+	Update(servers []string)
+	// Pick returns the server for a request with the given affinity key,
+	// or false if there are no servers. Only hashing strategies use key.
+	Pick(key string) (string, bool)
+}
+
+// Pool is what strategies know about the backends besides their addresses.
+type Pool interface {
+	InFlight(server string) int
+	// Weight is at least 1. Weights only change together with a call to
+	// Update, so strategies may cache them until the next one.
+	Weight(server string) int
+}
+
+// Strategy names accepted by -strategy and the config file.
+const (
+	strategyHash               = "hash"
+	strategyRoundRobin         = "round-robin"
+	strategyLeastConnections   = "least-connections"
+	strategyWeightedRoundRobin = "weighted-round-robin"
+	strategyP2C                = "p2c"
+)
+
+var strategyNames = []string{
+	strategyHash,
+	strategyRoundRobin,
+	strategyLeastConnections,
+	strategyWeightedRoundRobin,
+	strategyP2C,
+}
+
+func newStrategy(name string, pool Pool) (Strategy, error) {
+	switch name {
+	case strategyHash:
+		return &hashStrategy{ring: newRing(), pool: pool}, nil
+	case strategyRoundRobin:
+		return &roundRobin{pool: pool}, nil
+	case strategyLeastConnections:
+		return &leastConnections{pool: pool}, nil
+	case strategyWeightedRoundRobin:
+		return &weightedRoundRobin{pool: pool}, nil
+	case strategyP2C:
+		return &powerOfTwoChoices{pool: pool}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, want one of %v", name, strategyNames)
+}
+
+// servers is the list the list-based strategies pick from.
+type servers struct {
+	mu   sync.RWMutex
+	list []string
+}
+
+func (s *servers) Update(list []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = list
+}
+
+func (s *servers) get() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list
+}
+
+// hashStrategy sends every key to the same backend while the healthy set
+// and the weights stay the same, see newWeightedRing.
+type hashStrategy struct {
+	pool Pool
+
+	mu   sync.RWMutex
+	ring *hashring.Ring
+	n    int
+}
+
+func (s *hashStrategy) Update(list []string) {
+	ring := newWeightedRing(s.pool.Weight, list...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ring = ring
+	s.n = len(list)
+}
+
+func (s *hashStrategy) Pick(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.n == 0 {
+		return "", false
+	}
+	return s.ring.Get(key), true
+}
+
+// roundRobin cycles through the servers, each taking as many turns per cycle
+// as its weight. The turns are spread over the cycle: weights a=2 and b=1
+// give a, b, a.
+type roundRobin struct {
+	servers
+	pool Pool
+	next atomic.Uint64
+}
+
+func (s *roundRobin) Update(list []string) {
+	var cycle []string
+	for turn, left := 0, true; left; turn++ {
+		left = false
+		for _, server := range list {
+			if w := max(s.pool.Weight(server), 1); turn < w {
+				cycle = append(cycle, server)
+				left = left || turn+1 < w
+			}
+		}
+	}
+	s.servers.Update(cycle)
+}
+
+func (s *roundRobin) Pick(string) (string, bool) {
+	list := s.get()
+	if len(list) == 0 {
+		return "", false
+	}
+	return list[(s.next.Add(1)-1)%uint64(len(list))], true
+}
+
+// leastConnections picks the server with the fewest requests in flight,
+// the first one in the list on a tie.
+type leastConnections struct {
+	servers
+	pool Pool
+}
+
+func (s *leastConnections) Pick(string) (string, bool) {
+	list := s.get()
+	if len(list) == 0 {
+		return "", false
+	}
+	best, bestLoad := list[0], s.pool.InFlight(list[0])
+	for _, server := range list[1:] {
+		if load := s.pool.InFlight(server); load < bestLoad {
+			best, bestLoad = server, load
+		}
+	}
+	return best, true
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: every
+// pick adds each server's weight to its score and takes the highest score
+// down by the total weight, so a server of weight 2 among two of weight 1
+// is picked every other time instead of twice in a row.
+type weightedRoundRobin struct {
+	pool Pool
+
+	mu     sync.Mutex
+	list   []string
+	scores map[string]int
+}
+
+func (s *weightedRoundRobin) Update(list []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = list
+	s.scores = make(map[string]int, len(list))
+}
+
+func (s *weightedRoundRobin) Pick(string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.list) == 0 {
+		return "", false
+	}
+	best, total := "", 0
+	for _, server := range s.list {
+		weight := max(s.pool.Weight(server), 1)
+		total += weight
+		s.scores[server] += weight
+		if best == "" || s.scores[server] > s.scores[best] {
+			best = server
+		}
+	}
+	s.scores[best] -= total
+	return best, true
+}
+
+// powerOfTwoChoices picks two different servers at random and takes the one
+// with fewer requests in flight.
+type powerOfTwoChoices struct {
+	servers
+	pool Pool
+}
+
+func (s *powerOfTwoChoices) Pick(string) (string, bool) {
+	list := s.get()
+	switch len(list) {
+	case 0:
+		return "", false
+	case 1:
+		return list[0], true
+	}
+	i := rand.IntN(len(list))
+	j := rand.IntN(len(list) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := list[i], list[j]
+	if s.pool.InFlight(b) < s.pool.InFlight(a) {
+		return b, true
+	}
+	return a, true
+}
+
+// livePool is the Pool of the running balancer.
+type livePool struct{}
+
+func (livePool) InFlight(server string) int {
+	return inflightRequests(server)
+}
+
+func (livePool) Weight(server string) int {
+	return currentConfig().weight(server)
+}
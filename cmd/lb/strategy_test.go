@@ -0,0 +1,129 @@
+package main
+
+import "testing"
+
+// fakePool is a Pool with fixed loads and weights.
+type fakePool struct {
+	inflight map[string]int
+	weights  map[string]int
+}
+
+func (p fakePool) InFlight(server string) int { return p.inflight[server] }
+func (p fakePool) Weight(server string) int   { return p.weights[server] }
+
+func pickN(t *testing.T, s Strategy, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		server, ok := s.Pick("/path")
+		if !ok {
+			t.Fatal("Pick found no server")
+		}
+		counts[server]++
+	}
+	return counts
+}
+
+func TestStrategies(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+
+	t.Run("round-robin", func(t *testing.T) {
+		s, _ := newStrategy(strategyRoundRobin, fakePool{})
+		s.Update(servers)
+		for i := 0; i < 6; i++ {
+			if got, _ := s.Pick(""); got != servers[i%3] {
+				t.Fatalf("pick %d: got %s, want %s", i, got, servers[i%3])
+			}
+		}
+	})
+
+	t.Run("weighted round-robin", func(t *testing.T) {
+		s, _ := newStrategy(strategyRoundRobin, fakePool{weights: map[string]int{"a": 3, "c": 2}})
+		s.Update(servers)
+		var order string
+		for i := 0; i < 12; i++ {
+			got, _ := s.Pick("")
+			order += got
+		}
+		if order != "abcacaabcaca" {
+			t.Errorf("got picks %s, want abcaca twice", order)
+		}
+	})
+
+	t.Run("least-connections", func(t *testing.T) {
+		s, _ := newStrategy(strategyLeastConnections, fakePool{inflight: map[string]int{"a": 3, "b": 1, "c": 2}})
+		s.Update(servers)
+		if got, _ := s.Pick(""); got != "b" {
+			t.Errorf("got %s, want the least busy b", got)
+		}
+		s, _ = newStrategy(strategyLeastConnections, fakePool{})
+		s.Update(servers)
+		if got, _ := s.Pick(""); got != "a" {
+			t.Errorf("got %s on a tie, want the first server a", got)
+		}
+	})
+
+	t.Run("weighted-round-robin", func(t *testing.T) {
+		s, _ := newStrategy(strategyWeightedRoundRobin, fakePool{weights: map[string]int{"a": 3, "b": 1}})
+		s.Update([]string{"a", "b"})
+		var order string
+		for i := 0; i < 8; i++ {
+			got, _ := s.Pick("")
+			order += got
+		}
+		if order != "aabaaaba" {
+			t.Errorf("got picks %s, want aabaaaba", order)
+		}
+	})
+
+	t.Run("p2c", func(t *testing.T) {
+		s, _ := newStrategy(strategyP2C, fakePool{inflight: map[string]int{"a": 5, "b": 0, "c": 1}})
+		s.Update(servers)
+		counts := pickN(t, s, 300)
+		if counts["a"] != 0 {
+			t.Errorf("the busiest server got %d of 300 picks", counts["a"])
+		}
+		if counts["b"] == 0 || counts["c"] == 0 {
+			t.Errorf("got %v, want both less busy servers picked", counts)
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		s, _ := newStrategy(strategyHash, fakePool{})
+		s.Update(servers)
+		first, _ := s.Pick("/some/path")
+		for i := 0; i < 10; i++ {
+			if got, _ := s.Pick("/some/path"); got != first {
+				t.Fatalf("got %s, then %s for the same key", first, got)
+			}
+		}
+	})
+}
+
+func TestStrategiesEmpty(t *testing.T) {
+	for _, name := range strategyNames {
+		s, err := newStrategy(name, fakePool{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server, ok := s.Pick("/"); ok {
+			t.Errorf("%s: got %s before Update", name, server)
+		}
+		s.Update([]string{"a"})
+		s.Update(nil)
+		if server, ok := s.Pick("/"); ok {
+			t.Errorf("%s: got %s with no servers", name, server)
+		}
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := newStrategy("random", fakePool{}); err == nil {
+		t.Error("got no error for an unknown strategy")
+	}
+	c := defaultConfig()
+	c.Strategy = "random"
+	if err := c.validate(); err == nil {
+		t.Error("validate accepted an unknown strategy")
+	}
+}
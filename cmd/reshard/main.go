@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+	"github.com/DmytroHalai/achitecture-practice-5/shard"
+)
+
+var (
+	shards  = flag.String("shards", "http://localhost:8083", "comma separated base URLs of the current db shards")
+	add     = flag.String("add", "", "base URL of a shard to add")
+	remove  = flag.String("remove", "", "base URL of a shard to remove")
+	cleanup = flag.Bool("cleanup", false, "only delete keys left on shards that do not own them")
+	token   = flag.String("token", "", "bearer token with read and write access to every shard")
+	settle  = flag.Duration("settle", shard.DefaultSettle, "how long to wait for the servers to load each new topology; must exceed their -db-refresh")
+)
+
+// reshard moves keys between db shards when one is added or removed. The
+// servers keep serving while it runs: they load every step from the topology
+// stored on the shards. A failed run can simply be repeated.
+func main() {
+	flag.Parse()
+	if *cleanup == (*add != "" || *remove != "") || (*add != "" && *remove != "") {
+		log.Fatal("exactly one of -add, -remove and -cleanup is required")
+	}
+
+	client := shard.NewClient(shard.ParseShards(*shards), dbclient.WithToken(*token))
+	client.SetSettle(*settle)
+	ctx := context.Background()
+	if err := client.Refresh(ctx); err != nil {
+		log.Fatalf("failed to load the shard topology: %v", err)
+	}
+	var err error
+	switch {
+	case *add != "":
+		err = client.AddShard(ctx, *add)
+	case *remove != "":
+		err = client.RemoveShard(ctx, *remove)
+	default:
+		err = client.Cleanup(ctx)
+	}
+	if err != nil {
+		log.Fatalf("resharding failed: %v", err)
+	}
+	fmt.Println(strings.Join(client.Shards(), ","))
+}
@@ -1,32 +1,49 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
 	"github.com/DmytroHalai/achitecture-practice-5/httptools"
+	"github.com/DmytroHalai/achitecture-practice-5/shard"
 	"github.com/DmytroHalai/achitecture-practice-5/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port      = flag.Int("port", 8080, "server port")
+	dbShards  = flag.String("db-shards", "http://db:8083", "comma separated base URLs of the db shards; the topology stored on them by reshard takes precedence")
+	dbTimeout = flag.Duration("db-timeout", dbclient.DefaultTimeout, "timeout of a single db request attempt")
+	dbToken   = flag.String("db-token", "", "bearer token sent to the db shards")
+	dbRefresh = flag.Duration("db-refresh", 10*time.Second, "how often to reload the shard topology; must be shorter than the reshard -settle time")
+)
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
 const teamKey = "object261"
-const dbAddr = "http://db:8083"
 
 func main() {
+	flag.Parse()
+	db := shard.NewClient(shard.ParseShards(*dbShards), dbclient.WithTimeout(*dbTimeout), dbclient.WithToken(*dbToken))
+
 	now := time.Now().Format("2006-01-02")
-	postBody, _ := json.Marshal(map[string]string{"value": now})
-	_, _ = http.Post(fmt.Sprintf("%s/db/%s", dbAddr, teamKey), "application/json", bytes.NewReader(postBody))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := db.Refresh(ctx); err != nil {
+		log.Printf("failed to load the shard topology: %v", err)
+	}
+	go refreshShards(db)
+	if err := db.Put(ctx, teamKey, now); err != nil {
+		log.Printf("failed to store %q: %v", teamKey, err)
+	}
+	cancel()
 
 	h := new(http.ServeMux)
 
@@ -56,24 +73,26 @@ func main() {
 			key = teamKey
 		}
 
-		resp, err := http.Get(fmt.Sprintf("%s/db/%s", dbAddr, key))
-		if err != nil {
-			http.Error(rw, "db unavailable", http.StatusServiceUnavailable)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusNotFound {
+		// The item is passed on as the db sent it; a db that answers with
+		// an error is a 500, one that cannot be reached a 503.
+		item, err := db.GetItem(r.Context(), key)
+		var statusErr *dbclient.StatusError
+		switch {
+		case errors.Is(err, dbclient.ErrNotFound):
 			rw.WriteHeader(http.StatusNotFound)
 			return
-		}
-		if resp.StatusCode != http.StatusOK {
+		case errors.As(err, &statusErr):
+			log.Printf("failed to read %q: %v", key, err)
 			http.Error(rw, "db error", http.StatusInternalServerError)
 			return
+		case err != nil:
+			log.Printf("failed to read %q: %v", key, err)
+			http.Error(rw, "db unavailable", http.StatusServiceUnavailable)
+			return
 		}
-		body, _ := io.ReadAll(resp.Body)
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		rw.Write(body)
+		_ = json.NewEncoder(rw).Encode(item)
 	})
 
 	h.Handle("/report", report)
@@ -82,3 +101,14 @@ func main() {
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// refreshShards keeps the client on the topology that reshard publishes.
+func refreshShards(db *shard.Client) {
+	for range time.Tick(*dbRefresh) {
+		ctx, cancel := context.WithTimeout(context.Background(), *dbTimeout)
+		if err := db.Refresh(ctx); err != nil {
+			log.Printf("failed to refresh the shard topology: %v", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultChangeFeedSize is the number of recent changes kept for watchers.
+const DefaultChangeFeedSize = 10000
+
+// ErrChangesGone means the requested changes are older than the ones still
+// kept in the feed, or were made before the datastore was last opened. The
+// watcher has to read the current state again and continue from ChangeSeq.
+var ErrChangesGone = errors.New("changes are no longer available")
+
+const (
+	changeSeqFileName = "change-seq"
+	// changeSeqBlock is how many sequence numbers are reserved on disk at a
+	// time, so the file is written once per block rather than per change.
+	changeSeqBlock = 1 << 16
+)
+
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Change is a write that happened to a key. It does not carry the value,
+// which may be large; watchers read it with Get if they need it.
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Op  string `json:"op"`
+	Key string `json:"key"`
+}
+
+// changeFeed keeps the most recent changes in memory, in a ring buffer.
+// Sequence numbers are reserved in blocks in the change-seq file and a
+// reopened feed starts after the last reserved one, so they keep increasing
+// across restarts and crashes. A watcher resuming with a sequence number from
+// before a restart gets ErrChangesGone instead of silently missing changes.
+type changeFeed struct {
+	mu      sync.Mutex
+	ring    []Change
+	start   int
+	count   int
+	last    uint64
+	updated chan struct{}
+
+	// path is the change-seq file, empty for read-only datastores, and
+	// reserved the highest sequence number recorded in it.
+	path     string
+	reserved uint64
+}
+
+func newChangeFeed(size int) *changeFeed {
+	size = max(size, 1)
+	return &changeFeed{
+		ring:    make([]Change, size),
+		updated: make(chan struct{}),
+	}
+}
+
+// openChangeFeed is newChangeFeed continuing the sequence numbers reserved in
+// dir.
+func openChangeFeed(dir string, size int) (*changeFeed, error) {
+	f := newChangeFeed(size)
+	f.path = filepath.Join(dir, changeSeqFileName)
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read change sequence: %w", err)
+	}
+	if err == nil {
+		if f.last, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: bad change sequence: %v", ErrCorrupted, err)
+		}
+	}
+	f.reserved = f.last
+	return f, nil
+}
+
+// reserve makes sure the next changes have sequence numbers on disk. Writers
+// call it before writing, so a failure to record them fails the write.
+func (f *changeFeed) reserve() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.path == "" || f.reserved-f.last >= changeSeqBlock/2 {
+		return nil
+	}
+	reserved := f.last + changeSeqBlock
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(reserved, 10)+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to reserve change sequence: %w", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("failed to reserve change sequence: %w", err)
+	}
+	f.reserved = reserved
+	return nil
+}
+
+func (f *changeFeed) add(op, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last++
+	change := Change{Seq: f.last, Op: op, Key: key}
+	if f.count < len(f.ring) {
+		f.ring[(f.start+f.count)%len(f.ring)] = change
+		f.count++
+	} else {
+		f.ring[f.start] = change
+		f.start = (f.start + 1) % len(f.ring)
+	}
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// read returns the changes after since whose keys have prefix, the sequence
+// number the reader has seen up to, and a channel closed on the next change.
+func (f *changeFeed) read(since uint64, prefix string) ([]Change, uint64, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldest := f.last - uint64(f.count) + 1
+	if since+1 < oldest || since > f.last {
+		return nil, f.last, nil, ErrChangesGone
+	}
+	var changes []Change
+	for i := int(since + 1 - oldest); i < f.count; i++ {
+		change := f.ring[(f.start+i)%len(f.ring)]
+		if strings.HasPrefix(change.Key, prefix) {
+			changes = append(changes, change)
+		}
+	}
+	return changes, f.last, f.updated, nil
+}
+
+// ChangeSeq returns the sequence number of the latest change. Watching from
+// it yields only changes that happen afterwards.
+func (ds *SegmentedDatastore) ChangeSeq() uint64 {
+	ds.feed.mu.Lock()
+	defer ds.feed.mu.Unlock()
+	return ds.feed.last
+}
+
+// Changes returns the changes after since to keys with the given prefix,
+// oldest first, and the sequence number to pass as since on the next call.
+func (ds *SegmentedDatastore) Changes(since uint64, prefix string) ([]Change, uint64, error) {
+	changes, next, _, err := ds.feed.read(since, prefix)
+	return changes, next, err
+}
+
+// WatchChanges is like Changes but waits until there is at least one matching
+// change or ctx is done.
+func (ds *SegmentedDatastore) WatchChanges(ctx context.Context, since uint64, prefix string) ([]Change, uint64, error) {
+	for {
+		changes, next, updated, err := ds.feed.read(since, prefix)
+		if err != nil || len(changes) > 0 {
+			return changes, next, err
+		}
+		since = next
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, since, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), 1<<20, WithChangeFeedSize(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	start := ds.ChangeSeq()
+	ds.Put("a/1", "v")
+	ds.Put("b/1", "v")
+	ds.Delete("a/1")
+
+	changes, next, err := ds.Changes(start, "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{Seq: start + 1, Op: OpPut, Key: "a/1"}, {Seq: start + 3, Op: OpDelete, Key: "a/1"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %v, want %v", changes, want)
+	}
+	if next != start+3 {
+		t.Errorf("next: got %d, want %d", next-start, 3)
+	}
+
+	for i := 0; i < 5; i++ {
+		ds.Put(fmt.Sprintf("c/%d", i), "v")
+	}
+	if _, _, err := ds.Changes(start, ""); !errors.Is(err, ErrChangesGone) {
+		t.Errorf("changes pushed out of the feed: got %v, want ErrChangesGone", err)
+	}
+	if changes, _, err := ds.Changes(next+1, ""); err != nil || len(changes) != 4 {
+		t.Errorf("changes still in the feed: got %v, %v", changes, err)
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	since := ds.ChangeSeq()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ds.Put("other", "v")
+		ds.Put("config/x", "v")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	changes, next, err := ds.WatchChanges(ctx, since, "config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Key != "config/x" || next != since+2 {
+		t.Errorf("got %v up to %d", changes, next-since)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := ds.WatchChanges(ctx, next, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestChangesAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewSegmentedDatastore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Put("a", "v")
+	ds.Put("b", "v")
+	before := ds.ChangeSeq()
+	ds.Close()
+
+	ds, err = NewSegmentedDatastore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if ds.ChangeSeq() <= before {
+		t.Fatalf("sequence went back after reopening: %d, was %d", ds.ChangeSeq(), before)
+	}
+	if _, _, err := ds.Changes(before, ""); !errors.Is(err, ErrChangesGone) {
+		t.Errorf("changes from before reopening: got %v, want ErrChangesGone", err)
+	}
+	since := ds.ChangeSeq()
+	ds.Put("c", "v")
+	if changes, _, err := ds.Changes(since, ""); err != nil || len(changes) != 1 || changes[0].Seq != since+1 {
+		t.Errorf("changes after reopening: got %v, %v", changes, err)
+	}
+}
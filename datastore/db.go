@@ -2,32 +2,96 @@ package datastore
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 const (
 	outFileName = "current-data"
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrReadOnly = errors.New("datastore is opened in read-only mode")
+
+	// errDeleted tells a SegmentedDatastore that the key was deleted in this
+	// segment, so older segments must not be consulted.
+	errDeleted = fmt.Errorf("%w: deleted", ErrNotFound)
+)
+
+// tombstone marks a deleted key in the index.
+const tombstone = -1
 
 type hashIndex map[string]int64
 
 type Db struct {
 	out       *os.File
 	outOffset int64
+	dir       string
 	filename  string
 	index     hashIndex
+	lock      *dirLock
+	readOnly  bool
+	opts      options
+
+	// file is the handle all reads go through, so they keep working after
+	// Merge removed the file.
+	file *segmentFile
+
+	// headerSize is where the records start. aead is set if the values of
+	// the segment are encrypted.
+	header     segmentHeader
+	headerSize int64
+	aead       cipher.AEAD
+
+	mu          sync.RWMutex
+	writeCh     chan writeRequest
+	wg          sync.WaitGroup
+	stopOnce    sync.Once
+	releaseOnce sync.Once
+	closeErr    error
+}
 
-	mu       sync.RWMutex
-	writeCh  chan entry
-	wg       sync.WaitGroup
-	stopOnce sync.Once
+// segmentFile is the read handle of a segment file. The Db shares it with the
+// readers that outlive a lock on it, Views and the readers of GetReader, and
+// it is closed when the last of them releases it.
+type segmentFile struct {
+	*os.File
+	refs atomic.Int64
+}
+
+func newSegmentFile(f *os.File) *segmentFile {
+	sf := &segmentFile{File: f}
+	sf.refs.Store(1)
+	return sf
+}
+
+func (f *segmentFile) acquire() {
+	f.refs.Add(1)
+}
+
+func (f *segmentFile) release() error {
+	if f.refs.Add(-1) == 0 {
+		return f.File.Close()
+	}
+	return nil
+}
+
+type writeRequest struct {
+	e    entry
+	done chan error
+
+	// body, when set, is copied into the record as the value instead of
+	// e.value; size is the exact number of bytes it holds.
+	body io.Reader
+	size int64
 }
 
 type Entry struct {
@@ -36,47 +100,84 @@ type Entry struct {
 }
 
 func (db *Db) ReadAll() ([]Entry, error) {
-	file, err := os.Open(db.filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
 	var entries []Entry
-	reader := bufio.NewReader(file)
+	err := db.readRecords(func(record entry) {
+		if record.value != "" {
+			entries = append(entries, Entry{Key: record.key, Value: record.value})
+		}
+	})
+	return entries, err
+}
+
+// readRecords calls fn for every record in the file, deletions included.
+func (db *Db) readRecords(fn func(record entry)) error {
+	return db.readRecordsUntil(-1, fn)
+}
+
+// readRecordsUntil is readRecords for the records stored before offset end;
+// a negative end reads all complete records.
+func (db *Db) readRecordsUntil(end int64, fn func(record entry)) error {
+	if end < 0 {
+		end = db.committedSize()
+	}
+	reader := bufio.NewReader(io.NewSectionReader(db.file, db.headerSize, end-db.headerSize))
 	for {
 		var record entry
-		n, err := record.DecodeFromReader(reader)
+		n, err := db.decodeRecord(reader, &record)
 		if err != nil {
 			if errors.Is(err, io.EOF) && n == 0 {
 				break
 			}
-			return nil, fmt.Errorf("error during record decoding: %w", err)
-		}
-		if record.value == "" {
-			continue
+			return fmt.Errorf("error during record decoding: %w", err)
 		}
-		entries = append(entries, Entry{Key: record.key, Value: record.value})
+		fn(record)
 	}
-	return entries, nil
+	return nil
 }
 
-func Open(dir string) (*Db, error) {
+// Open opens the data directory for writing. The directory is locked for the
+// lifetime of the Db, so a second writer fails with ErrLocked.
+func Open(dir string, opts ...Option) (*Db, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create a catalogue %s: %w", dir, err)
 	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	outputPath := filepath.Join(dir, outFileName)
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	o := newOptions(opts)
+	if err := writeHeader(f, newSegmentHeader(o)); err != nil {
+		f.Close()
+		lock.release()
+		return nil, err
+	}
+	r, err := os.Open(outputPath)
+	if err != nil {
+		f.Close()
+		lock.release()
 		return nil, err
 	}
 	db := &Db{
 		out:      f,
+		file:     newSegmentFile(r),
+		dir:      dir,
 		filename: outputPath,
 		index:    make(hashIndex),
-		writeCh:  make(chan entry, 128),
+		lock:     lock,
+		opts:     o,
+		writeCh:  make(chan writeRequest, 128),
 	}
 	err = db.recover()
 	if err != nil && err != io.EOF {
+		f.Close()
+		r.Close()
+		lock.release()
 		return nil, err
 	}
 	db.wg.Add(1)
@@ -84,18 +185,54 @@ func Open(dir string) (*Db, error) {
 	return db, nil
 }
 
+// OpenReadOnly opens an existing data directory without taking its lock, so
+// it can be used next to a running writer. Put returns ErrReadOnly.
+func OpenReadOnly(dir string, opts ...Option) (*Db, error) {
+	outputPath := filepath.Join(dir, outFileName)
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &Db{
+		out:      f,
+		file:     newSegmentFile(f),
+		dir:      dir,
+		filename: outputPath,
+		index:    make(hashIndex),
+		readOnly: true,
+		opts:     newOptions(opts),
+	}
+	err = db.recover()
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
 func (db *Db) recover() error {
-	f, err := os.Open(db.out.Name())
+	info, err := db.file.Stat()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	in := bufio.NewReader(f)
-	offset := int64(0)
+	in := bufio.NewReader(io.NewSectionReader(db.file, 0, info.Size()))
+	if err := db.readHeader(in); err != nil {
+		return err
+	}
+	offset := db.headerSize
 	for {
+		if torn(in, info.Size()-offset) {
+			// A crash in the middle of a write, most likely of a
+			// streamed value, left the last record incomplete.
+			if !db.readOnly {
+				if err := db.out.Truncate(offset); err != nil {
+					return fmt.Errorf("cannot truncate the incomplete record at offset %d: %w", offset, err)
+				}
+			}
+			break
+		}
 		var record entry
-		n, err := record.DecodeFromReader(in)
+		n, err := db.decodeRecord(in, &record)
 		if errors.Is(err, io.EOF) && n == 0 {
 			break
 		}
@@ -103,67 +240,175 @@ func (db *Db) recover() error {
 			return fmt.Errorf("decode error at offset %d: %w", offset, err)
 		}
 
-		db.index[record.key] = offset
+		if record.value == "" {
+			db.index[record.key] = tombstone
+		} else {
+			db.index[record.key] = offset
+		}
 		offset += int64(n)
 	}
 	db.outOffset = offset
 	return nil
 }
 
+// torn reports whether the record at the front of in does not fit into the
+// remaining bytes of the file.
+func torn(in *bufio.Reader, remaining int64) bool {
+	if remaining == 0 {
+		return false
+	}
+	size, err := in.Peek(4)
+	if err != nil {
+		return true
+	}
+	return int64(binary.LittleEndian.Uint32(size)) > remaining
+}
+
 func (db *Db) writeLoop() {
 	defer db.wg.Done()
-	for e := range db.writeCh {
-		data := e.Encode()
-		n, err := db.out.Write(data)
+	for req := range db.writeCh {
+		var (
+			n   int64
+			err error
+		)
+		if req.body != nil {
+			n, err = db.writeStream(req.e.key, req.body, req.size)
+		} else {
+			var written int
+			written, err = db.out.Write(req.e.Encode())
+			n = int64(written)
+		}
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "write error: %v\n", err)
+			req.done <- fmt.Errorf("write error: %w", err)
 			continue
 		}
 		db.mu.Lock()
-		db.index[e.key] = db.outOffset
-		db.outOffset += int64(n)
+		if req.e.value == "" && req.size == 0 {
+			db.index[req.e.key] = tombstone
+		} else {
+			db.index[req.e.key] = db.outOffset
+		}
+		db.outOffset += n
 		db.mu.Unlock()
+		req.done <- nil
 	}
 }
 
+// Close stops the writes and releases the segment file.
 func (db *Db) Close() error {
+	err := db.closeWrites()
+	db.releaseOnce.Do(func() {
+		if releaseErr := db.file.release(); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	})
+	return err
+}
+
+// closeWrites stops the writes and unlocks the directory but keeps the Db
+// readable, for a segment that rotation retires.
+func (db *Db) closeWrites() error {
 	db.stopOnce.Do(func() {
-		close(db.writeCh)
+		if db.writeCh != nil {
+			close(db.writeCh)
+		}
+		db.wg.Wait()
+		if !db.readOnly {
+			db.closeErr = db.out.Close()
+		}
+		if err := db.lock.release(); err != nil && db.closeErr == nil {
+			db.closeErr = err
+		}
 	})
-	db.wg.Wait()
-	return db.out.Close()
+	return db.closeErr
 }
 
-func (db *Db) Get(key string) (string, error) {
+// position returns the offset of the latest record for key.
+func (db *Db) position(key string) (int64, error) {
 	db.mu.RLock()
 	position, ok := db.index[key]
 	db.mu.RUnlock()
 	if !ok {
-		return "", ErrNotFound
+		return 0, ErrNotFound
 	}
-	file, err := os.Open(db.out.Name())
-	if err != nil {
-		return "", err
+	if position == tombstone {
+		return 0, errDeleted
 	}
-	defer file.Close()
-	_, err = file.Seek(position, 0)
+	return position, nil
+}
+
+// committedSize returns the size of the file up to the last fully written
+// record.
+func (db *Db) committedSize() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.outOffset
+}
+
+func (db *Db) Get(key string) (string, error) {
+	position, err := db.position(key)
 	if err != nil {
 		return "", err
 	}
+	in := io.NewSectionReader(db.file, position, db.committedSize()-position)
 	var record entry
-	if _, err = record.DecodeFromReader(bufio.NewReader(file)); err != nil {
+	if _, err = db.decodeRecord(bufio.NewReader(in), &record); err != nil {
 		return "", err
 	}
 	return record.value, nil
 }
 
+// decodeRecord reads the next record from in and decrypts its value.
+func (db *Db) decodeRecord(in *bufio.Reader, record *entry) (int, error) {
+	n, err := record.decodeFromReader(in)
+	if err != nil || db.aead == nil || record.value == "" {
+		return n, err
+	}
+	if record.value, err = unseal(db.aead, record.key, record.value); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
 func (db *Db) Put(key, value string) error {
-	entry := entry{key: key, value: value}
-	db.writeCh <- entry
-	if value == "" {
-		delete(db.index, key)
+	if db.readOnly {
+		return ErrReadOnly
 	}
-	return nil
+	if err := db.opts.checkSizes(key, len(value)); err != nil {
+		return err
+	}
+	return db.put(key, value)
+}
+
+// put is Put without the size limits, for records that were accepted
+// before, possibly under higher limits.
+func (db *Db) put(key, value string) error {
+	if db.aead != nil && value != "" {
+		var err error
+		if value, err = seal(db.aead, key, value); err != nil {
+			return fmt.Errorf("failed to encrypt value: %w", err)
+		}
+	}
+	req := writeRequest{
+		e:    entry{key: key, value: value},
+		done: make(chan error, 1),
+	}
+	db.writeCh <- req
+	return <-req.done
+}
+
+// PutBytes stores an arbitrary binary value under a binary key. As with Put,
+// an empty value deletes the key.
+func (db *Db) PutBytes(key, value []byte) error {
+	return db.Put(string(key), string(value))
+}
+
+func (db *Db) GetBytes(key []byte) ([]byte, error) {
+	value, err := db.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
 }
 
 func (db *Db) Size() (int64, error) {
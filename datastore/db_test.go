@@ -1,6 +1,11 @@
 package datastore
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -86,3 +91,171 @@ func TestDb(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenLocked(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Open: expected ErrLocked, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatalf("Open after Close: %v", err)
+	}
+	_ = db.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenReadOnly(tmp)
+	if err != nil {
+		t.Fatalf("OpenReadOnly next to a writer: %v", err)
+	}
+	defer ro.Close()
+
+	value, err := ro.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "v1" {
+		t.Errorf("get(k1) = %q, wanted v1", value)
+	}
+	if err := ro.Put("k2", "v2"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put on read-only db: expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestPutSizeLimits(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithMaxKeySize(8), WithMaxValueSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("key", strings.Repeat("v", 16)); err != nil {
+		t.Errorf("value at the limit: %v", err)
+	}
+	if err := db.Put("key", strings.Repeat("v", 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := db.Put(strings.Repeat("k", 9), "v"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+}
+
+func TestLoweredLimitsKeepRecordsReadable(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 64)
+	if err := db.Put(strings.Repeat("k", 32), value); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(tmp, WithMaxKeySize(8), WithMaxValueSize(16))
+	if err != nil {
+		t.Fatalf("reopen with lower limits: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if got, err := db.Get(strings.Repeat("k", 32)); err != nil || got != value {
+		t.Errorf("record written under the old limits: %q, %v", got, err)
+	}
+	if err := db.Put("key", value); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("new write over the lowered limit: expected ErrValueTooLarge, got %v", err)
+	}
+}
+
+func TestOpenTruncatesTornRecord(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	complete := db.committedSize()
+	if err := db.Put("k2", strings.Repeat("v", 100)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// The crash happened halfway through the value of k2.
+	if err := os.Truncate(filepath.Join(tmp, outFileName), complete+50); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatalf("reopen after a torn write: %v", err)
+	}
+	if got, err := db.Get("k1"); err != nil || got != "v1" {
+		t.Errorf("k1: %q, %v", got, err)
+	}
+	if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("torn k2: expected ErrNotFound, got %v", err)
+	}
+	if err := db.Put("k3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatalf("reopen after writing past the torn record: %v", err)
+	}
+	defer db.Close()
+	if got, err := db.Get("k3"); err != nil || got != "v3" {
+		t.Errorf("k3: %q, %v", got, err)
+	}
+}
+
+func TestPutGetBytes(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	key := []byte{0x00, 0xff, 'k', 0x80}
+	value := []byte{0x00, 0x01, 0xfe, 0xff, 0x00, 0xc3, 0x28}
+	if err := db.PutBytes(key, value); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("GetBytes() = %v, wanted %v", got, value)
+	}
+}
@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealOverhead is what AES-GCM adds to a value: the nonce and the tag.
+const sealOverhead = 12 + 16
+
+var (
+	ErrUnknownKey = errors.New("segment is encrypted with a key that is not configured")
+	ErrDecrypt    = errors.New("cannot decrypt record")
+)
+
+// KeyRing holds the AES keys segments are encrypted with, by key ID. New
+// segments are encrypted with the current key; the others are only used to
+// read segments written before the current key was added.
+type KeyRing struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeyRing parses keys written as id:hex-key and separated by whitespace
+// or commas, e.g. the contents of a key file or an environment variable. Keys
+// are 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256. The last key is
+// the current one, so a key is rotated by appending a new one.
+func ParseKeyRing(text string) (*KeyRing, error) {
+	keys := &KeyRing{aeads: make(map[string]cipher.AEAD)}
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, field := range fields {
+		id, hexKey, ok := strings.Cut(field, ":")
+		if !ok || id == "" || len(id) > maxKeyIDLength {
+			return nil, fmt.Errorf("bad key %q: want id:hex-key with an id of 1-%d bytes", field, maxKeyIDLength)
+		}
+		if _, ok := keys.aeads[id]; ok {
+			return nil, fmt.Errorf("key %s is given twice", id)
+		}
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("bad key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keys.aeads[id] = aead
+		keys.current = id
+	}
+	if len(keys.aeads) == 0 {
+		return nil, errors.New("no encryption keys given")
+	}
+	return keys, nil
+}
+
+// Current returns the ID of the key new segments are encrypted with.
+func (k *KeyRing) Current() string {
+	return k.current
+}
+
+func (k *KeyRing) aead(id string) (cipher.AEAD, error) {
+	if k != nil {
+		if aead, ok := k.aeads[id]; ok {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+}
+
+// WithEncryption encrypts the values of new segments with the current key of
+// keys. Segments written without encryption or under older keys stay
+// readable, and Merge rewrites them under the current key.
+//
+// Only the values at rest are encrypted, each one as a whole:
+//   - GetReader and PutStream hold an encrypted value in memory while it is
+//     decrypted or encrypted, so they do not stream it;
+//   - ReadLog, Snapshot and View return decrypted records, so replication
+//     and Raft traffic carry plaintext and have to be protected by the
+//     transport.
+func WithEncryption(keys *KeyRing) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// keyID is the ID of the key new segments are encrypted with, or "" if they
+// are not encrypted. It is recorded in the segment header.
+func (o options) keyID() string {
+	if o.keys == nil {
+		return ""
+	}
+	return o.keys.Current()
+}
+
+// openCipher picks the key of the segment header, if it names one.
+func (db *Db) openCipher() error {
+	if db.header.keyID == "" {
+		return nil
+	}
+	var err error
+	db.aead, err = db.opts.keys.aead(db.header.keyID)
+	return err
+}
+
+// seal encrypts a value of key. The key is authenticated along with it, so a
+// value cannot be moved to another key unnoticed.
+func seal(aead cipher.AEAD, key, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return string(aead.Seal(nonce, nonce, []byte(value), []byte(key))), nil
+}
+
+func unseal(aead cipher.AEAD, key, sealed string) (string, error) {
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w of %s: value too short", ErrDecrypt, key)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, []byte(nonce), []byte(ciphertext), []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("%w of %s: %v", ErrDecrypt, key, err)
+	}
+	return string(value), nil
+}
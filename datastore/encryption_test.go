@@ -0,0 +1,217 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "k1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "k2:1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func mustKeyRing(t *testing.T, text string) *KeyRing {
+	t.Helper()
+	keys, err := ParseKeyRing(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// segmentFiles returns the contents of every segment file in dir.
+func segmentFiles(t *testing.T, dir string) []byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.db", outFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []byte
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, data...)
+	}
+	return all
+}
+
+func checkValues(t *testing.T, ds *SegmentedDatastore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := ds.Get(key); err != nil || value != fmt.Sprintf("secret%d", i) {
+			t.Errorf("%s: got %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	keys, err := ParseKeyRing(testKey1 + ",\n" + testKey2 + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current() != "k2" {
+		t.Errorf("current key %q, want the last one", keys.Current())
+	}
+	for _, bad := range []string{
+		"",
+		"k1",
+		":00112233445566778899aabbccddeeff",
+		"k1:0011",
+		"k1:not-hex",
+		testKey1 + " " + testKey1,
+	} {
+		if _, err := ParseKeyRing(bad); err == nil {
+			t.Errorf("ParseKeyRing(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize, WithEncryption(mustKeyRing(t, testKey1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := ds.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("secret%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Delete("key19"); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, ds, 19)
+	ds.Close()
+
+	if data := segmentFiles(t, dir); bytes.Contains(data, []byte("secret")) {
+		t.Error("segment files hold plaintext values")
+	}
+
+	if _, err := NewSegmentedDatastore(dir, testMaxSegmentSize); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("open without the key: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := NewSegmentedDatastore(dir, testMaxSegmentSize, WithEncryption(mustKeyRing(t, testKey2))); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("open with another key: got %v, want ErrUnknownKey", err)
+	}
+
+	ds, err = NewSegmentedDatastore(dir, testMaxSegmentSize, WithEncryption(mustKeyRing(t, testKey1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	checkValues(t, ds, 19)
+	if _, err := ds.Get("key19"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted key: got %v", err)
+	}
+}
+
+func TestEncryptionWrongKeyMaterial(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewSegmentedDatastore(dir, 1<<20, WithEncryption(mustKeyRing(t, testKey1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Put("key", "value")
+	ds.Close()
+
+	// Same ID, different key.
+	other := "k1:" + strings.TrimPrefix(testKey2, "k2:")
+	if _, err := NewSegmentedDatastore(dir, 1<<20, WithEncryption(mustKeyRing(t, other))); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	// Start with a plaintext datastore, then enable encryption and rotate.
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ds.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("secret%d", i))
+	}
+	ds.Close()
+
+	for i, keys := range []string{testKey1, testKey1 + "," + testKey2} {
+		ds, err = NewSegmentedDatastore(dir, testMaxSegmentSize, WithEncryption(mustKeyRing(t, keys)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("key%d", 10*(i+1)+j)
+			ds.Put(key, fmt.Sprintf("secret%d", 10*(i+1)+j))
+		}
+		checkValues(t, ds, 10*(i+2))
+		if i == 0 {
+			ds.Close()
+		}
+	}
+	defer ds.Close()
+
+	if err := ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, ds, 30)
+	if data := segmentFiles(t, dir); !bytes.HasPrefix(data, segmentHeader{version: FormatVersion, keyID: "k2"}.encode()) || bytes.Contains(data, []byte("secret")) {
+		t.Error("merge did not rewrite the segments under the current key")
+	}
+	ds.Close()
+
+	// Older keys are not needed after the merge.
+	ds, err = NewSegmentedDatastore(dir, testMaxSegmentSize, WithEncryption(mustKeyRing(t, testKey2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, ds, 30)
+}
+
+func TestEncryptionStreamAndLog(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), 1<<20, WithEncryption(mustKeyRing(t, testKey1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	value := bytes.Repeat([]byte("secret"), 1000)
+	if err := ds.PutStream("blob", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	r, size, err := ds.GetReader("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if size != int64(len(value)) || !bytes.Equal(got, value) {
+		t.Errorf("GetReader returned %d bytes (size %d), wanted %d", len(got), size, len(value))
+	}
+
+	// The log carries plaintext records, so followers encrypt with their
+	// own keys.
+	data, _, err := ds.ReadLog(LogPosition{}, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := NewSegmentedDatastore(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if err := follower.ApplyLog(data); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := follower.Get("blob"); err != nil || got != string(value) {
+		t.Errorf("replicated value of %d bytes, %v", len(got), err)
+	}
+}
@@ -8,13 +8,29 @@ import (
 	"io"
 )
 
+// recordHeaderSize is the size of the record length plus the key and value
+// length prefixes.
+const recordHeaderSize = 12
+
+// The largest key and value the record format allows. Decoding checks stored
+// records only against these, so records written under higher configured
+// limits stay readable after the limits are lowered. WithMaxKeySize and
+// WithMaxValueSize cannot go above them.
+const (
+	MaxFormatKeySize   = 1 << 20
+	MaxFormatValueSize = 1 << 30
+	maxRecordSize      = MaxFormatKeySize + MaxFormatValueSize + recordHeaderSize
+)
+
+var ErrCorrupted = errors.New("corrupted record")
+
 type entry struct {
 	key, value string
 }
 
 func (e *entry) Encode() []byte {
 	kl, vl := len(e.key), len(e.value)
-	size := kl + vl + 12
+	size := kl + vl + recordHeaderSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
@@ -36,7 +52,28 @@ func decodeString(v []byte) string {
 	return string(buf)
 }
 
+// checkLayout verifies that the key and value lengths stored in a record fit
+// into the record itself, so Decode never reads out of bounds.
+func checkLayout(input []byte) error {
+	size := len(input)
+	kl := int(binary.LittleEndian.Uint32(input[4:]))
+	if kl > size-recordHeaderSize {
+		return fmt.Errorf("%w: key length %d in a record of %d bytes", ErrCorrupted, kl, size)
+	}
+	vl := int(binary.LittleEndian.Uint32(input[kl+8:]))
+	if kl+vl+recordHeaderSize != size {
+		return fmt.Errorf("%w: value length %d in a record of %d bytes", ErrCorrupted, vl, size)
+	}
+	return nil
+}
+
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	return e.decodeFromReader(in)
+}
+
+// decodeFromReader reads the next record and checks it against the format
+// limits.
+func (e *entry) decodeFromReader(in *bufio.Reader) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
@@ -44,11 +81,47 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 		}
 		return 0, fmt.Errorf("decodeFromReader, cannot read size: %w", err)
 	}
-	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	if size < recordHeaderSize || size > maxRecordSize {
+		return 0, fmt.Errorf("%w: record size %d", ErrCorrupted, size)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
-		return n, fmt.Errorf("decodeFromReader, cannot read record: %w", err)
+		return n, fmt.Errorf("%w: cannot read record: %v", ErrCorrupted, err)
+	}
+	if err := checkLayout(buf); err != nil {
+		return n, err
 	}
 	e.Decode(buf)
+	if len(e.key) > MaxFormatKeySize || len(e.value) > MaxFormatValueSize {
+		return n, fmt.Errorf("%w: key or value exceeds the format limits", ErrCorrupted)
+	}
 	return n, nil
 }
+
+// EncodeRecord encodes a key and value in the record format of the segment
+// files, so other framings can reuse it.
+func EncodeRecord(key, value string) []byte {
+	e := entry{key: key, value: value}
+	return e.Encode()
+}
+
+// ReadRecord reads one record written by EncodeRecord and checks it against
+// the key and value size limits, which makes it suitable for untrusted input.
+// It returns io.EOF if in is at its end.
+func ReadRecord(in *bufio.Reader, opts ...Option) (key, value string, err error) {
+	o := newOptions(opts)
+	size, err := in.Peek(4)
+	if err == nil && int64(binary.LittleEndian.Uint32(size)) > int64(o.maxKeySize+o.maxValueSize+recordHeaderSize) {
+		return "", "", fmt.Errorf("%w: record size %d", ErrCorrupted, binary.LittleEndian.Uint32(size))
+	}
+	var e entry
+	if _, err := e.decodeFromReader(in); err != nil {
+		return "", "", err
+	}
+	if err := o.checkSizes(e.key, len(e.value)); err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return e.key, e.value, nil
+}
@@ -3,6 +3,10 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -43,3 +47,49 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("decodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestDecodeFromReaderCorrupted(t *testing.T) {
+	valid := (&entry{"key", "value"}).Encode()
+
+	hugeSize := make([]byte, len(valid))
+	copy(hugeSize, valid)
+	binary.LittleEndian.PutUint32(hugeSize, 0xfffffff0)
+
+	badKeyLen := make([]byte, len(valid))
+	copy(badKeyLen, valid)
+	binary.LittleEndian.PutUint32(badKeyLen[4:], 1000)
+
+	cases := map[string][]byte{
+		"huge size":   hugeSize,
+		"tiny size":   {4, 0, 0, 0, 0, 0, 0, 0},
+		"bad key len": badKeyLen,
+		"truncated":   valid[:len(valid)-2],
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			var e entry
+			_, err := e.decodeFromReader(bufio.NewReader(bytes.NewReader(data)))
+			if !errors.Is(err, ErrCorrupted) {
+				t.Errorf("expected ErrCorrupted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(EncodeRecord("key", "value"))
+	buf.Write(EncodeRecord("long", strings.Repeat("x", 10)))
+	in := bufio.NewReader(&buf)
+
+	key, value, err := ReadRecord(in)
+	if err != nil || key != "key" || value != "value" {
+		t.Fatalf("got %q=%q, %v", key, value, err)
+	}
+	if _, _, err := ReadRecord(in, WithMaxValueSize(5)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("oversized value: got %v, want ErrCorrupted", err)
+	}
+	if _, _, err := ReadRecord(in); !errors.Is(err, io.EOF) {
+		t.Errorf("at the end: got %v, want io.EOF", err)
+	}
+}
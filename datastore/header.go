@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Segment files created by Open start with a header:
+//
+//	magic "\0\0\0\0KVSG" | version (1 byte) | key ID length (1 byte) | key ID
+//
+// The key ID is empty unless the values are encrypted. Files written before
+// the header existed start with a record instead; they are read as version 0
+// and rewritten in the current format by Merge. The magic picks the format
+// and the version byte the layout after it.
+const (
+	// segmentMagic starts with a zero record size. Every record is at least
+	// recordHeaderSize long, so the magic never starts a headerless file.
+	segmentMagic = "\x00\x00\x00\x00KVSG"
+	// zeroSize is the record size the magic starts with.
+	zeroSize = "\x00\x00\x00\x00"
+	// FormatVersion is the format of the segments created by Open.
+	FormatVersion = 1
+	// legacyVersion is the format of segments without a header.
+	legacyVersion = 0
+
+	// fixedHeaderSize is the magic, the version and the key ID length.
+	fixedHeaderSize = len(segmentMagic) + 2
+	maxKeyIDLength  = 255
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported segment format version")
+
+type segmentHeader struct {
+	version int
+	keyID   string
+}
+
+func (h segmentHeader) encode() []byte {
+	buf := make([]byte, 0, fixedHeaderSize+len(h.keyID))
+	buf = append(buf, segmentMagic...)
+	buf = append(buf, byte(h.version), byte(len(h.keyID)))
+	return append(buf, h.keyID...)
+}
+
+// readHeader reads the header at the start of in and returns it with its
+// size. Files that do not start with a zero record size are legacy segments.
+func readHeader(in *bufio.Reader) (segmentHeader, int64, error) {
+	magic, err := in.Peek(len(segmentMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return segmentHeader{}, 0, fmt.Errorf("cannot read segment header: %w", err)
+	}
+	if !strings.HasPrefix(string(magic), zeroSize) {
+		return segmentHeader{version: legacyVersion}, 0, nil
+	}
+	if string(magic) != segmentMagic {
+		return segmentHeader{}, 0, fmt.Errorf("%w: bad segment magic %q", ErrCorrupted, magic)
+	}
+	var fixed [fixedHeaderSize]byte
+	if _, err := io.ReadFull(in, fixed[:]); err != nil {
+		return segmentHeader{}, 0, fmt.Errorf("%w: cannot read segment header: %v", ErrCorrupted, err)
+	}
+	h := segmentHeader{version: int(fixed[len(segmentMagic)])}
+	if h.version != FormatVersion {
+		return segmentHeader{}, 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.version)
+	}
+	id := make([]byte, fixed[len(segmentMagic)+1])
+	if _, err := io.ReadFull(in, id); err != nil {
+		return segmentHeader{}, 0, fmt.Errorf("%w: cannot read segment key ID: %v", ErrCorrupted, err)
+	}
+	h.keyID = string(id)
+	return h, int64(fixedHeaderSize + len(id)), nil
+}
+
+// newSegmentHeader is the header of segments created with o: the current
+// format, with the key ID of the current encryption key, if any.
+func newSegmentHeader(o options) segmentHeader {
+	return segmentHeader{version: FormatVersion, keyID: o.keyID()}
+}
+
+// writeHeader starts an empty segment file with h. Files that already hold
+// records keep the header they were written with.
+func writeHeader(f *os.File, h segmentHeader) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() > 0 {
+		return err
+	}
+	if _, err := f.Write(h.encode()); err != nil {
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	return nil
+}
+
+// readHeader reads the segment header and sets up what it describes.
+func (db *Db) readHeader(in *bufio.Reader) error {
+	h, size, err := readHeader(in)
+	if err != nil {
+		return err
+	}
+	db.header = h
+	db.headerSize = size
+	return db.openCipher()
+}
+
+// current reports whether the segment has the header new segments would get,
+// so it is written in the current format and encrypted with the current key.
+func (db *Db) current() bool {
+	return db.header == newSegmentHeader(db.opts)
+}
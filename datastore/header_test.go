@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLegacySegment writes a headerless segment as it was stored before
+// segment headers existed.
+func writeLegacySegment(t *testing.T, dir, name string, records ...entry) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, record := range records {
+		data = append(data, record.Encode()...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name, outFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, outFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := segmentHeader{version: FormatVersion}.encode()
+	if !bytes.HasPrefix(data, header) {
+		t.Fatalf("segment starts with %q, want header %q", data[:min(len(data), 8)], header)
+	}
+
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("get after reopen: %q, %v", value, err)
+	}
+	db.Close()
+
+	// A newer format is refused rather than misread.
+	data[len(segmentMagic)] = FormatVersion + 1
+	if err := os.WriteFile(filepath.Join(dir, outFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("got %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestSegmentFormatDetection(t *testing.T) {
+	for name, tc := range map[string]struct {
+		data    []byte
+		version int
+		err     error
+	}{
+		"empty":  {nil, legacyVersion, nil},
+		"legacy": {(&entry{"KVSG", "value"}).Encode(), legacyVersion, nil},
+		"header": {segmentHeader{version: FormatVersion}.encode(), FormatVersion, nil},
+		// A zero size starts no record, so it is a damaged header.
+		"bad magic":      {[]byte("\x00\x00\x00\x00KVXX\x01\x00"), 0, ErrCorrupted},
+		"newer version":  {[]byte(segmentMagic + "\x02\x00"), 0, ErrUnsupportedVersion},
+		"torn header":    {[]byte(segmentMagic), 0, ErrCorrupted},
+		"short legacy":   {[]byte{0x20, 0x00}, legacyVersion, nil},
+		"zero size only": {[]byte(zeroSize), 0, ErrCorrupted},
+	} {
+		h, _, err := readHeader(bufio.NewReader(bytes.NewReader(tc.data)))
+		if !errors.Is(err, tc.err) || err == nil && h.version != tc.version {
+			t.Errorf("%s: got version %d, %v, want %d, %v", name, h.version, err, tc.version, tc.err)
+		}
+	}
+}
+
+func TestLegacySegmentUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacySegment(t, dir, "segment-0.db", entry{"a", "1"}, entry{"b", "2"})
+	writeLegacySegment(t, dir, "segment-1.db", entry{"a", "3"}, entry{"c", "4"}, entry{"b", ""})
+	if err := saveManifest(dir, &Manifest{Segments: []string{"segment-0.db", "segment-1.db"}, ActiveIndex: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := NewSegmentedDatastore(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	want := map[string]string{"a": "3", "c": "4"}
+	check := func(stage string) {
+		t.Helper()
+		for key, value := range want {
+			if got, err := ds.Get(key); err != nil || got != value {
+				t.Errorf("%s: %s = %q, %v, want %q", stage, key, got, err, value)
+			}
+		}
+		if _, err := ds.Get("b"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: deleted key: %v", stage, err)
+		}
+	}
+	check("legacy")
+
+	// Writes never go to a legacy segment.
+	if n := ds.SegmentCount(); n != 3 {
+		t.Fatalf("%d segments, want a new one after the legacy ones", n)
+	}
+	if err := ds.Put("d", "5"); err != nil {
+		t.Fatal(err)
+	}
+	want["d"] = "5"
+
+	if err := ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged")
+	if ds.segments[0].header.version != FormatVersion {
+		t.Errorf("merged segment has version %d", ds.segments[0].header.version)
+	}
+	if data := segmentFiles(t, dir); !bytes.HasPrefix(data, segmentHeader{version: FormatVersion}.encode()) {
+		t.Error("merged segment has no header")
+	}
+
+	// The log starts after the header.
+	log, _, err := ds.ReadLog(LogPosition{}, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(log); n != 3*(recordHeaderSize+2) {
+		t.Errorf("log of the merged segment is %d bytes: %q", n, log)
+	}
+}
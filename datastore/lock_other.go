@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// flock is a no-op on platforms without flock(2); the LOCK file is still
+// created so the directory layout stays the same.
+func flock(*os.File) error { return nil }
+
+func funlock(*os.File) error { return nil }
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+var ErrPositionGone = errors.New("log position refers to a segment that no longer exists")
+
+// LogPosition addresses a record boundary inside one of the segments of a
+// SegmentedDatastore. The zero value means the start of the oldest segment.
+type LogPosition struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func (p LogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.Segment, p.Offset)
+}
+
+// ReadLog returns the records written at or after pos, re-encoded one after
+// another in the segment record format, and the position that follows them.
+// It stops once roughly maxBytes have been collected. When the segment of pos
+// has been merged away, ReadLog returns ErrPositionGone and the reader has to
+// start over from a Snapshot. Encrypted values are returned decrypted.
+func (ds *SegmentedDatastore) ReadLog(pos LogPosition, maxBytes int) ([]byte, LogPosition, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	if len(ds.segments) == 0 {
+		return nil, pos, nil
+	}
+	idx := 0
+	if pos.Segment == "" {
+		pos = LogPosition{Segment: ds.segments[0].name()}
+	} else {
+		idx = ds.segmentIndex(pos.Segment)
+		if idx < 0 {
+			return nil, pos, fmt.Errorf("%w: %s", ErrPositionGone, pos)
+		}
+	}
+
+	var out bytes.Buffer
+	for out.Len() < maxBytes {
+		segment := ds.segments[idx]
+		pos.Offset = max(pos.Offset, segment.headerSize)
+		end := segment.committedSize()
+		if pos.Offset > end {
+			return nil, pos, fmt.Errorf("%w: %s is past the end of the segment", ErrPositionGone, pos)
+		}
+		if pos.Offset == end {
+			if idx == len(ds.segments)-1 {
+				break
+			}
+			idx++
+			pos = LogPosition{Segment: ds.segments[idx].name()}
+			continue
+		}
+		n, err := segment.copyRecords(&out, pos.Offset, end, maxBytes-out.Len())
+		if err != nil {
+			return nil, pos, err
+		}
+		pos.Offset += n
+	}
+	return out.Bytes(), pos, nil
+}
+
+// ApplyLog writes records produced by ReadLog, deletions included. Like
+// PutReplicated, it does not check them against the size limits.
+func (ds *SegmentedDatastore) ApplyLog(data []byte) error {
+	in := bufio.NewReader(bytes.NewReader(data))
+	for {
+		var record entry
+		n, err := record.decodeFromReader(in)
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ds.PutReplicated(record.key, record.value); err != nil {
+			return err
+		}
+	}
+}
+
+// Snapshot returns every live record, encoded as for ReadLog, together with
+// the log position the snapshot corresponds to, so a reader can continue with
+// ReadLog from there. Writes are not blocked while the records are read.
+func (ds *SegmentedDatastore) Snapshot() ([]byte, LogPosition, error) {
+	view := ds.View()
+	defer view.Close()
+	data, err := view.Snapshot()
+	if err != nil {
+		return nil, LogPosition{}, err
+	}
+	return data, view.Position(), nil
+}
+
+// ApplySnapshot makes the datastore hold exactly the records of a Snapshot:
+// they are written, without the size limits, and every other key is deleted.
+func (ds *SegmentedDatastore) ApplySnapshot(data []byte) error {
+	in := bufio.NewReader(bytes.NewReader(data))
+	keep := make(map[string]struct{})
+	for {
+		var record entry
+		n, err := record.decodeFromReader(in)
+		if errors.Is(err, io.EOF) && n == 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := ds.PutReplicated(record.key, record.value); err != nil {
+			return err
+		}
+		keep[record.key] = struct{}{}
+	}
+	for _, key := range ds.Keys() {
+		if _, ok := keep[key]; ok {
+			continue
+		}
+		if err := ds.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *SegmentedDatastore) segmentIndex(name string) int {
+	for i, segment := range ds.segments {
+		if segment.name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (db *Db) name() string {
+	return filepath.Base(db.dir)
+}
+
+// copyRecords re-encodes whole records stored in [from, to) into out until
+// at least limit bytes were written and returns how many file bytes it
+// consumed.
+func (db *Db) copyRecords(out *bytes.Buffer, from, to int64, limit int) (int64, error) {
+	in := bufio.NewReader(io.NewSectionReader(db.file, from, to-from))
+	var consumed int64
+	written := 0
+	for written < limit && from+consumed < to {
+		var record entry
+		n, err := db.decodeRecord(in, &record)
+		if err != nil {
+			return consumed, fmt.Errorf("failed to read %s at %d: %w", db.filename, from+consumed, err)
+		}
+		data := record.Encode()
+		out.Write(data)
+		written += len(data)
+		consumed += int64(n)
+	}
+	return consumed, nil
+}
@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadLogApplyLog(t *testing.T) {
+	leader, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create leader datastore: %v", err)
+	}
+	defer leader.Close()
+	follower, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create follower datastore: %v", err)
+	}
+	defer follower.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+
+	var pos LogPosition
+	for {
+		data, next, err := leader.ReadLog(pos, 64)
+		if err != nil {
+			t.Fatalf("ReadLog(%s): %v", pos, err)
+		}
+		if err := follower.ApplyLog(data); err != nil {
+			t.Fatalf("ApplyLog: %v", err)
+		}
+		if next == pos {
+			break
+		}
+		pos = next
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		value, err := follower.Get(key)
+		if i == 3 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("deleted %s was replicated as %q (err %v)", key, value, err)
+			}
+			continue
+		}
+		if expected := fmt.Sprintf("value%d", i); value != expected {
+			t.Errorf("%s: were waited %s, got %s (err %v)", key, expected, value, err)
+		}
+	}
+
+	if err := leader.Merge(); err != nil {
+		t.Fatalf("merge didn't happen: %v", err)
+	}
+	if _, _, err := leader.ReadLog(pos, 64); !errors.Is(err, ErrPositionGone) {
+		t.Errorf("expected ErrPositionGone after merge, got %v", err)
+	}
+
+	if err := follower.Put("stale", "value"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, snapPos, err := leader.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplySnapshot(snapshot); err != nil {
+		t.Fatalf("ApplySnapshot: %v", err)
+	}
+	if keys := follower.Keys(); len(keys) != 19 {
+		t.Errorf("follower has %d keys after the snapshot, wanted 19", len(keys))
+	}
+	if _, err := follower.Get("stale"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("key missing from the snapshot survived: %v", err)
+	}
+
+	if err := leader.Put("after", "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := leader.ReadLog(snapPos, 1024)
+	if err != nil {
+		t.Fatalf("ReadLog from snapshot position: %v", err)
+	}
+	if err := follower.ApplyLog(data); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := follower.Get("after"); err != nil || value != "snapshot" {
+		t.Errorf("record after the snapshot was not shipped: %q, %v", value, err)
+	}
+}
+
+func TestDeleteHidesOlderSegments(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	defer ds.Close()
+
+	if err := ds.Put("key", "old"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ds.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.segments) < 2 {
+		t.Fatalf("expected the delete to land in a newer segment, got %d segments", len(ds.segments))
+	}
+	if value, err := ds.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted key still readable from an older segment: %q, %v", value, err)
+	}
+
+	if err := ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ds.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted key came back after merge: %q, %v", value, err)
+	}
+	for _, key := range ds.Keys() {
+		if key == "key" {
+			t.Error("Keys() returned a deleted key")
+		}
+	}
+}
+
+func TestViewSurvivesWritesAndMerge(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ds.Put(fmt.Sprintf("key%d", i), "before"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	view := ds.View()
+	if err := ds.Put("key0", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Put("late", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ := filepath.Glob(filepath.Join(ds.dir, "segment-*")); len(dirs) != 1 {
+		t.Errorf("merged segments left on disk: %v", dirs)
+	}
+
+	data, err := view.Snapshot()
+	view.Close()
+	if err != nil {
+		t.Fatalf("snapshot of the view after merge: %v", err)
+	}
+	restored, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.ApplySnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := restored.Get("key0"); value != "before" {
+		t.Errorf("view saw a later write: key0 = %q", value)
+	}
+	if _, err := restored.Get("late"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("view saw a key written after it was taken: %v", err)
+	}
+	if keys := restored.Keys(); len(keys) != 10 {
+		t.Errorf("view has %d keys, wanted 10", len(keys))
+	}
+}
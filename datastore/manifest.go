@@ -7,13 +7,15 @@ import (
 	"path/filepath"
 )
 
+const manifestFileName = "manifest.json"
+
 type Manifest struct {
 	Segments    []string `json:"segments"`
 	ActiveIndex int      `json:"active_index"`
 }
 
 func loadManifest(dir string) (*Manifest, error) {
-	path := filepath.Join(dir, "manifest.json")
+	path := filepath.Join(dir, manifestFileName)
 	f, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -31,7 +33,7 @@ func loadManifest(dir string) (*Manifest, error) {
 }
 
 func saveManifest(dir string, manifest *Manifest) error {
-	path := filepath.Join(dir, "manifest.json")
+	path := filepath.Join(dir, manifestFileName)
 	f, err := os.Create(path)
 	if err != nil {
 		return err
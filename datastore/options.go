@@ -0,0 +1,70 @@
+package datastore
+
+import "errors"
+
+const (
+	DefaultMaxKeySize   = 4 << 10
+	DefaultMaxValueSize = 64 << 20
+)
+
+var (
+	ErrKeyTooLarge   = errors.New("key exceeds the maximum size")
+	ErrValueTooLarge = errors.New("value exceeds the maximum size")
+)
+
+type options struct {
+	maxKeySize     int
+	maxValueSize   int
+	changeFeedSize int
+	keys           *KeyRing
+}
+
+// Option configures a Db or a SegmentedDatastore.
+type Option func(*options)
+
+// WithMaxKeySize limits the size of keys accepted by Put, up to
+// MaxFormatKeySize. Records already stored are read whatever their size.
+func WithMaxKeySize(n int) Option {
+	return func(o *options) {
+		o.maxKeySize = min(n, MaxFormatKeySize)
+	}
+}
+
+// WithMaxValueSize limits the size of values accepted by Put, up to
+// MaxFormatValueSize less the room encryption needs. Records already stored
+// are read whatever their size.
+func WithMaxValueSize(n int) Option {
+	return func(o *options) {
+		o.maxValueSize = min(n, MaxFormatValueSize-sealOverhead)
+	}
+}
+
+// WithChangeFeedSize sets how many recent changes a SegmentedDatastore keeps
+// for watchers.
+func WithChangeFeedSize(n int) Option {
+	return func(o *options) {
+		o.changeFeedSize = n
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		maxKeySize:     DefaultMaxKeySize,
+		maxValueSize:   DefaultMaxValueSize,
+		changeFeedSize: DefaultChangeFeedSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o options) checkSizes(key string, valueSize int) error {
+	if len(key) > o.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if valueSize > o.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
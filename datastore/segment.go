@@ -5,42 +5,75 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type SegmentedDatastore struct {
-	dir            string
+	dir string
+
+	// mu is held for reading by Get and Put, and for writing while the
+	// segment list changes during rotation and Merge.
+	mu             sync.RWMutex
 	segments       []*Db
 	maxSegmentSize int64
+	nextSegment    int
+	lock           *dirLock
+	readOnly       bool
+	opts           []Option
+	feed           *changeFeed
 }
 
-func NewSegmentedDatastore(dir string, maxSegmentSize int64) (*SegmentedDatastore, error) {
+// NewSegmentedDatastore opens the datastore in dir for writing. The directory
+// is locked until Close, so a second process gets ErrLocked instead of
+// appending to the same segments.
+func NewSegmentedDatastore(dir string, maxSegmentSize int64, opts ...Option) (*SegmentedDatastore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create catalogue %s: %w", dir, err)
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	ds := &SegmentedDatastore{
 		dir:            dir,
 		maxSegmentSize: maxSegmentSize,
+		lock:           lock,
+		opts:           opts,
+	}
+	if ds.feed, err = openChangeFeed(dir, newOptions(opts).changeFeedSize); err != nil {
+		ds.Close()
+		return nil, err
 	}
 
 	manifest, err := loadManifest(ds.dir)
 	if err != nil {
+		ds.Close()
 		return nil, err
 	}
 
 	for _, segFile := range manifest.Segments {
 		path := filepath.Join(dir, segFile)
 		fmt.Printf("opening segment: %q\n", path)
-		db, err := Open(path)
+		db, err := Open(path, ds.opts...)
 		if err != nil {
+			ds.Close()
 			return nil, fmt.Errorf("failed to open segment %q: %w", path, err)
 		}
 		ds.segments = append(ds.segments, db)
+		ds.observeSegmentName(segFile)
 	}
 
-	if len(ds.segments) == 0 {
-		if err := ds.createNewSegment(); err != nil {
-			return nil, err
+	// New records go to a segment in the current format and encryption;
+	// older segments stay readable until Merge rewrites them.
+	if n := len(ds.segments); n == 0 || !ds.segments[n-1].current() {
+		if n > 0 {
+			ds.segments[n-1].closeWrites()
 		}
-		manifest.Segments = []string{fmt.Sprintf("segment-%d.db", len(ds.segments)-1)}
-		manifest.ActiveIndex = 0
-		if err := saveManifest(ds.dir, manifest); err != nil {
+		if err := ds.createNewSegment(); err != nil {
+			ds.Close()
 			return nil, err
 		}
 	}
@@ -48,15 +81,63 @@ func NewSegmentedDatastore(dir string, maxSegmentSize int64) (*SegmentedDatastor
 	return ds, nil
 }
 
+// OpenSegmentedReadOnly opens an existing datastore for reading only. It does
+// not take the directory lock and never creates, appends to or rewrites files,
+// so it is safe to use on a directory owned by a running writer. The view is a
+// snapshot of the segments present at open time; it reads them through the
+// files it opened, so it keeps working after the writer merged them away.
+// Put, Delete and Merge return ErrReadOnly.
+func OpenSegmentedReadOnly(dir string, opts ...Option) (*SegmentedDatastore, error) {
+	if _, err := os.Stat(filepath.Join(dir, manifestFileName)); err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &SegmentedDatastore{
+		dir:      dir,
+		readOnly: true,
+		opts:     opts,
+		feed:     newChangeFeed(newOptions(opts).changeFeedSize),
+	}
+	for _, segFile := range manifest.Segments {
+		path := filepath.Join(dir, segFile)
+		db, err := OpenReadOnly(path, ds.opts...)
+		if err != nil {
+			ds.Close()
+			return nil, fmt.Errorf("failed to open segment %q: %w", path, err)
+		}
+		ds.segments = append(ds.segments, db)
+	}
+	return ds, nil
+}
+
+// observeSegmentName makes sure new segments never reuse the number of an
+// existing one.
+func (ds *SegmentedDatastore) observeSegmentName(name string) {
+	num := strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), ".db")
+	if n, err := strconv.Atoi(num); err == nil && n >= ds.nextSegment {
+		ds.nextSegment = n + 1
+	}
+}
+
+func (ds *SegmentedDatastore) newSegmentName() string {
+	name := fmt.Sprintf("segment-%d.db", ds.nextSegment)
+	ds.nextSegment++
+	return name
+}
+
 func (ds *SegmentedDatastore) createNewSegment() error {
-	segmentName := fmt.Sprintf("segment-%d.db", len(ds.segments))
+	segmentName := ds.newSegmentName()
 	path := filepath.Join(ds.dir, segmentName)
 
 	if err := os.MkdirAll(ds.dir, 0755); err != nil {
 		return fmt.Errorf("failed to create catalogue %s: %w", ds.dir, err)
 	}
 
-	db, err := Open(path)
+	db, err := Open(path, ds.opts...)
 	if err != nil {
 		return fmt.Errorf("failed to open segment %s: %w", path, err)
 	}
@@ -75,36 +156,31 @@ func (ds *SegmentedDatastore) createNewSegment() error {
 }
 
 func (ds *SegmentedDatastore) Merge() error {
-	latest := make(map[string]string)
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
-	for _, segment := range ds.segments {
-		entries, err := segment.ReadAll()
-		if err != nil {
-			return fmt.Errorf("failed to read segment %s: %w", segment.filename, err)
-		}
-		for _, e := range entries {
-			if e.Value == "" {
-				delete(latest, e.Key)
-			} else {
-				latest[e.Key] = e.Value
-			}
-		}
+	latest, err := ds.latestValues()
+	if err != nil {
+		return err
 	}
 
-	tmpSegmentName := fmt.Sprintf("tmp-segment-%d.tmp", len(ds.segments))
+	tmpSegmentName := fmt.Sprintf("tmp-segment-%d.tmp", ds.nextSegment)
 	tmpPath := filepath.Join(ds.dir, tmpSegmentName)
 
 	if err := os.MkdirAll(ds.dir, 0755); err != nil {
 		return fmt.Errorf("failed to create catalogue %s: %w", ds.dir, err)
 	}
 
-	tmpDb, err := Open(tmpPath)
+	tmpDb, err := Open(tmpPath, ds.opts...)
 	if err != nil {
 		return fmt.Errorf("failed to open temp segment %s: %w", tmpPath, err)
 	}
 
 	for key, value := range latest {
-		if err := tmpDb.Put(key, value); err != nil {
+		if err := tmpDb.put(key, value); err != nil {
 			tmpDb.Close()
 			os.RemoveAll(tmpPath)
 			return err
@@ -115,19 +191,21 @@ func (ds *SegmentedDatastore) Merge() error {
 		return fmt.Errorf("failed to close tmpDb before renaiming: %w", err)
 	}
 
+	// Views and readers still hold the files of the old segments open, so
+	// they keep reading them after the directories are gone.
 	for _, seg := range ds.segments {
 		seg.Close()
-		os.Remove(seg.filename)
+		os.RemoveAll(seg.dir)
 	}
 
-	finalSegmentName := fmt.Sprintf("segment-%d.db", len(ds.segments))
+	finalSegmentName := ds.newSegmentName()
 	finalPath := filepath.Join(ds.dir, finalSegmentName)
 
 	if err := os.Rename(tmpPath, finalPath); err != nil {
 		return fmt.Errorf("failed to rename %s into %s: %w", tmpPath, finalPath, err)
 	}
 
-	newDb, err := Open(finalPath)
+	newDb, err := Open(finalPath, ds.opts...)
 	if err != nil {
 		return err
 	}
@@ -142,69 +220,229 @@ func (ds *SegmentedDatastore) Merge() error {
 	return saveManifest(ds.dir, manifest)
 }
 
-func (ds *SegmentedDatastore) Put(key, value string) error {
-	if len(ds.segments) == 0 {
-		if err := ds.createNewSegment(); err != nil {
-			return err
+// latestValues replays all segments and returns the live value of every key.
+// The caller must hold ds.mu.
+func (ds *SegmentedDatastore) latestValues() (map[string]string, error) {
+	latest := make(map[string]string)
+	for _, segment := range ds.segments {
+		err := segment.readRecords(func(record entry) {
+			if record.value == "" {
+				delete(latest, record.key)
+			} else {
+				latest[record.key] = record.value
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", segment.filename, err)
 		}
 	}
+	return latest, nil
+}
 
-	active := ds.segments[len(ds.segments)-1]
+func (ds *SegmentedDatastore) Put(key, value string) error {
+	return ds.put(key, value, true)
+}
 
-	size, err := active.Size()
+// PutReplicated stores a record that another node already accepted, such as
+// a replicated or committed write. The size limits of this node do not
+// apply, so a follower configured with lower limits never drops it.
+func (ds *SegmentedDatastore) PutReplicated(key, value string) error {
+	return ds.put(key, value, false)
+}
+
+func (ds *SegmentedDatastore) put(key, value string, checked bool) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	if err := ds.feed.reserve(); err != nil {
+		return err
+	}
+	err := ds.write(func(active *Db) error {
+		if checked {
+			return active.Put(key, value)
+		}
+		return active.put(key, value)
+	})
 	if err != nil {
-		if err := active.Close(); err != nil {
+		return err
+	}
+	if value == "" {
+		ds.feed.add(OpDelete, key)
+	} else {
+		ds.feed.add(OpPut, key)
+	}
+	return nil
+}
+
+// write runs fn against the active segment. It holds ds.mu for reading while
+// fn runs, so rotation and Merge wait for writes in flight.
+func (ds *SegmentedDatastore) write(fn func(active *Db) error) error {
+	for {
+		ds.mu.RLock()
+		if active := ds.writableSegment(); active != nil {
+			err := fn(active)
+			ds.mu.RUnlock()
 			return err
 		}
-		if err := ds.createNewSegment(); err != nil {
+		ds.mu.RUnlock()
+
+		ds.mu.Lock()
+		err := ds.rotate()
+		ds.mu.Unlock()
+		if err != nil {
 			return err
 		}
-		active = ds.segments[len(ds.segments)-1]
 	}
+}
 
-	if size >= ds.maxSegmentSize {
-		if err := active.Close(); err != nil {
-			return err
-		}
-		if err := ds.createNewSegment(); err != nil {
+// writableSegment returns the active segment if it can take more records.
+func (ds *SegmentedDatastore) writableSegment() *Db {
+	if len(ds.segments) == 0 {
+		return nil
+	}
+	active := ds.segments[len(ds.segments)-1]
+	size, err := active.Size()
+	if err != nil || size >= ds.maxSegmentSize {
+		return nil
+	}
+	return active
+}
+
+// rotate closes the active segment once it has reached maxSegmentSize and
+// starts a fresh one. The caller must hold ds.mu for writing.
+func (ds *SegmentedDatastore) rotate() error {
+	if ds.writableSegment() != nil {
+		return nil
+	}
+	if len(ds.segments) > 0 {
+		if err := ds.segments[len(ds.segments)-1].closeWrites(); err != nil {
 			return err
 		}
-		active = ds.segments[len(ds.segments)-1]
 	}
-
-	return active.Put(key, value)
+	return ds.createNewSegment()
 }
 
 func (ds *SegmentedDatastore) Get(key string) (string, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
 	for i := len(ds.segments) - 1; i >= 0; i-- {
 		value, err := ds.segments[i].Get(key)
 		if err == nil {
 			return value, nil
 		}
+		if errors.Is(err, errDeleted) {
+			break
+		}
 		if !errors.Is(err, ErrNotFound) {
 			return "", err
 		}
 	}
-	return "", fmt.Errorf("key not found: %s", key)
+	return "", keyNotFoundError{key: key}
+}
+
+// keyNotFoundError keeps the "key not found: <key>" message while still
+// matching ErrNotFound with errors.Is.
+type keyNotFoundError struct {
+	key string
+}
+
+func (e keyNotFoundError) Error() string {
+	return "key not found: " + e.key
+}
+
+func (e keyNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// PutBytes stores an arbitrary binary value under a binary key. As with Put,
+// an empty value deletes the key.
+func (ds *SegmentedDatastore) PutBytes(key, value []byte) error {
+	return ds.Put(string(key), string(value))
+}
+
+func (ds *SegmentedDatastore) GetBytes(key []byte) ([]byte, error) {
+	value, err := ds.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
 }
 
 func (ds *SegmentedDatastore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var firstErr error
 	for _, segment := range ds.segments {
-		if err := segment.Close(); err != nil {
-			return err
+		if err := segment.Close(); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-	return nil
+	if err := ds.lock.release(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	ds.lock = nil
+	return firstErr
 }
 
 func (ds *SegmentedDatastore) Delete(key string) error {
-	activeSegment := ds.segments[len(ds.segments)-1]
-
-	if err := activeSegment.Put(key, ""); err != nil {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	if err := ds.feed.reserve(); err != nil {
+		return err
+	}
+	err := ds.write(func(active *Db) error {
+		return active.Put(key, "")
+	})
+	if err != nil {
 		return fmt.Errorf("failed to write delete token for key %s: %w", key, err)
 	}
+	ds.feed.add(OpDelete, key)
+	return nil
+}
 
-	delete(activeSegment.index, key)
+// Keys returns all live keys in no particular order.
+func (ds *SegmentedDatastore) Keys() []string {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	live := make(map[string]bool)
+	for _, segment := range ds.segments {
+		segment.mu.RLock()
+		for key, position := range segment.index {
+			live[key] = position != tombstone
+		}
+		segment.mu.RUnlock()
+	}
+	keys := make([]string, 0, len(live))
+	for key, ok := range live {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
 
-	return nil
+// Stats describes the on-disk state of a datastore.
+type Stats struct {
+	Keys     int   `json:"keys"`
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+}
+
+func (ds *SegmentedDatastore) Stats() Stats {
+	keys := len(ds.Keys())
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	stats := Stats{Keys: keys, Segments: len(ds.segments)}
+	for _, segment := range ds.segments {
+		stats.Size += segment.committedSize()
+	}
+	return stats
+}
+
+// SegmentCount returns the number of segments, which Merge reduces to one.
+func (ds *SegmentedDatastore) SegmentCount() int {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return len(ds.segments)
 }
@@ -1,8 +1,12 @@
 package datastore
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -61,7 +65,7 @@ func TestMergeSegments(t *testing.T) {
 	if err := ds.Put(key, "old"); err != nil {
 		t.Fatalf("failed to write old value: %v", err)
 	}
-	ds.segments[len(ds.segments)-1].Close()
+	ds.segments[len(ds.segments)-1].closeWrites()
 
 	if err := ds.createNewSegment(); err != nil {
 		t.Fatalf("failed to create new segment: %v", err)
@@ -70,7 +74,7 @@ func TestMergeSegments(t *testing.T) {
 	if err := ds.Put(key, "new"); err != nil {
 		t.Fatalf("failed to write a new value: %v", err)
 	}
-	ds.segments[len(ds.segments)-1].Close()
+	ds.segments[len(ds.segments)-1].closeWrites()
 
 	for i, seg := range ds.segments {
 		_, err := seg.ReadAll()
@@ -96,6 +100,39 @@ func TestMergeSegments(t *testing.T) {
 	}
 }
 
+func TestMergeUnderLoweredLimits(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 64)
+	if err := ds.Put("big", value); err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+
+	ds, err = NewSegmentedDatastore(dir, testMaxSegmentSize, WithMaxValueSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if err := ds.Put("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ds.Merge(); err != nil {
+			t.Fatalf("merge %d: %v", i+1, err)
+		}
+	}
+	if len(ds.segments) != 1 {
+		t.Errorf("%d segments after merge, want 1", len(ds.segments))
+	}
+	if got, err := ds.Get("big"); err != nil || got != value {
+		t.Errorf("record written under the old limits: %q, %v", got, err)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	dir := t.TempDir()
 
@@ -126,3 +163,119 @@ func TestDelete(t *testing.T) {
 		t.Fatalf("expected error '%s', received: '%v'", expectedErr, err)
 	}
 }
+
+func TestSegmentedDatastoreLocked(t *testing.T) {
+	dir := t.TempDir()
+
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+
+	if _, err := NewSegmentedDatastore(dir, testMaxSegmentSize); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked for a second datastore on %s, got %v", dir, err)
+	}
+
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ds, err = NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to reopen datastore after Close: %v", err)
+	}
+	_ = ds.Close()
+}
+
+func TestOpenSegmentedReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ds.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("failed to write value: %v", err)
+		}
+	}
+
+	ro, err := OpenSegmentedReadOnly(dir)
+	if err != nil {
+		t.Fatalf("failed to open read-only datastore: %v", err)
+	}
+	defer ro.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := ro.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Errorf("Get(key%d): %v", i, err)
+		}
+		if expected := fmt.Sprintf("value%d", i); value != expected {
+			t.Errorf("key%d: were waited %s, got %s", i, expected, value)
+		}
+	}
+
+	if err := ro.Put("key", "value"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Delete("key1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Merge(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Merge: expected ErrReadOnly, got %v", err)
+	}
+
+	// The writer merging removes the segment files the view was opened on.
+	if err := ds.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ro.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Get after the writer merged: %q, %v", value, err)
+	}
+	r, _, err := ro.GetReader("key4")
+	if err != nil {
+		t.Fatalf("GetReader after the writer merged: %v", err)
+	}
+	if value, err := io.ReadAll(r); err != nil || string(value) != "value4" {
+		t.Errorf("GetReader after the writer merged: %q, %v", value, err)
+	}
+	r.Close()
+
+	missing := filepath.Join(dir, "missing")
+	if _, err := OpenSegmentedReadOnly(missing); err == nil {
+		t.Error("expected an error for a directory without a manifest")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("read-only open must not create %s", missing)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ds, err := NewSegmentedDatastore(t.TempDir(), testMaxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ds.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ds.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := ds.Stats()
+	if stats.Keys != 9 {
+		t.Errorf("keys: got %d, want 9", stats.Keys)
+	}
+	if stats.Segments != len(ds.segments) || stats.Segments < 2 {
+		t.Errorf("segments: got %d", stats.Segments)
+	}
+	if stats.Size == 0 {
+		t.Error("size is zero")
+	}
+}
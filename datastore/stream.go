@@ -0,0 +1,223 @@
+package datastore
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type valueReader struct {
+	*io.SectionReader
+	file *segmentFile
+	once sync.Once
+}
+
+func (r *valueReader) Close() error {
+	var err error
+	r.once.Do(func() { err = r.file.release() })
+	return err
+}
+
+// GetReader returns a reader over the value bytes stored in the segment file
+// together with the value size, so large values never have to be held in
+// memory. The caller must close the reader. Encrypted values are sealed as a
+// whole, so they are read and decrypted in memory first, see WithEncryption.
+func (db *Db) GetReader(key string) (io.ReadCloser, int64, error) {
+	if db.aead != nil {
+		value, err := db.Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(strings.NewReader(value)), int64(len(value)), nil
+	}
+	position, err := db.position(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	file := db.file
+
+	var header [8]byte
+	if _, err := file.ReadAt(header[:], position); err != nil {
+		return nil, 0, fmt.Errorf("%w: cannot read record header: %v", ErrCorrupted, err)
+	}
+	size := int64(binary.LittleEndian.Uint32(header[:4]))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if kl > size-recordHeaderSize {
+		return nil, 0, fmt.Errorf("%w: key length %d in a record of %d bytes", ErrCorrupted, kl, size)
+	}
+
+	var vlBuf [4]byte
+	if _, err := file.ReadAt(vlBuf[:], position+8+kl); err != nil {
+		return nil, 0, fmt.Errorf("%w: cannot read value length: %v", ErrCorrupted, err)
+	}
+	vl := int64(binary.LittleEndian.Uint32(vlBuf[:]))
+	if kl+vl+recordHeaderSize != size {
+		return nil, 0, fmt.Errorf("%w: value length %d in a record of %d bytes", ErrCorrupted, vl, size)
+	}
+
+	valueStart := position + recordHeaderSize + kl
+	file.acquire()
+	return &valueReader{
+		SectionReader: io.NewSectionReader(file, valueStart, vl),
+		file:          file,
+	}, vl, nil
+}
+
+// PutStream stores exactly size bytes read from r as the value of key. The
+// body is first copied to a temporary file next to the segment, so a slow
+// reader never holds up other writers; the record is then copied from that
+// file. Values of encrypted segments are read into memory to be encrypted,
+// see WithEncryption.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.opts.checkSizes(key, int(min(size, int64(db.opts.maxValueSize)+1))); err != nil || size < 0 {
+		return cmp.Or(err, ErrValueTooLarge)
+	}
+	staged, err := stageBody(db.dir, r, size)
+	if err != nil {
+		return err
+	}
+	defer staged.remove()
+	return db.putStaged(key, staged, size)
+}
+
+// putStaged writes a record whose value is the staged body.
+func (db *Db) putStaged(key string, staged *stagedBody, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.opts.checkSizes(key, int(size)); err != nil {
+		return err
+	}
+	if db.aead != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(staged, value); err != nil {
+			return err
+		}
+		return db.Put(key, string(value))
+	}
+	req := writeRequest{
+		e:    entry{key: key},
+		done: make(chan error, 1),
+		body: staged,
+		size: size,
+	}
+	db.writeCh <- req
+	return <-req.done
+}
+
+// stagedBody is a request body copied to a temporary file.
+type stagedBody struct {
+	*os.File
+}
+
+// stageBody copies exactly size bytes from r to a temporary file in dir and
+// rewinds it. A short body fails with io.EOF or io.ErrUnexpectedEOF.
+func stageBody(dir string, r io.Reader, size int64) (*stagedBody, error) {
+	f, err := os.CreateTemp(dir, "stream-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage value: %w", err)
+	}
+	staged := &stagedBody{File: f}
+	copied, err := io.CopyN(f, r, size)
+	if err == io.EOF && copied > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		staged.remove()
+		return nil, err
+	}
+	return staged, nil
+}
+
+func (s *stagedBody) remove() {
+	s.Close()
+	os.Remove(s.Name())
+}
+
+// writeStream appends a record whose value is copied from body. If the copy
+// fails, the partial record is truncated away so the file stays decodable.
+func (db *Db) writeStream(key string, body io.Reader, size int64) (int64, error) {
+	kl := len(key)
+	header := make([]byte, kl+recordHeaderSize)
+	binary.LittleEndian.PutUint32(header, uint32(int64(kl)+size+recordHeaderSize))
+	binary.LittleEndian.PutUint32(header[4:], uint32(kl))
+	copy(header[8:], key)
+	binary.LittleEndian.PutUint32(header[kl+8:], uint32(size))
+
+	n, err := db.out.Write(header)
+	if err == nil {
+		var copied int64
+		copied, err = io.CopyN(db.out, body, size)
+		n += int(copied)
+	}
+	if err != nil {
+		if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+			return 0, fmt.Errorf("%w (truncate failed: %v)", err, truncErr)
+		}
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// GetReader returns a reader over the latest value of key, see Db.GetReader.
+func (ds *SegmentedDatastore) GetReader(key string) (io.ReadCloser, int64, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	for i := len(ds.segments) - 1; i >= 0; i-- {
+		r, size, err := ds.segments[i].GetReader(key)
+		if err == nil {
+			return r, size, nil
+		}
+		if errors.Is(err, errDeleted) {
+			break
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, keyNotFoundError{key: key}
+}
+
+// PutStream writes size bytes from r as the value of key into the active
+// segment, see Db.PutStream. The body is staged before the segment list is
+// locked, so a slow reader does not hold up rotation and Merge either.
+func (ds *SegmentedDatastore) PutStream(key string, r io.Reader, size int64) error {
+	if ds.readOnly {
+		return ErrReadOnly
+	}
+	o := newOptions(ds.opts)
+	if err := o.checkSizes(key, int(min(size, int64(o.maxValueSize)+1))); err != nil || size < 0 {
+		return cmp.Or(err, ErrValueTooLarge)
+	}
+	staged, err := stageBody(ds.dir, r, size)
+	if err != nil {
+		return err
+	}
+	defer staged.remove()
+	if err := ds.feed.reserve(); err != nil {
+		return err
+	}
+	err = ds.write(func(active *Db) error {
+		return active.putStaged(key, staged, size)
+	})
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		ds.feed.add(OpDelete, key)
+	} else {
+		ds.feed.add(OpPut, key)
+	}
+	return nil
+}
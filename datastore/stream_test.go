@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutStreamGetReader(t *testing.T) {
+	dir := t.TempDir()
+
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	defer ds.Close()
+
+	value := bytes.Repeat([]byte{0x00, 0x7f, 0xff}, 100000)
+	if err := ds.PutStream("blob", bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+	if err := ds.Put("after", "value"); err != nil {
+		t.Fatalf("Put after PutStream: %v", err)
+	}
+
+	r, size, err := ds.GetReader("blob")
+	if err != nil {
+		t.Fatalf("GetReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(value)) || !bytes.Equal(got, value) {
+		t.Errorf("GetReader returned %d bytes (size %d), wanted %d", len(got), size, len(value))
+	}
+
+	full, err := ds.Get("blob")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if full != string(value) {
+		t.Error("Get returned a different value than was streamed")
+	}
+
+	if _, _, err := ds.GetReader("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPutStreamShortBody(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutStream("k2", strings.NewReader("short"), 100); err == nil {
+		t.Fatal("expected an error for a body shorter than the declared size")
+	}
+	sizeAfter, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizeAfter != sizeBefore {
+		t.Errorf("partial record was left in the file: size %d, wanted %d", sizeAfter, sizeBefore)
+	}
+
+	if err := db.Put("k3", "v3"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := db.ReadAll()
+	if err != nil {
+		t.Fatalf("file is not decodable after a failed stream: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 records, got %d", len(entries))
+	}
+	if _, err := db.Get("k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for the failed key, got %v", err)
+	}
+}
+
+func TestPutStreamSlowBodyDoesNotBlockWriters(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewSegmentedDatastore(dir, testMaxSegmentSize)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %v", err)
+	}
+	defer ds.Close()
+
+	body, writer := io.Pipe()
+	streamed := make(chan error, 1)
+	go func() {
+		streamed <- ds.PutStream("slow", body, 10)
+	}()
+	if _, err := writer.Write([]byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	put := make(chan error, 1)
+	go func() {
+		put <- ds.Put("fast", "value")
+	}()
+	select {
+	case err := <-put:
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Put waited for a stalled stream body")
+	}
+
+	writer.Write([]byte("67890"))
+	writer.Close()
+	if err := <-streamed; err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+	if value, err := ds.Get("slow"); err != nil || value != "1234567890" {
+		t.Errorf("Get(slow) = %q, %v", value, err)
+	}
+	staged, _ := filepath.Glob(filepath.Join(dir, "stream-*.tmp"))
+	if len(staged) != 0 {
+		t.Errorf("staged bodies left behind: %v", staged)
+	}
+}
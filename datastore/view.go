@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// View is a read-only picture of a SegmentedDatastore as of the moment it was
+// taken. Taking it holds the datastore lock only briefly and reading it does
+// not block writers, so large snapshots can be encoded while Put goes on.
+// The View holds the segment files open, so Merge does not disturb it.
+type View struct {
+	ds       *SegmentedDatastore
+	segments []*Db
+	// end is the committed size of the last segment when the View was taken;
+	// records appended after it are not part of the View.
+	end    int64
+	closed bool
+}
+
+// View pins the current segments. The caller must Close the View.
+func (ds *SegmentedDatastore) View() *View {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	v := &View{ds: ds, segments: append([]*Db(nil), ds.segments...)}
+	for _, segment := range v.segments {
+		segment.file.acquire()
+	}
+	if len(v.segments) > 0 {
+		v.end = v.segments[len(v.segments)-1].committedSize()
+	}
+	return v
+}
+
+// Position is the log position the View corresponds to.
+func (v *View) Position() LogPosition {
+	if len(v.segments) == 0 {
+		return LogPosition{}
+	}
+	return LogPosition{Segment: v.segments[len(v.segments)-1].name(), Offset: v.end}
+}
+
+// Snapshot encodes every live record of the View in the ReadLog format.
+func (v *View) Snapshot() ([]byte, error) {
+	latest := make(map[string]string)
+	for i, segment := range v.segments {
+		end := int64(-1)
+		if i == len(v.segments)-1 {
+			end = v.end
+		}
+		err := segment.readRecordsUntil(end, func(record entry) {
+			if record.value == "" {
+				delete(latest, record.key)
+			} else {
+				latest[record.key] = record.value
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", segment.filename, err)
+		}
+	}
+	var out bytes.Buffer
+	for key, value := range latest {
+		out.Write((&entry{key: key, value: value}).Encode())
+	}
+	return out.Bytes(), nil
+}
+
+// Close releases the segment files.
+func (v *View) Close() {
+	ds := v.ds
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if v.closed {
+		return
+	}
+	v.closed = true
+	for _, segment := range v.segments {
+		segment.file.release()
+	}
+}
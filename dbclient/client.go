@@ -0,0 +1,386 @@
+// Package dbclient is a client for the HTTP API of cmd/db.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// leaderHeader carries the leader address in 421 answers of followers.
+	leaderHeader = "Db-Leader"
+	octetStream  = "application/octet-stream"
+)
+
+const (
+	DefaultTimeout    = 5 * time.Second
+	DefaultRetries    = 3
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrTooLarge = errors.New("key or value too large")
+	// ErrReadOnly is returned by writes that a follower rejected without
+	// naming its leader, or that the named leader rejected as well, and by
+	// writes sent over the binary protocol to a Raft node that is not the
+	// leader.
+	ErrReadOnly = errors.New("db node is a read-only follower")
+	// ErrUnauthorized means the token is missing or unknown to the node.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden means the token does not cover the key or operation.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// StatusError is returned when the db answers with an unexpected status. It
+// matches ErrNotFound, ErrTooLarge, ErrReadOnly, ErrUnauthorized and
+// ErrForbidden with errors.Is for the corresponding status codes.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	// Leader is the node a follower answering 421 sent the client to.
+	Leader string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("db responded with %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrReadOnly:
+		return e.StatusCode == http.StatusMisdirectedRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Item is a key and its value. Values that are not valid UTF-8 arrive base64
+// encoded, with Encoding set to "base64"; Get and Scan decode them.
+type Item struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func (item *Item) decode() error {
+	if item.Encoding != "base64" {
+		return nil
+	}
+	value, err := base64.StdEncoding.DecodeString(item.Value)
+	if err != nil {
+		return fmt.Errorf("bad value of %q: %w", item.Key, err)
+	}
+	item.Value, item.Encoding = string(value), ""
+	return nil
+}
+
+type Stats struct {
+	Keys     int   `json:"keys"`
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+}
+
+// Client talks to a single db node. Requests that fail to connect or get a
+// 5xx response are retried with exponential backoff until the retries run out
+// or the context is done. All operations are idempotent, so retrying a write
+// is safe. A write rejected by a follower is sent once more to the leader it
+// names, with the same token.
+type Client struct {
+	base       string
+	token      string
+	http       *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client, whose timeout applies to
+// every attempt separately.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) { cl.http = c }
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(cl *Client) { cl.http = &http.Client{Timeout: timeout} }
+}
+
+// WithToken sends token as the bearer token of every request.
+func WithToken(token string) Option {
+	return func(cl *Client) { cl.token = token }
+}
+
+// WithRetries sets how many times a failed request is repeated; 0 disables
+// retries.
+func WithRetries(n int) Option {
+	return func(cl *Client) { cl.retries = n }
+}
+
+// WithBackoff sets the delay before the first retry and the cap it doubles
+// up to.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(cl *Client) {
+		cl.backoff = initial
+		cl.maxBackoff = max
+	}
+}
+
+// New creates a client for the node at baseURL, e.g. http://db:8083.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		base:       strings.TrimSuffix(baseURL, "/"),
+		http:       &http.Client{Timeout: DefaultTimeout},
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) BaseURL() string {
+	return c.base
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	item, err := c.GetItem(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if err := item.decode(); err != nil {
+		return "", err
+	}
+	return item.Value, nil
+}
+
+// GetItem returns key and its value as the db sent them, so a value that is
+// not valid UTF-8 is still base64 encoded.
+func (c *Client) GetItem(ctx context.Context, key string) (Item, error) {
+	var item Item
+	err := c.getJSON(ctx, keyPath(key), &item)
+	return item, err
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, keyPath(key), body, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetBytes returns the value as stored, without the JSON envelope that Get
+// uses and that cannot carry invalid UTF-8.
+func (c *Client) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key), nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("bad response from %s: %w", c.base, err)
+	}
+	return value, nil
+}
+
+// PutBytes stores value as an application/octet-stream body, so any bytes
+// survive. The server rejects an empty value; use Delete to remove a key.
+func (c *Client) PutBytes(ctx context.Context, key string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	resp, err := c.do(ctx, http.MethodPut, keyPath(key), value, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, false)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Keys returns all keys with the given prefix in sorted order.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.getJSON(ctx, "/keys?"+url.Values{"prefix": {prefix}}.Encode(), &keys)
+	return keys, err
+}
+
+// Scan returns up to limit items with the given prefix whose keys sort after
+// the after key. Pass the last key of a page as after to get the next one. A
+// limit of 0 uses the server default.
+func (c *Client) Scan(ctx context.Context, prefix, after string, limit int) ([]Item, error) {
+	query := url.Values{"prefix": {prefix}, "after": {after}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var items []Item
+	if err := c.getJSON(ctx, "/scan?"+query.Encode(), &items); err != nil {
+		return nil, err
+	}
+	for i := range items {
+		if err := items[i].decode(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.getJSON(ctx, "/stats", &stats)
+	return stats, err
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("bad response from %s: %w", c.base, err)
+	}
+	return nil
+}
+
+// do sends the request and returns the response if it has a 2xx status. A raw
+// request sends and accepts the value as application/octet-stream instead of
+// JSON.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, raw bool) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, c.base+path, body, raw)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.Leader != "" {
+			resp, err = c.send(ctx, method, strings.TrimSuffix(statusErr.Leader, "/")+path, body, raw)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		if !retryable(err) || attempt >= c.retries {
+			return nil, err
+		}
+		lastErr = err
+		if err := c.wait(ctx, attempt); err != nil {
+			return nil, fmt.Errorf("%w (last error: %v)", err, lastErr)
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, target string, body []byte, raw bool) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	contentType := "application/json"
+	if raw {
+		contentType = octetStream
+		req.Header.Set("Accept", octetStream)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &connError{err: err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	statusErr := &StatusError{StatusCode: resp.StatusCode, Message: string(bytes.TrimSpace(msg))}
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		statusErr.Leader = resp.Header.Get(leaderHeader)
+	}
+	return nil, statusErr
+}
+
+// connError marks failures to reach the node, which are worth retrying.
+type connError struct {
+	err error
+}
+
+func (e *connError) Error() string { return e.err.Error() }
+func (e *connError) Unwrap() error { return e.err }
+
+func retryable(err error) bool {
+	var connErr *connError
+	if errors.As(err, &connErr) {
+		return true
+	}
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 500
+}
+
+// wait sleeps before retry number attempt+1. The delay doubles with every
+// attempt and is jittered so that clients do not retry in lockstep.
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	delay := c.maxBackoff
+	if attempt < 30 {
+		delay = min(c.backoff<<attempt, c.maxBackoff)
+	}
+	delay = delay/2 + rand.N(delay/2+1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,283 @@
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string, opts ...Option) *Client {
+	return New(url, append([]Option{WithBackoff(time.Millisecond, 5*time.Millisecond)}, opts...)...)
+}
+
+func TestGetPutDelete(t *testing.T) {
+	data := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path[len("/db/"):]
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := data[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(Item{Key: key, Value: value})
+		case http.MethodPost:
+			var req struct{ Value string }
+			json.NewDecoder(r.Body).Decode(&req)
+			data[key] = req.Value
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			delete(data, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+	client := newTestClient(ts.URL)
+	ctx := context.Background()
+
+	if err := client.Put(ctx, "a/b c", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if data["a/b c"] != "value" {
+		t.Errorf("stored %v", data)
+	}
+	if value, err := client.Get(ctx, "a/b c"); err != nil || value != "value" {
+		t.Errorf("get: %q, %v", value, err)
+	}
+	if err := client.Delete(ctx, "a/b c"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.Get(ctx, "a/b c")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("get deleted key: got %v, want ErrNotFound", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("get deleted key: got %#v, want a 404 StatusError", err)
+	}
+}
+
+func TestGetPutBytes(t *testing.T) {
+	var stored []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/octet-stream" {
+			http.Error(w, "expected a raw request", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Write(stored)
+		case http.MethodPut:
+			if r.Header.Get("Content-Type") != "application/octet-stream" {
+				http.Error(w, "expected a raw body", http.StatusBadRequest)
+				return
+			}
+			stored, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+	client := newTestClient(ts.URL)
+	ctx := context.Background()
+
+	value := []byte{0xff, 0xfe, 0, 'x'}
+	if err := client.PutBytes(ctx, "k", value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.GetBytes(ctx, "k"); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("get bytes: %q, %v", got, err)
+	}
+}
+
+func TestGetItem(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Item{Key: "k", Value: "/w==", Encoding: "base64"})
+	}))
+	defer ts.Close()
+	client := newTestClient(ts.URL)
+	ctx := context.Background()
+
+	want := Item{Key: "k", Value: "/w==", Encoding: "base64"}
+	if item, err := client.GetItem(ctx, "k"); err != nil || item != want {
+		t.Errorf("get item: %+v, %v", item, err)
+	}
+	if value, err := client.Get(ctx, "k"); err != nil || value != "\xff" {
+		t.Errorf("get: %q, %v", value, err)
+	}
+}
+
+func TestRetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(Item{Key: "k", Value: "v"})
+	}))
+	defer ts.Close()
+
+	value, err := newTestClient(ts.URL).Get(context.Background(), "k")
+	if err != nil || value != "v" {
+		t.Fatalf("get: %q, %v", value, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d calls, want 3", n)
+	}
+}
+
+func TestNoRetryOnClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer ts.Close()
+
+	err := newTestClient(ts.URL).Put(context.Background(), "k", "v")
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d calls, want 1", n)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer secret":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	if _, err := newTestClient(ts.URL).Get(context.Background(), "k"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("without token: got %v, want ErrUnauthorized", err)
+	}
+	if _, err := newTestClient(ts.URL, WithToken("secret")).Get(context.Background(), "k"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("with token: got %v, want ErrForbidden", err)
+	}
+}
+
+func TestFollowerWriteGoesToLeader(t *testing.T) {
+	var stored string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct{ Value string }
+		json.NewDecoder(r.Body).Decode(&req)
+		stored = req.Value
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer leader.Close()
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(leaderHeader, leader.URL)
+		http.Error(w, "read-only follower", http.StatusMisdirectedRequest)
+	}))
+	defer follower.Close()
+
+	if err := newTestClient(follower.URL, WithToken("secret")).Put(context.Background(), "k", "v"); err != nil {
+		t.Fatalf("put through follower: %v", err)
+	}
+	if stored != "v" {
+		t.Errorf("leader stored %q", stored)
+	}
+
+	leader.Close()
+	err := newTestClient(follower.URL, WithRetries(0)).Put(context.Background(), "k", "v")
+	if err == nil {
+		t.Error("put succeeded with the leader down")
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "db error", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	client := New(ts.URL, WithRetries(2), WithBackoff(time.Millisecond, time.Millisecond))
+	_, err := client.Get(context.Background(), "k")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got %v, want a 500 StatusError", err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("%d calls, want 3", n)
+	}
+}
+
+func TestConnectionErrors(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	_, err := newTestClient(url).Get(context.Background(), "k")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want a connection error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	client := New(url, WithRetries(100), WithBackoff(10*time.Millisecond, 10*time.Millisecond))
+	start := time.Now()
+	if _, err := client.Get(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries ignored the context, took %v", elapsed)
+	}
+}
+
+func TestScanAndStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/scan":
+			query := r.URL.Query()
+			if query.Get("prefix") != "user/" || query.Get("after") != "user/1" || query.Get("limit") != "2" {
+				http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode([]Item{
+				{Key: "user/2", Value: "b"},
+				{Key: "user/3", Value: "/w==", Encoding: "base64"},
+			})
+		case "/stats":
+			json.NewEncoder(w).Encode(Stats{Keys: 3, Segments: 2, Size: 100})
+		}
+	}))
+	defer ts.Close()
+	client := newTestClient(ts.URL)
+
+	items, err := client.Scan(context.Background(), "user/", "user/1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Item{{Key: "user/2", Value: "b"}, {Key: "user/3", Value: "\xff"}}; !reflect.DeepEqual(items, want) {
+		t.Errorf("scan: got %v, want %v", items, want)
+	}
+
+	stats, err := client.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Keys: 3, Segments: 2, Size: 100}) {
+		t.Errorf("stats: got %+v", stats)
+	}
+}
@@ -0,0 +1,60 @@
+package dbclient
+
+import (
+	"bufio"
+
+	"github.com/DmytroHalai/achitecture-practice-5/datastore"
+)
+
+// The binary protocol of cmd/db runs over a plain TCP connection. A request
+// is an op byte followed by a record in the segment file format that carries
+// the key and, for puts, the value. A response is a status byte followed by a
+// record with an empty key and the value or an error message. Responses come
+// back in request order, so a client may send any number of requests before
+// reading the responses.
+
+type Op byte
+
+const (
+	OpGet    Op = 'G'
+	OpPut    Op = 'P'
+	OpDelete Op = 'D'
+	// OpAuth carries a bearer token as its value. It authenticates the rest
+	// of the connection on nodes that require tokens.
+	OpAuth Op = 'A'
+)
+
+type Status byte
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusTooLarge
+	// StatusNotLeader answers writes to a node that does not take them. The
+	// payload is the leader address if the node knows it.
+	StatusNotLeader
+	StatusFailed
+	StatusUnauthorized
+	StatusForbidden
+)
+
+// WriteFrame writes a request or response frame. kind is an Op or a Status.
+func WriteFrame(w *bufio.Writer, kind byte, key, value string) error {
+	if err := w.WriteByte(kind); err != nil {
+		return err
+	}
+	_, err := w.Write(datastore.EncodeRecord(key, value))
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame. The options limit the key
+// and value sizes; a frame over the limits fails with datastore.ErrCorrupted
+// and leaves the stream unusable. It returns io.EOF if the stream ended
+// between frames.
+func ReadFrame(r *bufio.Reader, opts ...datastore.Option) (kind byte, key, value string, err error) {
+	if kind, err = r.ReadByte(); err != nil {
+		return 0, "", "", err
+	}
+	key, value, err = datastore.ReadRecord(r, opts...)
+	return kind, key, value, err
+}
@@ -0,0 +1,219 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var ErrClosed = errors.New("connection closed")
+
+// Request is one operation sent with TCPClient.Do.
+type Request struct {
+	Op    Op
+	Key   string
+	Value string
+}
+
+// Result is the outcome of one Request. Err is ErrNotFound, ErrTooLarge,
+// ErrReadOnly, ErrUnauthorized, ErrForbidden or another error reported by the
+// node.
+type Result struct {
+	Value string
+	Err   error
+}
+
+// TCPClient speaks the binary protocol over a single connection. It is safe
+// for concurrent use; requests from different goroutines are pipelined on the
+// connection instead of waiting for each other's responses. A client whose
+// connection fails returns the error from then on and has to be replaced.
+type TCPClient struct {
+	conn net.Conn
+
+	// writeMu keeps the order of pending in line with the order the
+	// requests are written in.
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	mu      sync.Mutex
+	pending []chan Result
+	err     error
+}
+
+// DialTCP connects to the binary listener of a db node, e.g. db:8093.
+func DialTCP(ctx context.Context, addr string) (*TCPClient, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &TCPClient{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *TCPClient) Get(ctx context.Context, key string) (string, error) {
+	res, err := c.Do(ctx, Request{Op: OpGet, Key: key})
+	if err != nil {
+		return "", err
+	}
+	return res[0].Value, res[0].Err
+}
+
+func (c *TCPClient) Put(ctx context.Context, key, value string) error {
+	res, err := c.Do(ctx, Request{Op: OpPut, Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	return res[0].Err
+}
+
+func (c *TCPClient) Delete(ctx context.Context, key string) error {
+	res, err := c.Do(ctx, Request{Op: OpDelete, Key: key})
+	if err != nil {
+		return err
+	}
+	return res[0].Err
+}
+
+// Authenticate sends a bearer token for the rest of the connection.
+func (c *TCPClient) Authenticate(ctx context.Context, token string) error {
+	res, err := c.Do(ctx, Request{Op: OpAuth, Value: token})
+	if err != nil {
+		return err
+	}
+	return res[0].Err
+}
+
+// Do sends all requests in one write and waits for their results. The error
+// is set if the exchange itself failed; errors of single operations are in
+// the results.
+func (c *TCPClient) Do(ctx context.Context, reqs ...Request) ([]Result, error) {
+	waits, err := c.send(reqs)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(reqs))
+	for i, wait := range waits {
+		select {
+		case res := <-wait:
+			if res.Err == ErrClosed || isConnErr(res.Err) {
+				return nil, res.Err
+			}
+			results[i] = res
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+func (c *TCPClient) send(reqs []Request) ([]chan Result, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	waits := make([]chan Result, len(reqs))
+	for i := range waits {
+		// The buffer lets readLoop move on if the caller gave up waiting.
+		waits[i] = make(chan Result, 1)
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.pending = append(c.pending, waits...)
+	c.mu.Unlock()
+
+	for _, req := range reqs {
+		if err := WriteFrame(c.w, byte(req.Op), req.Key, req.Value); err != nil {
+			c.fail(&connError{err: err})
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		c.fail(&connError{err: err})
+		return nil, err
+	}
+	return waits, nil
+}
+
+func (c *TCPClient) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		status, _, value, err := ReadFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrClosed
+			} else {
+				err = &connError{err: err}
+			}
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			c.fail(&connError{err: errors.New("unexpected response")})
+			return
+		}
+		wait := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		wait <- result(Status(status), value)
+	}
+}
+
+func result(status Status, value string) Result {
+	switch status {
+	case StatusOK:
+		return Result{Value: value}
+	case StatusNotFound:
+		return Result{Err: ErrNotFound}
+	case StatusTooLarge:
+		return Result{Err: ErrTooLarge}
+	case StatusNotLeader:
+		return Result{Err: fmt.Errorf("%w, leader: %q", ErrReadOnly, value)}
+	case StatusUnauthorized:
+		return Result{Err: ErrUnauthorized}
+	case StatusForbidden:
+		return Result{Err: ErrForbidden}
+	default:
+		return Result{Err: fmt.Errorf("db error: %s", value)}
+	}
+}
+
+// fail closes the connection and fails every request still waiting.
+func (c *TCPClient) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	pending := c.pending
+	c.pending = nil
+	err = c.err
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, wait := range pending {
+		wait <- Result{Err: err}
+	}
+}
+
+func (c *TCPClient) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+func isConnErr(err error) bool {
+	var connErr *connError
+	return errors.As(err, &connErr)
+}
@@ -0,0 +1,135 @@
+// Package hashring is the consistent-hash ring shared by the db shard client
+// and the load balancer.
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points a node of weight 1 gets on the
+// ring.
+const DefaultReplicas = 100
+
+// Ring maps keys to nodes with consistent hashing. Every node owns replicas
+// points per unit of weight and a key belongs to the node of the first point
+// at or after the key's hash, so adding or removing a node only moves the
+// keys next to that node's points. Get may be called concurrently as long as
+// the ring is not changed.
+type Ring struct {
+	replicas int
+	points   []uint32
+	owners   map[uint32]string
+	weights  map[string]int
+}
+
+func New(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		weights:  make(map[string]int),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+// hash places keys and points on the ring. FNV-1a alone leaves similar
+// strings such as "/a" and "/b" close together, so the result is mixed with
+// the murmur3 finalizer to spread them. It decides where sharded data lives,
+// so it must not change.
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Add places node on the ring with weight 1. Adding a node twice is a no-op.
+func (r *Ring) Add(node string) {
+	r.AddWeighted(node, 1)
+}
+
+// AddWeighted places node on the ring with weight times the points of a
+// node of weight 1, so it gets keys in proportion to its weight. Adding a
+// node twice is a no-op.
+func (r *Ring) AddWeighted(node string, weight int) {
+	if _, ok := r.weights[node]; ok {
+		return
+	}
+	weight = max(weight, 1)
+	r.weights[node] = weight
+	for i := 0; i < r.replicas*weight; i++ {
+		point := hash(node + "#" + strconv.Itoa(i))
+		// On a collision the point stays with its first owner.
+		if _, taken := r.owners[point]; taken {
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	if _, ok := r.weights[node]; !ok {
+		return
+	}
+	delete(r.weights, node)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+func (r *Ring) Has(node string) bool {
+	_, ok := r.weights[node]
+	return ok
+}
+
+// Get returns the node that owns key, or "" if the ring is empty.
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the nodes on the ring in sorted order.
+func (r *Ring) Nodes() []string {
+	nodes := make([]string, 0, len(r.weights))
+	for node := range r.weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Clone returns a copy of the ring that can be changed independently.
+func (r *Ring) Clone() *Ring {
+	c := New(r.replicas)
+	for _, node := range r.Nodes() {
+		c.AddWeighted(node, r.weights[node])
+	}
+	return c
+}
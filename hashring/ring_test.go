@@ -0,0 +1,81 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingDistribution(t *testing.T) {
+	ring := New(DefaultReplicas, "a", "b", "c")
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[ring.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	for _, node := range ring.Nodes() {
+		if counts[node] < 5000 || counts[node] > 15000 {
+			t.Errorf("node %s owns %d of 30000 keys", node, counts[node])
+		}
+	}
+}
+
+func TestRingAddMovesOnlyToNewNode(t *testing.T) {
+	ring := New(DefaultReplicas, "a", "b", "c")
+	next := ring.Clone()
+	next.Add("d")
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before, after := ring.Get(key), next.Get(key)
+		if before == after {
+			continue
+		}
+		if after != "d" {
+			t.Fatalf("%s moved from %s to %s", key, before, after)
+		}
+		moved++
+	}
+	// About a quarter of the keys should move to the fourth node.
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("%d of 10000 keys moved", moved)
+	}
+
+	next.Remove("d")
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if ring.Get(key) != next.Get(key) {
+			t.Fatalf("%s: owner differs after removing the added node", key)
+		}
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	if node := New(0).Get("key"); node != "" {
+		t.Errorf("empty ring returned %q", node)
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	ring := New(DefaultReplicas)
+	ring.AddWeighted("a", 2)
+	ring.Add("b")
+	ring.Add("c")
+	counts := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		counts[ring.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	// Weights 2, 1 and 1 should give a half and two quarters.
+	if counts["a"] < 12000 || counts["a"] > 18000 {
+		t.Errorf("node a of weight 2 owns %d of 30000 keys", counts["a"])
+	}
+
+	next := ring.Clone()
+	next.Remove("b")
+	next.AddWeighted("b", 2)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if before, after := ring.Get(key), next.Get(key); before != after && after != "b" {
+			t.Fatalf("%s moved from %s to %s", key, before, after)
+		}
+	}
+}
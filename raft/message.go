@@ -0,0 +1,75 @@
+package raft
+
+type MessageType int
+
+const (
+	MsgVote MessageType = iota
+	MsgVoteResp
+	MsgApp
+	MsgAppResp
+	MsgSnap
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgVote:
+		return "MsgVote"
+	case MsgVoteResp:
+		return "MsgVoteResp"
+	case MsgApp:
+		return "MsgApp"
+	case MsgAppResp:
+		return "MsgAppResp"
+	case MsgSnap:
+		return "MsgSnap"
+	}
+	return "MsgUnknown"
+}
+
+type EntryType int
+
+const (
+	EntryNormal EntryType = iota
+	EntryNoop
+	EntryAddNode
+	EntryRemoveNode
+)
+
+type Entry struct {
+	Term  uint64    `json:"term"`
+	Index uint64    `json:"index"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// Snapshot replaces the log up to and including Index.
+type Snapshot struct {
+	Index uint64   `json:"index"`
+	Term  uint64   `json:"term"`
+	Peers []string `json:"peers"`
+	Data  []byte   `json:"data,omitempty"`
+}
+
+// Message is exchanged between nodes. Fields that do not apply to a type are
+// left empty.
+type Message struct {
+	Type MessageType `json:"type"`
+	From string      `json:"from"`
+	To   string      `json:"to"`
+	Term uint64      `json:"term"`
+
+	LastLogIndex uint64 `json:"last_log_index,omitempty"`
+	LastLogTerm  uint64 `json:"last_log_term,omitempty"`
+	Granted      bool   `json:"granted,omitempty"`
+
+	PrevLogIndex uint64  `json:"prev_log_index,omitempty"`
+	PrevLogTerm  uint64  `json:"prev_log_term,omitempty"`
+	Entries      []Entry `json:"entries,omitempty"`
+	Commit       uint64  `json:"commit,omitempty"`
+
+	Success    bool   `json:"success,omitempty"`
+	MatchIndex uint64 `json:"match_index,omitempty"`
+	RejectHint uint64 `json:"reject_hint,omitempty"`
+
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
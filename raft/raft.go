@@ -0,0 +1,812 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrNotLeader         = errors.New("node is not the leader")
+	ErrProposalDropped   = errors.New("proposal was dropped by a leader change")
+	ErrConfChangePending = errors.New("another membership change is in progress")
+)
+
+// StateMachine receives committed entries in log order.
+type StateMachine interface {
+	// Apply applies a committed entry. An entry that fails is not skipped:
+	// applying stops there and is retried on every Tick until it succeeds.
+	Apply(data []byte) error
+	// Snapshot captures the state after the last applied entry, so the log
+	// before it can be dropped, and returns a function that encodes it. The
+	// capture runs with applies paused and must be cheap; the encoding runs
+	// on its own goroutine while later entries are applied.
+	Snapshot() (func() ([]byte, error), error)
+	// Restore replaces the state with a snapshot sent by the leader.
+	Restore(data []byte) error
+}
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+type Config struct {
+	ID string
+	// Peers is the initial cluster, this node included. A node started
+	// without itself in Peers waits to be added by the leader.
+	Peers []string
+
+	// ElectionTicks is the minimum number of ticks without hearing from a
+	// leader before a follower campaigns; the actual timeout is randomized
+	// in [ElectionTicks, 2*ElectionTicks).
+	ElectionTicks  int
+	HeartbeatTicks int
+	// SnapshotEntries is the number of applied entries after which the log
+	// is compacted into a state machine snapshot. Zero disables snapshots.
+	SnapshotEntries uint64
+	// MaxBatch limits the number of entries in a single append message.
+	MaxBatch int
+
+	StateMachine StateMachine
+	// PersistentStateMachine tells the node that the state machine keeps its
+	// state across restarts. The node then saves the applied index and on
+	// restart neither restores the snapshot nor replays the applied entries.
+	PersistentStateMachine bool
+	Storage                Storage
+	// Rand drives election timeouts; tests pass a seeded source.
+	Rand *rand.Rand
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Node is a single Raft participant. It does no I/O besides Storage: the
+// caller drives it with Tick and Step and delivers the messages returned by
+// ReadMessages, which keeps it deterministic under test.
+type Node struct {
+	mu  sync.Mutex
+	cfg Config
+	id  string
+
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+
+	snapshot Snapshot
+	log      []Entry
+	commit   uint64
+	applied  uint64
+	peers    []string
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	votes      map[string]bool
+	// active holds the peers the leader heard from in the current election
+	// timeout.
+	active map[string]bool
+
+	electionElapsed   int
+	heartbeatElapsed  int
+	randomizedTimeout int
+
+	msgs    []Message
+	waiters map[uint64]waiter
+	dirty   bool
+	// applyErr is why the next committed entry could not be applied.
+	applyErr error
+
+	// snapshotting is set while a snapshot is being encoded; snapshots
+	// tracks the encoding goroutines.
+	snapshotting bool
+	snapshots    sync.WaitGroup
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = 10
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = 1
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = 64
+	}
+	if cfg.Storage == nil {
+		cfg.Storage = NewMemoryStorage()
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = rand.New(rand.NewSource(rand.Int63()))
+	}
+	n := &Node{
+		cfg:     cfg,
+		id:      cfg.ID,
+		waiters: make(map[uint64]waiter),
+	}
+
+	hs, snap, entries, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load raft state: %w", err)
+	}
+	n.term, n.votedFor = hs.Term, hs.VotedFor
+	n.log = entries
+	if snap != nil {
+		n.snapshot = *snap
+		n.commit, n.applied = snap.Index, snap.Index
+	}
+	switch {
+	case cfg.PersistentStateMachine && hs.Applied >= n.snapshot.Index && (snap != nil || len(entries) > 0):
+		// The state machine already holds everything up to hs.Applied.
+		applied := min(hs.Applied, n.lastIndex())
+		n.commit, n.applied = applied, applied
+	case snap != nil && snap.Index > 0:
+		if err := cfg.StateMachine.Restore(snap.Data); err != nil {
+			return nil, fmt.Errorf("failed to restore snapshot at %d: %w", snap.Index, err)
+		}
+	case snap == nil && len(entries) == 0 && len(cfg.Peers) > 0:
+		n.bootstrap(cfg.Peers)
+	}
+	n.peers = n.configAt(n.lastIndex())
+	n.becomeFollower(n.term, "")
+	return n, nil
+}
+
+// bootstrap writes the initial membership as committed entries of term 1.
+// Every founding member ends up with the same entries, and nodes added later
+// learn the membership by replicating them.
+func (n *Node) bootstrap(peers []string) {
+	n.term = 1
+	for i, p := range slices.Sorted(slices.Values(peers)) {
+		n.log = append(n.log, Entry{Term: 1, Index: uint64(i + 1), Type: EntryAddNode, Data: []byte(p)})
+	}
+	n.commit, n.applied = n.lastIndex(), n.lastIndex()
+	n.dirty = true
+}
+
+// Tick advances the logical clock by one step. It retries a committed entry
+// the state machine failed to apply and returns the error until it succeeds.
+func (n *Node) Tick() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Leader {
+		n.electionElapsed++
+		if n.electionElapsed >= n.cfg.ElectionTicks {
+			n.electionElapsed = 0
+			n.checkQuorum()
+		}
+		n.heartbeatElapsed++
+		if n.state == Leader && n.heartbeatElapsed >= n.cfg.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+	} else {
+		n.electionElapsed++
+		if n.electionElapsed >= n.randomizedTimeout && n.isMember(n.id) {
+			n.campaign()
+		}
+	}
+	if n.applyErr != nil {
+		n.applyCommitted()
+	}
+	if err := n.persist(); err != nil {
+		return err
+	}
+	return n.applyErr
+}
+
+// Step processes a message received from another node.
+func (n *Node) Step(m Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.step(m)
+	return n.persist()
+}
+
+// Propose appends data to the log. The returned channel receives the result
+// of applying it once the entry is committed, or ErrProposalDropped.
+func (n *Node) Propose(data []byte) (<-chan error, error) {
+	return n.propose(EntryNormal, data)
+}
+
+// AddNode and RemoveNode change the cluster membership one node at a time.
+func (n *Node) AddNode(id string) (<-chan error, error) {
+	return n.propose(EntryAddNode, []byte(id))
+}
+
+func (n *Node) RemoveNode(id string) (<-chan error, error) {
+	return n.propose(EntryRemoveNode, []byte(id))
+}
+
+// ReadMessages returns and clears the messages the node wants to send.
+func (n *Node) ReadMessages() []Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	msgs := n.msgs
+	n.msgs = nil
+	return msgs
+}
+
+type Status struct {
+	ID        string   `json:"id"`
+	State     string   `json:"state"`
+	Term      uint64   `json:"term"`
+	Leader    string   `json:"leader"`
+	Commit    uint64   `json:"commit"`
+	Applied   uint64   `json:"applied"`
+	LastIndex uint64   `json:"last_index"`
+	Snapshot  uint64   `json:"snapshot_index"`
+	Peers     []string `json:"peers"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:        n.id,
+		State:     n.state.String(),
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.lastIndex(),
+		Snapshot:  n.snapshot.Index,
+		Peers:     slices.Clone(n.peers),
+	}
+}
+
+func (n *Node) propose(typ EntryType, data []byte) (<-chan error, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader {
+		return nil, ErrNotLeader
+	}
+	if typ != EntryNormal {
+		if n.pendingConfChange() {
+			return nil, ErrConfChangePending
+		}
+		id := string(data)
+		if typ == EntryAddNode && n.isMember(id) {
+			return nil, fmt.Errorf("%s is already a member", id)
+		}
+		if typ == EntryRemoveNode && !n.isMember(id) {
+			return nil, fmt.Errorf("%s is not a member", id)
+		}
+	}
+	e := n.appendEntry(typ, data)
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, ch: ch}
+	n.broadcastAppend()
+	// A single member cluster commits on its own.
+	n.maybeCommit()
+	if err := n.persist(); err != nil {
+		delete(n.waiters, e.Index)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (n *Node) step(m Message) {
+	// A node that still hears from a leader ignores campaigns, so a node
+	// that was partitioned away or removed cannot disrupt the cluster. The
+	// leader itself only stays in power while checkQuorum sees a majority.
+	if m.Type == MsgVote && m.Term > n.term && n.inLease() {
+		return
+	}
+	switch {
+	case m.Term > n.term:
+		leader := ""
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	case m.Term < n.term:
+		// Let a stale leader or candidate learn about the newer term.
+		switch m.Type {
+		case MsgApp, MsgSnap:
+			n.send(Message{Type: MsgAppResp, To: m.From, Success: false})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From, Granted: false})
+		}
+		return
+	}
+	if n.state == Leader {
+		n.active[m.From] = true
+	}
+
+	switch m.Type {
+	case MsgVote:
+		n.handleVote(m)
+	case MsgVoteResp:
+		n.handleVoteResp(m)
+	case MsgApp:
+		n.becomeFollowerOf(m.From)
+		n.handleAppend(m)
+	case MsgAppResp:
+		n.handleAppendResp(m)
+	case MsgSnap:
+		n.becomeFollowerOf(m.From)
+		n.handleSnapshot(m)
+	}
+}
+
+func (n *Node) handleVote(m Message) {
+	canVote := n.votedFor == "" || n.votedFor == m.From
+	upToDate := m.LastLogTerm > n.lastTerm() ||
+		(m.LastLogTerm == n.lastTerm() && m.LastLogIndex >= n.lastIndex())
+	granted := canVote && upToDate
+	if granted {
+		n.votedFor = m.From
+		n.electionElapsed = 0
+		n.dirty = true
+	}
+	n.send(Message{Type: MsgVoteResp, To: m.From, Granted: granted})
+}
+
+func (n *Node) handleVoteResp(m Message) {
+	if n.state != Candidate {
+		return
+	}
+	n.votes[m.From] = m.Granted
+	if n.countVotes() >= n.quorum() {
+		n.becomeLeader()
+	}
+}
+
+func (n *Node) handleAppend(m Message) {
+	prev, entries := m.PrevLogIndex, m.Entries
+	// Entries covered by our snapshot are committed and therefore match.
+	if prev < n.snapshot.Index {
+		skip := n.snapshot.Index - prev
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.snapshot.Index
+	} else if prev > n.lastIndex() || n.termAt(prev) != m.PrevLogTerm {
+		hint := n.lastIndex()
+		if prev > 0 && prev-1 < hint {
+			hint = prev - 1
+		}
+		n.send(Message{Type: MsgAppResp, To: m.From, Success: false, RejectHint: hint})
+		return
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.truncateFrom(e.Index)
+		}
+		n.log = append(n.log, entries[i:]...)
+		n.dirty = true
+		n.peers = n.configAt(n.lastIndex())
+		break
+	}
+
+	lastNew := prev + uint64(len(entries))
+	if commit := min(m.Commit, lastNew); commit > n.commit {
+		n.commit = commit
+		n.applyCommitted()
+	}
+	n.send(Message{Type: MsgAppResp, To: m.From, Success: true, MatchIndex: lastNew})
+}
+
+func (n *Node) handleAppendResp(m Message) {
+	if n.state != Leader {
+		return
+	}
+	if _, ok := n.nextIndex[m.From]; !ok {
+		return
+	}
+	if m.Success {
+		if m.MatchIndex > n.matchIndex[m.From] {
+			n.matchIndex[m.From] = m.MatchIndex
+		}
+		n.nextIndex[m.From] = max(n.nextIndex[m.From], n.matchIndex[m.From]+1)
+		n.maybeCommit()
+		if n.nextIndex[m.From] <= n.lastIndex() {
+			n.sendAppend(m.From)
+		}
+		return
+	}
+	// The follower's log ends before or diverges at the probed index.
+	next := min(m.RejectHint+1, n.nextIndex[m.From]-1)
+	n.nextIndex[m.From] = max(next, n.matchIndex[m.From]+1, 1)
+	n.sendAppend(m.From)
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	snap := m.Snapshot
+	if snap == nil || snap.Index <= n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Success: true, MatchIndex: n.commit})
+		return
+	}
+	if err := n.cfg.StateMachine.Restore(snap.Data); err != nil {
+		n.send(Message{Type: MsgAppResp, To: m.From, Success: false, RejectHint: n.commit})
+		return
+	}
+	if snap.Index <= n.lastIndex() && n.termAt(snap.Index) == snap.Term {
+		n.log = slices.Clone(n.log[snap.Index-n.snapshot.Index:])
+	} else {
+		n.log = nil
+	}
+	n.dropWaitersFrom(0)
+	n.snapshot = *snap
+	n.commit, n.applied = snap.Index, snap.Index
+	n.applyErr = nil
+	n.peers = n.configAt(n.lastIndex())
+	n.dirty = true
+	n.send(Message{Type: MsgAppResp, To: m.From, Success: true, MatchIndex: snap.Index})
+}
+
+func (n *Node) campaign() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.dirty = true
+	n.resetElectionTimeout()
+	if n.countVotes() >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		if p == n.id {
+			continue
+		}
+		n.send(Message{Type: MsgVote, To: p, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()})
+	}
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term != n.term {
+		n.term = term
+		n.votedFor = ""
+		n.dirty = true
+	}
+	n.state = Follower
+	n.leader = leader
+	n.resetElectionTimeout()
+}
+
+// becomeFollowerOf records the current leader after a message from it.
+func (n *Node) becomeFollowerOf(leader string) {
+	if n.state != Follower {
+		n.becomeFollower(n.term, leader)
+	}
+	n.leader = leader
+	n.electionElapsed = 0
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.id
+	n.heartbeatElapsed = 0
+	n.electionElapsed = 0
+	n.active = make(map[string]bool)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	for _, p := range n.peers {
+		n.nextIndex[p] = n.lastIndex() + 1
+		n.matchIndex[p] = 0
+	}
+	// Entries from earlier terms only commit together with one of ours.
+	n.appendEntry(EntryNoop, nil)
+	n.broadcastAppend()
+	n.maybeCommit()
+}
+
+func (n *Node) appendEntry(typ EntryType, data []byte) Entry {
+	e := Entry{Term: n.term, Index: n.lastIndex() + 1, Type: typ, Data: data}
+	n.log = append(n.log, e)
+	n.dirty = true
+	if typ == EntryAddNode || typ == EntryRemoveNode {
+		n.peers = n.configAt(e.Index)
+		for _, p := range n.peers {
+			if _, ok := n.nextIndex[p]; !ok {
+				n.nextIndex[p] = e.Index
+				n.matchIndex[p] = 0
+			}
+		}
+	}
+	n.matchIndex[n.id] = e.Index
+	n.nextIndex[n.id] = e.Index + 1
+	return e
+}
+
+func (n *Node) broadcastAppend() {
+	for _, p := range n.peers {
+		if p != n.id {
+			n.sendAppend(p)
+		}
+	}
+}
+
+func (n *Node) sendAppend(to string) {
+	next := n.nextIndex[to]
+	if next <= n.snapshot.Index {
+		snap := n.snapshot
+		n.send(Message{Type: MsgSnap, To: to, Snapshot: &snap})
+		return
+	}
+	prev := next - 1
+	var entries []Entry
+	if next <= n.lastIndex() {
+		start := next - n.snapshot.Index - 1
+		end := min(start+uint64(n.cfg.MaxBatch), uint64(len(n.log)))
+		entries = slices.Clone(n.log[start:end])
+		// Assume the entries arrive, so heartbeats do not resend them. A
+		// lost message makes the follower reject the next append, which
+		// moves nextIndex back.
+		n.nextIndex[to] = next + uint64(len(entries))
+	}
+	n.send(Message{
+		Type:         MsgApp,
+		To:           to,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.termAt(prev),
+		Entries:      entries,
+		Commit:       n.commit,
+	})
+}
+
+// maybeCommit advances the commit index to the highest entry of the current
+// term stored on a majority.
+func (n *Node) maybeCommit() {
+	if n.state != Leader {
+		return
+	}
+	for idx := n.lastIndex(); idx > n.commit; idx-- {
+		if n.termAt(idx) != n.term {
+			break
+		}
+		count := 0
+		for _, p := range n.peers {
+			if n.matchIndex[p] >= idx {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commit = idx
+			n.applyCommitted()
+			// Let followers learn the new commit index right away.
+			n.broadcastAppend()
+			return
+		}
+	}
+}
+
+func (n *Node) applyCommitted() {
+	for n.applied < n.commit {
+		e := n.entryAt(n.applied + 1)
+		if e.Type == EntryNormal {
+			// Every node applies every committed entry, so one that
+			// fails here is retried rather than skipped.
+			if err := n.cfg.StateMachine.Apply(e.Data); err != nil {
+				n.applyErr = fmt.Errorf("failed to apply entry %d: %w", e.Index, err)
+				return
+			}
+		}
+		n.applyErr = nil
+		n.applied++
+		var err error
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				err = ErrProposalDropped
+			}
+			w.ch <- err
+		}
+		if e.Type == EntryRemoveNode && string(e.Data) == n.id && n.state == Leader {
+			n.becomeFollower(n.term, "")
+		}
+		if n.cfg.PersistentStateMachine {
+			n.dirty = true
+		}
+	}
+	n.maybeSnapshot()
+}
+
+func (n *Node) maybeSnapshot() {
+	if n.cfg.SnapshotEntries == 0 || n.snapshotting || n.applied-n.snapshot.Index < n.cfg.SnapshotEntries {
+		return
+	}
+	encode, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		// The log is kept; the next applied entry tries again.
+		return
+	}
+	n.snapshotting = true
+	n.snapshots.Add(1)
+	go n.compact(n.applied, encode)
+}
+
+// compact encodes a snapshot of the state at index without holding the node
+// lock, so ticks and messages are handled meanwhile, and then drops the log
+// it covers.
+func (n *Node) compact(index uint64, encode func() ([]byte, error)) {
+	defer n.snapshots.Done()
+	data, err := encode()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.snapshotting = false
+	// A failed snapshot is retried after the next applied entry. A snapshot
+	// from the leader may have overtaken this one while it was encoded.
+	if err != nil || index <= n.snapshot.Index {
+		return
+	}
+	snap := Snapshot{
+		Index: index,
+		Term:  n.termAt(index),
+		Peers: n.configAt(index),
+		Data:  data,
+	}
+	n.log = slices.Clone(n.log[index-n.snapshot.Index:])
+	n.snapshot = snap
+	n.dirty = true
+	// A failure leaves the node dirty, so the next Tick or Step retries
+	// and reports it.
+	n.persist()
+}
+
+func (n *Node) truncateFrom(index uint64) {
+	n.log = n.log[:index-n.snapshot.Index-1]
+	n.dropWaitersFrom(index)
+	n.dirty = true
+}
+
+func (n *Node) dropWaitersFrom(index uint64) {
+	for idx, w := range n.waiters {
+		if idx >= index {
+			w.ch <- ErrProposalDropped
+			delete(n.waiters, idx)
+		}
+	}
+}
+
+// configAt returns the membership in effect once the log up to index is
+// known. Changes take effect as soon as they are appended.
+func (n *Node) configAt(index uint64) []string {
+	peers := slices.Clone(n.snapshot.Peers)
+	for _, e := range n.log {
+		if e.Index > index {
+			break
+		}
+		id := string(e.Data)
+		switch e.Type {
+		case EntryAddNode:
+			if !slices.Contains(peers, id) {
+				peers = append(peers, id)
+			}
+		case EntryRemoveNode:
+			peers = slices.DeleteFunc(peers, func(p string) bool { return p == id })
+		}
+	}
+	slices.Sort(peers)
+	return peers
+}
+
+func (n *Node) pendingConfChange() bool {
+	for _, e := range n.log {
+		if e.Index > n.commit && (e.Type == EntryAddNode || e.Type == EntryRemoveNode) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuorum steps the leader down if it has not heard from a majority
+// within an election timeout. A leader cut off from the cluster then stops
+// accepting proposals that could never commit, and no longer ignores the
+// campaigns of the majority.
+func (n *Node) checkQuorum() {
+	count := 0
+	for _, p := range n.peers {
+		if p == n.id || n.active[p] {
+			count++
+		}
+	}
+	n.active = make(map[string]bool)
+	if count < n.quorum() {
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) inLease() bool {
+	return n.state == Leader || (n.leader != "" && n.electionElapsed < n.cfg.ElectionTicks)
+}
+
+func (n *Node) isMember(id string) bool {
+	return slices.Contains(n.peers, id)
+}
+
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *Node) countVotes() int {
+	count := 0
+	for _, p := range n.peers {
+		if n.votes[p] {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.randomizedTimeout = n.cfg.ElectionTicks + n.cfg.Rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// termAt returns the term of the entry at index, or 0 when it is unknown.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapshot.Index-1].Term
+}
+
+func (n *Node) entryAt(index uint64) Entry {
+	return n.log[index-n.snapshot.Index-1]
+}
+
+func (n *Node) send(m Message) {
+	m.From = n.id
+	m.Term = n.term
+	n.msgs = append(n.msgs, m)
+}
+
+// persist saves the state before any message produced by the same step can
+// leave the node. If saving fails, those messages are dropped.
+func (n *Node) persist() error {
+	if !n.dirty {
+		return nil
+	}
+	hs := HardState{Term: n.term, VotedFor: n.votedFor}
+	if n.cfg.PersistentStateMachine {
+		hs.Applied = n.applied
+	}
+	err := n.cfg.Storage.Save(hs, &n.snapshot, n.log)
+	if err != nil {
+		n.msgs = nil
+		return fmt.Errorf("failed to persist raft state: %w", err)
+	}
+	n.dirty = false
+	return nil
+}
@@ -0,0 +1,515 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// kvMachine applies "key=value" commands. While fail is set, every apply
+// fails with it.
+type kvMachine struct {
+	data    map[string]string
+	applies int
+	fail    error
+}
+
+func newKVMachine() *kvMachine {
+	return &kvMachine{data: make(map[string]string)}
+}
+
+func (m *kvMachine) Apply(data []byte) error {
+	if m.fail != nil {
+		return m.fail
+	}
+	key, value, _ := strings.Cut(string(data), "=")
+	m.data[key] = value
+	m.applies++
+	return nil
+}
+
+func (m *kvMachine) Snapshot() (func() ([]byte, error), error) {
+	data := maps.Clone(m.data)
+	return func() ([]byte, error) {
+		var lines []string
+		for _, key := range slices.Sorted(maps.Keys(data)) {
+			lines = append(lines, key+"="+data[key])
+		}
+		return []byte(strings.Join(lines, "\n")), nil
+	}, nil
+}
+
+func (m *kvMachine) Restore(data []byte) error {
+	m.data = make(map[string]string)
+	if len(data) == 0 {
+		return nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if err := m.Apply([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// network is a deterministic in-process cluster: time advances only through
+// tick, messages are delivered in the order they were sent, and links can be
+// cut to simulate partitions.
+type network struct {
+	t        *testing.T
+	seed     int64
+	nodes    map[string]*Node
+	machines map[string]*kvMachine
+	storages map[string]*MemoryStorage
+	down     map[string]bool
+	cut      map[[2]string]bool
+	queue    []Message
+	snapEach uint64
+	// persistent keeps the state machines across restarts.
+	persistent bool
+}
+
+func newNetwork(t *testing.T, seed int64, snapEach uint64, ids ...string) *network {
+	nw := &network{
+		t:        t,
+		seed:     seed,
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*kvMachine),
+		storages: make(map[string]*MemoryStorage),
+		down:     make(map[string]bool),
+		cut:      make(map[[2]string]bool),
+		snapEach: snapEach,
+	}
+	for _, id := range ids {
+		nw.start(id, ids)
+	}
+	return nw
+}
+
+// start creates a node or restarts it from its storage.
+func (nw *network) start(id string, peers []string) {
+	nw.t.Helper()
+	storage, ok := nw.storages[id]
+	if !ok {
+		storage = NewMemoryStorage()
+		nw.storages[id] = storage
+	}
+	machine, ok := nw.machines[id]
+	if !ok || !nw.persistent {
+		machine = newKVMachine()
+	}
+	node, err := NewNode(Config{
+		ID:                     id,
+		Peers:                  peers,
+		ElectionTicks:          10,
+		HeartbeatTicks:         1,
+		SnapshotEntries:        nw.snapEach,
+		MaxBatch:               4,
+		StateMachine:           machine,
+		PersistentStateMachine: nw.persistent,
+		Storage:                storage,
+		Rand:                   rand.New(rand.NewSource(nw.seed + int64(len(nw.nodes)) + int64(len(id)))),
+	})
+	if err != nil {
+		nw.t.Fatalf("failed to start %s: %v", id, err)
+	}
+	nw.nodes[id] = node
+	nw.machines[id] = machine
+	delete(nw.down, id)
+}
+
+func (nw *network) ids() []string {
+	return slices.Sorted(maps.Keys(nw.nodes))
+}
+
+func (nw *network) tick() {
+	// Snapshots are encoded in the background; finishing them before the
+	// clock moves keeps runs deterministic.
+	for _, node := range nw.nodes {
+		node.snapshots.Wait()
+	}
+	for _, id := range nw.ids() {
+		if nw.down[id] {
+			continue
+		}
+		if err := nw.nodes[id].Tick(); err != nil && !errors.Is(err, nw.machines[id].fail) {
+			nw.t.Fatal(err)
+		}
+		nw.collect(id)
+	}
+	nw.deliver()
+}
+
+func (nw *network) collect(id string) {
+	nw.queue = append(nw.queue, nw.nodes[id].ReadMessages()...)
+}
+
+func (nw *network) deliver() {
+	for len(nw.queue) > 0 {
+		m := nw.queue[0]
+		nw.queue = nw.queue[1:]
+		node, ok := nw.nodes[m.To]
+		if !ok || nw.down[m.To] || nw.down[m.From] || nw.cut[[2]string{m.From, m.To}] {
+			continue
+		}
+		if err := node.Step(m); err != nil {
+			nw.t.Fatal(err)
+		}
+		nw.collect(m.To)
+	}
+}
+
+func (nw *network) partition(groups ...[]string) {
+	for i, a := range groups {
+		for j, b := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range a {
+				for _, to := range b {
+					nw.cut[[2]string{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+func (nw *network) heal() {
+	nw.cut = make(map[[2]string]bool)
+}
+
+func (nw *network) runUntil(what string, cond func() bool) {
+	nw.t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		nw.tick()
+	}
+	nw.t.Fatalf("timed out waiting for %s", what)
+}
+
+// leaderOf returns the leader with the highest term among ids.
+func (nw *network) leaderOf(ids ...string) string {
+	leader, term := "", uint64(0)
+	for _, id := range ids {
+		st := nw.nodes[id].Status()
+		if !nw.down[id] && st.State == "leader" && st.Term >= term {
+			leader, term = id, st.Term
+		}
+	}
+	return leader
+}
+
+func (nw *network) propose(id, key, value string) <-chan error {
+	nw.t.Helper()
+	ch, err := nw.nodes[id].Propose([]byte(key + "=" + value))
+	if err != nil {
+		nw.t.Fatalf("propose on %s: %v", id, err)
+	}
+	nw.collect(id)
+	nw.deliver()
+	return ch
+}
+
+func (nw *network) hasValue(key, value string, ids ...string) func() bool {
+	return func() bool {
+		for _, id := range ids {
+			if nw.machines[id].data[key] != value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func waitResult(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	default:
+		t.Fatal("proposal has no result yet")
+		return nil
+	}
+}
+
+func TestElectionAndReplication(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			ids := []string{"a", "b", "c"}
+			nw := newNetwork(t, seed, 0, ids...)
+			nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+			leader := nw.leaderOf(ids...)
+
+			leaders := 0
+			for _, id := range ids {
+				if nw.nodes[id].Status().State == "leader" {
+					leaders++
+				}
+			}
+			if leaders != 1 {
+				t.Fatalf("expected exactly one leader, got %d", leaders)
+			}
+
+			ch := nw.propose(leader, "key", "value")
+			nw.runUntil("replication", nw.hasValue("key", "value", ids...))
+			if err := waitResult(t, ch); err != nil {
+				t.Errorf("proposal failed: %v", err)
+			}
+
+			for _, id := range ids {
+				if id == leader {
+					continue
+				}
+				if _, err := nw.nodes[id].Propose([]byte("x=y")); !errors.Is(err, ErrNotLeader) {
+					t.Errorf("propose on follower %s: expected ErrNotLeader, got %v", id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionedLeader(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	nw := newNetwork(t, 7, 0, ids...)
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	oldLeader := nw.leaderOf(ids...)
+
+	var minority, majority []string
+	for _, id := range ids {
+		if id == oldLeader || len(minority) == 0 {
+			if len(minority) < 2 {
+				minority = append(minority, id)
+				continue
+			}
+		}
+		majority = append(majority, id)
+	}
+	if !slices.Contains(minority, oldLeader) {
+		minority[1] = oldLeader
+		majority = slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return slices.Contains(minority, id) })
+	}
+	nw.partition(minority, majority)
+
+	lost := nw.propose(oldLeader, "key", "lost")
+	nw.runUntil("a majority leader", func() bool { return nw.leaderOf(majority...) != "" })
+	newLeader := nw.leaderOf(majority...)
+	kept := nw.propose(newLeader, "key", "kept")
+	nw.runUntil("majority commit", nw.hasValue("key", "kept", majority...))
+
+	for _, id := range minority {
+		if nw.machines[id].data["key"] == "lost" {
+			t.Fatalf("uncommitted write was applied on %s during the partition", id)
+		}
+	}
+	nw.runUntil("the old leader to step down", func() bool { return nw.nodes[oldLeader].Status().State != "leader" })
+	if _, err := nw.nodes[oldLeader].Propose([]byte("key=late")); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("propose on the partitioned leader: expected ErrNotLeader, got %v", err)
+	}
+
+	nw.heal()
+	nw.runUntil("convergence", nw.hasValue("key", "kept", ids...))
+	if err := waitResult(t, kept); err != nil {
+		t.Errorf("majority proposal failed: %v", err)
+	}
+	if err := waitResult(t, lost); !errors.Is(err, ErrProposalDropped) {
+		t.Errorf("minority proposal: expected ErrProposalDropped, got %v", err)
+	}
+	if st := nw.nodes[oldLeader].Status(); st.State == "leader" && st.Term < nw.nodes[newLeader].Status().Term {
+		t.Errorf("old leader %s did not step down", oldLeader)
+	}
+}
+
+func TestMembershipChange(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	nw := newNetwork(t, 3, 0, ids...)
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	leader := nw.leaderOf(ids...)
+	nw.propose(leader, "before", "join")
+
+	// The new node does not know the cluster and waits to be contacted.
+	nw.start("d", nil)
+	ch, err := nw.nodes[leader].AddNode("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nw.nodes[leader].AddNode("e"); !errors.Is(err, ErrConfChangePending) {
+		t.Errorf("second membership change: expected ErrConfChangePending, got %v", err)
+	}
+	nw.collect(leader)
+	nw.runUntil("d to catch up", nw.hasValue("before", "join", "d"))
+	if err := waitResult(t, ch); err != nil {
+		t.Fatal(err)
+	}
+	if peers := nw.nodes["d"].Status().Peers; !slices.Equal(peers, []string{"a", "b", "c", "d"}) {
+		t.Errorf("d learned peers %v", peers)
+	}
+
+	removed := "a"
+	if leader == removed {
+		removed = "b"
+	}
+	if _, err := nw.nodes[leader].RemoveNode(removed); err != nil {
+		t.Fatal(err)
+	}
+	nw.collect(leader)
+	nw.runUntil("removal", func() bool {
+		return !slices.Contains(nw.nodes[leader].Status().Peers, removed) && nw.nodes[leader].Status().Commit == nw.nodes[leader].Status().LastIndex
+	})
+
+	// The remaining three members keep working without the removed node.
+	nw.down[removed] = true
+	nw.propose(leader, "after", "remove")
+	rest := slices.DeleteFunc([]string{"a", "b", "c", "d"}, func(id string) bool { return id == removed })
+	nw.runUntil("replication after removal", nw.hasValue("after", "remove", rest...))
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	nw := newNetwork(t, 11, 5, ids...)
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	leader := nw.leaderOf(ids...)
+
+	var lagging string
+	var others []string
+	for _, id := range ids {
+		if id != leader && lagging == "" {
+			lagging = id
+		} else {
+			others = append(others, id)
+		}
+	}
+	nw.partition([]string{lagging}, others)
+
+	for i := 0; i < 20; i++ {
+		nw.propose(leader, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		nw.tick()
+	}
+	nw.runUntil("commit", nw.hasValue("key19", "value19", others...))
+	if st := nw.nodes[leader].Status(); st.Snapshot == 0 {
+		t.Fatalf("leader did not compact its log: %+v", st)
+	}
+
+	nw.heal()
+	nw.runUntil("snapshot install", nw.hasValue("key19", "value19", lagging))
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if got := nw.machines[lagging].data[key]; got != fmt.Sprintf("value%d", i) {
+			t.Errorf("%s on %s = %q after snapshot", key, lagging, got)
+		}
+	}
+}
+
+func TestRestartFromStorage(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	nw := newNetwork(t, 5, 3, ids...)
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	leader := nw.leaderOf(ids...)
+	for i := 0; i < 10; i++ {
+		nw.propose(leader, fmt.Sprintf("key%d", i), "value")
+	}
+	nw.runUntil("replication", nw.hasValue("key9", "value", ids...))
+
+	restarted := "a"
+	termBefore := nw.nodes[restarted].Status().Term
+	nw.start(restarted, ids)
+	if st := nw.nodes[restarted].Status(); st.Term != termBefore {
+		t.Errorf("term after restart = %d, wanted %d", st.Term, termBefore)
+	}
+	nw.runUntil("restarted node to apply the log", nw.hasValue("key9", "value", restarted))
+}
+
+func TestRestartPersistentStateMachine(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	nw := newNetwork(t, 5, 3)
+	nw.persistent = true
+	for _, id := range ids {
+		nw.start(id, ids)
+	}
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	leader := nw.leaderOf(ids...)
+	for i := 0; i < 10; i++ {
+		nw.propose(leader, fmt.Sprintf("key%d", i), "value")
+	}
+	nw.runUntil("replication", nw.hasValue("key9", "value", ids...))
+
+	restarted := "a"
+	applied := nw.nodes[restarted].Status().Applied
+	applies := nw.machines[restarted].applies
+	nw.start(restarted, ids)
+	if st := nw.nodes[restarted].Status(); st.Applied != applied {
+		t.Errorf("applied after restart = %d, wanted %d", st.Applied, applied)
+	}
+	if got := nw.machines[restarted].applies; got != applies {
+		t.Errorf("restart applied %d entries again", got-applies)
+	}
+	nw.propose(nw.leaderOf(ids...), "after", "restart")
+	nw.runUntil("replication after restart", nw.hasValue("after", "restart", ids...))
+}
+
+func TestApplyFailureIsRetried(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	nw := newNetwork(t, 3, 0, ids...)
+	nw.runUntil("a leader", func() bool { return nw.leaderOf(ids...) != "" })
+	leader := nw.leaderOf(ids...)
+	follower := ids[0]
+	if follower == leader {
+		follower = ids[1]
+	}
+
+	diskFull := errors.New("disk full")
+	nw.machines[follower].fail = diskFull
+	nw.propose(leader, "key", "value")
+	nw.propose(leader, "other", "value")
+	nw.runUntil("the entries to commit", func() bool {
+		return nw.nodes[follower].Status().Commit == nw.nodes[leader].Status().Commit
+	})
+	for i := 0; i < 5; i++ {
+		nw.tick()
+	}
+	st := nw.nodes[follower].Status()
+	if st.Applied >= st.Commit {
+		t.Fatalf("failed entry counted as applied: %+v", st)
+	}
+	if err := nw.nodes[follower].Tick(); !errors.Is(err, diskFull) {
+		t.Errorf("Tick with a failing state machine: %v", err)
+	}
+
+	nw.machines[follower].fail = nil
+	nw.runUntil("the entries to apply", nw.hasValue("other", "value", follower))
+	if nw.machines[follower].data["key"] != "value" {
+		t.Error("the entry that failed was skipped")
+	}
+}
+
+func TestRestartPersistentStateMachineWithoutSnapshot(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.hs = HardState{Term: 1, Applied: 2}
+	storage.entries = []Entry{
+		{Term: 1, Index: 1, Type: EntryAddNode, Data: []byte("a")},
+		{Term: 1, Index: 2, Data: []byte("key=old")},
+		{Term: 1, Index: 3, Data: []byte("key=new")},
+	}
+	machine := newKVMachine()
+	node, err := NewNode(Config{
+		ID:                     "a",
+		StateMachine:           machine,
+		PersistentStateMachine: true,
+		Storage:                storage,
+		Rand:                   rand.New(rand.NewSource(1)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := node.Status(); st.Applied != 2 {
+		t.Errorf("applied after restart = %d, wanted 2", st.Applied)
+	}
+	if machine.applies != 0 {
+		t.Errorf("restart applied %d entries again", machine.applies)
+	}
+}
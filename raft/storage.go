@@ -0,0 +1,359 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+type HardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+	// Applied is only kept for a PersistentStateMachine.
+	Applied uint64 `json:"applied,omitempty"`
+}
+
+// Storage keeps the state a node must not lose across restarts.
+type Storage interface {
+	// Load returns a nil snapshot for a fresh node.
+	Load() (HardState, *Snapshot, []Entry, error)
+	Save(hs HardState, snap *Snapshot, entries []Entry) error
+}
+
+type MemoryStorage struct {
+	mu      sync.Mutex
+	hs      HardState
+	snap    *Snapshot
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var snap *Snapshot
+	if s.snap != nil {
+		copied := *s.snap
+		snap = &copied
+	}
+	return s.hs, snap, slices.Clone(s.entries), nil
+}
+
+func (s *MemoryStorage) Save(hs HardState, snap *Snapshot, entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hs = hs
+	copied := *snap
+	s.snap = &copied
+	s.entries = slices.Clone(entries)
+	return nil
+}
+
+const (
+	stateFileName    = "raft-state.json"
+	snapshotFileName = "raft-snapshot.json"
+	logFileName      = "raft-log"
+
+	// logRecordHeader is the length and CRC-32 of a log record, which holds
+	// the term, index and type of the entry followed by its data.
+	logRecordHeader = 8
+	logEntryHeader  = 17
+)
+
+// FileStorage keeps the hard state and the snapshot in small files that are
+// replaced atomically, and the log in a file that new entries are appended
+// to. The log file is only rewritten when the node truncates its log or takes
+// a snapshot.
+type FileStorage struct {
+	dir      string
+	log      *os.File
+	hs       HardState
+	hasSnap  bool
+	snap     uint64
+	snapTerm uint64
+	// last and lastTerm describe the last entry in the log file, or the
+	// snapshot if the file is empty.
+	last     uint64
+	lastTerm uint64
+}
+
+type fileState struct {
+	HardState HardState `json:"hard_state"`
+	// Entries is only read, from state files written before the log moved to
+	// its own file.
+	Entries []Entry `json:"entries,omitempty"`
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (s *FileStorage) Load() (HardState, *Snapshot, []Entry, error) {
+	var state fileState
+	if err := readJSON(filepath.Join(s.dir, stateFileName), &state); err != nil && !os.IsNotExist(err) {
+		return HardState{}, nil, nil, err
+	}
+	s.hs = state.HardState
+	var snap *Snapshot
+	var stored Snapshot
+	err := readJSON(filepath.Join(s.dir, snapshotFileName), &stored)
+	if err == nil {
+		snap = &stored
+		s.snap, s.snapTerm, s.hasSnap = stored.Index, stored.Term, true
+	} else if !os.IsNotExist(err) {
+		return HardState{}, nil, nil, err
+	}
+
+	entries, err := s.openLog()
+	if err != nil {
+		return HardState{}, nil, nil, err
+	}
+	if s.log == nil {
+		entries = state.Entries
+	}
+	if snap != nil {
+		entries = entriesAfter(entries, snap)
+	}
+	if s.log == nil {
+		// Moves the entries of an old state file into a log file.
+		if err := s.rewriteLog(entries); err != nil {
+			return HardState{}, nil, nil, err
+		}
+	} else {
+		s.setLast(entries)
+	}
+	return s.hs, snap, entries, nil
+}
+
+// entriesAfter drops the entries covered by snap. The log file may still
+// hold the log from before a snapshot that was saved just before a crash; its
+// tail is only kept if it continues the snapshot.
+func entriesAfter(entries []Entry, snap *Snapshot) []Entry {
+	for i, e := range entries {
+		if e.Index == snap.Index && e.Term == snap.Term {
+			return entries[i+1:]
+		}
+		if e.Index > snap.Index {
+			if i == 0 && e.Index == snap.Index+1 {
+				return entries
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// openLog reads the log file and opens it for appending. A record torn by a
+// crash is cut off. It leaves s.log nil if there is no log file yet.
+func (s *FileStorage) openLog() ([]Entry, error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR, 0o600)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	in := bufio.NewReader(f)
+	var offset int64
+	for {
+		e, n, err := readLogRecord(in)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+		offset += n
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.log = f
+	return entries, nil
+}
+
+func (s *FileStorage) Save(hs HardState, snap *Snapshot, entries []Entry) error {
+	rewrite := false
+	if !s.hasSnap || snap.Index != s.snap {
+		if err := writeJSON(filepath.Join(s.dir, snapshotFileName), snap); err != nil {
+			return err
+		}
+		s.snap, s.snapTerm, s.hasSnap = snap.Index, snap.Term, true
+		rewrite = true
+	}
+	// Entries with the same index and term are the same, and so is the log
+	// before them, so only what follows the saved last entry is new.
+	var saved int
+	switch {
+	case rewrite || s.log == nil || s.last < snap.Index:
+		rewrite = true
+	case s.last == snap.Index:
+		rewrite = s.lastTerm != snap.Term
+	default:
+		saved = int(s.last - snap.Index)
+		rewrite = saved > len(entries) || entries[saved-1].Term != s.lastTerm
+	}
+	var err error
+	if rewrite {
+		err = s.rewriteLog(entries)
+	} else if saved < len(entries) {
+		err = s.appendLog(entries[saved:])
+	}
+	if err != nil || hs == s.hs {
+		return err
+	}
+	// The hard state goes last, so the applied index never points past the
+	// saved log.
+	if err := writeJSON(filepath.Join(s.dir, stateFileName), fileState{HardState: hs}); err != nil {
+		return err
+	}
+	s.hs = hs
+	return nil
+}
+
+func (s *FileStorage) appendLog(entries []Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		writeLogRecord(&buf, e)
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.setLast(entries)
+	return nil
+}
+
+// rewriteLog replaces the log file with entries.
+func (s *FileStorage) rewriteLog(entries []Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		writeLogRecord(&buf, e)
+	}
+	path := filepath.Join(s.dir, logFileName)
+	if err := writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = f
+	s.setLast(entries)
+	return nil
+}
+
+// setLast records the last entry of the log file, which holds entries.
+func (s *FileStorage) setLast(entries []Entry) {
+	s.last, s.lastTerm = s.snap, s.snapTerm
+	if len(entries) > 0 {
+		s.last, s.lastTerm = entries[len(entries)-1].Index, entries[len(entries)-1].Term
+	}
+}
+
+// Close closes the log file.
+func (s *FileStorage) Close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+func writeLogRecord(buf *bytes.Buffer, e Entry) {
+	record := make([]byte, logRecordHeader+logEntryHeader+len(e.Data))
+	body := record[logRecordHeader:]
+	binary.LittleEndian.PutUint64(body, e.Term)
+	binary.LittleEndian.PutUint64(body[8:], e.Index)
+	body[16] = byte(e.Type)
+	copy(body[logEntryHeader:], e.Data)
+	binary.LittleEndian.PutUint32(record, uint32(len(body)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	buf.Write(record)
+}
+
+func readLogRecord(in *bufio.Reader) (Entry, int64, error) {
+	var header [logRecordHeader]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return Entry{}, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size < logEntryHeader {
+		return Entry{}, 0, errors.New("bad raft log record size")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return Entry{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+		return Entry{}, 0, errors.New("bad raft log record checksum")
+	}
+	e := Entry{
+		Term:  binary.LittleEndian.Uint64(body),
+		Index: binary.LittleEndian.Uint64(body[8:]),
+		Type:  EntryType(body[16]),
+	}
+	if len(body) > logEntryHeader {
+		e.Data = body[logEntryHeader:]
+	}
+	return e, int64(logRecordHeader + size), nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces the file at path with data atomically.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
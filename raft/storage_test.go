@@ -0,0 +1,119 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func entries(term uint64, from, to uint64) []Entry {
+	var out []Entry
+	for i := from; i <= to; i++ {
+		out = append(out, Entry{Term: term, Index: i, Data: []byte{byte(i)}})
+	}
+	return out
+}
+
+func loadFileStorage(t *testing.T, dir string) (*FileStorage, HardState, *Snapshot, []Entry) {
+	t.Helper()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	hs, snap, loaded, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return s, hs, snap, loaded
+}
+
+func equalEntries(a, b []Entry) bool {
+	return slices.EqualFunc(a, b, func(x, y Entry) bool {
+		return x.Term == y.Term && x.Index == y.Index && x.Type == y.Type && string(x.Data) == string(y.Data)
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _ := loadFileStorage(t, dir)
+	logPath := filepath.Join(dir, logFileName)
+
+	hs := HardState{Term: 1, VotedFor: "a", Applied: 2}
+	snap := &Snapshot{}
+	log := entries(1, 1, 3)
+	if err := s.Save(hs, snap, log); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(logPath)
+	log = append(log, entries(1, 4, 5)...)
+	if err := s.Save(hs, snap, log); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(logPath)
+	if grown := after.Size() - before.Size(); grown <= 0 || grown >= after.Size() {
+		t.Errorf("log file grew by %d bytes to %d, wanted only the new entries appended", grown, after.Size())
+	}
+
+	// A conflicting entry replaces the tail of the log.
+	log = append(log[:3], entries(2, 4, 4)...)
+	if err := s.Save(hs, snap, log); err != nil {
+		t.Fatal(err)
+	}
+	_, gotHS, _, got := loadFileStorage(t, dir)
+	if gotHS != hs {
+		t.Errorf("hard state = %+v, wanted %+v", gotHS, hs)
+	}
+	if !equalEntries(got, log) {
+		t.Errorf("entries after truncation = %+v, wanted %+v", got, log)
+	}
+
+	// A record torn by a crash is dropped and later entries follow the
+	// last whole one.
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{40, 0, 0})
+	f.Close()
+	s, _, _, got = loadFileStorage(t, dir)
+	if !equalEntries(got, log) {
+		t.Fatalf("entries after a torn write = %+v, wanted %+v", got, log)
+	}
+	log = append(log, entries(2, 5, 6)...)
+	snap = &Snapshot{Index: 4, Term: 2, Peers: []string{"a"}}
+	if err := s.Save(hs, snap, log[4:]); err != nil {
+		t.Fatal(err)
+	}
+	_, _, gotSnap, got := loadFileStorage(t, dir)
+	if gotSnap == nil || gotSnap.Index != 4 {
+		t.Errorf("snapshot = %+v, wanted index 4", gotSnap)
+	}
+	if !equalEntries(got, log[4:]) {
+		t.Errorf("entries after snapshot = %+v, wanted %+v", got, log[4:])
+	}
+}
+
+func TestFileStorageSnapshotBeforeLogRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _ := loadFileStorage(t, dir)
+	if err := s.Save(HardState{Term: 1}, &Snapshot{}, entries(1, 1, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// A crash after the snapshot was written leaves the old log behind.
+	if err := writeJSON(filepath.Join(dir, snapshotFileName), &Snapshot{Index: 3, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_, _, snap, got := loadFileStorage(t, dir)
+	if snap.Index != 3 || !equalEntries(got, entries(1, 4, 5)) {
+		t.Errorf("loaded snapshot %d and entries %+v, wanted 3 and entries 4..5", snap.Index, got)
+	}
+
+	if err := writeJSON(filepath.Join(dir, snapshotFileName), &Snapshot{Index: 4, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, got := loadFileStorage(t, dir); len(got) != 0 {
+		t.Errorf("entries of another term survived the snapshot: %+v", got)
+	}
+}
@@ -0,0 +1,525 @@
+// Package shard spreads keys over several db nodes. Each key lives on exactly
+// one node, picked by a consistent hash ring over the node base URLs.
+//
+// The shard list is stored as a versioned topology under RingKey on every
+// node. Clients start from the list they are given, load the topology with
+// Refresh and keep refreshing it, so all of them switch rings when shards are
+// added or removed. While keys move, the topology names both the current and
+// the next ring: writes go to the owners in both and reads prefer the next
+// one, so no write is lost between copying a key and deleting it.
+package shard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+	"github.com/DmytroHalai/achitecture-practice-5/hashring"
+)
+
+var (
+	ErrNoShards     = errors.New("no shards configured")
+	ErrUnknownShard = errors.New("unknown shard")
+	ErrLastShard    = errors.New("cannot remove the last shard")
+	ErrKeyBusy      = errors.New("key kept changing while it was moved")
+)
+
+// RingKey is the reserved key that holds the topology on every node.
+const RingKey = "_shard/ring"
+
+const (
+	// DefaultSettle is how long a reshard waits for other clients to load a
+	// new topology; it must exceed their refresh interval.
+	DefaultSettle = 30 * time.Second
+	// copyAttempts limits how often a key written during its move is
+	// copied again.
+	copyAttempts = 5
+)
+
+// Topology is the shard list shared by all clients. Next is set while keys
+// move to another shard list.
+type Topology struct {
+	Version int64    `json:"version"`
+	Shards  []string `json:"shards"`
+	Next    []string `json:"next,omitempty"`
+}
+
+// Client routes Get, Put and Delete to the node that owns the key.
+type Client struct {
+	// mu is held for reading by requests and for writing while the
+	// topology changes.
+	mu      sync.RWMutex
+	version int64
+	ring    *hashring.Ring
+	// next is the ring keys are moving to, or nil.
+	next  *hashring.Ring
+	nodes map[string]*dbclient.Client
+	opts  []dbclient.Option
+
+	// reshardMu serializes AddShard, RemoveShard and Cleanup.
+	reshardMu sync.Mutex
+	settle    time.Duration
+}
+
+// NewClient creates a client for the given node base URLs, e.g.
+// http://db:8083. The options apply to the client of every node. Call Refresh
+// to pick up a topology stored by an earlier reshard.
+func NewClient(shards []string, opts ...dbclient.Option) *Client {
+	c := &Client{
+		ring:   hashring.New(hashring.DefaultReplicas),
+		nodes:  make(map[string]*dbclient.Client),
+		opts:   opts,
+		settle: DefaultSettle,
+	}
+	for _, shard := range shards {
+		shard = strings.TrimSuffix(shard, "/")
+		c.ring.Add(shard)
+		c.node(shard)
+	}
+	return c
+}
+
+// SetSettle sets how long AddShard and RemoveShard wait after storing a new
+// topology before they rely on every client using it.
+func (c *Client) SetSettle(d time.Duration) {
+	c.reshardMu.Lock()
+	defer c.reshardMu.Unlock()
+	c.settle = d
+}
+
+// node returns the client of a shard. The caller must hold c.mu for writing
+// or reading; in the latter case the node client must already exist, which
+// holds for every node on the rings.
+func (c *Client) node(shard string) *dbclient.Client {
+	if node, ok := c.nodes[shard]; ok {
+		return node
+	}
+	node := dbclient.New(shard, c.opts...)
+	c.nodes[shard] = node
+	return node
+}
+
+// ParseShards splits a comma separated shard list.
+func ParseShards(list string) []string {
+	var shards []string
+	for _, shard := range strings.Split(list, ",") {
+		if shard = strings.TrimSpace(shard); shard != "" {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Shard returns the node that owns key.
+func (c *Client) Shard(key string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.owner(c.ring, key)
+}
+
+func (c *Client) owner(ring *hashring.Ring, key string) (string, error) {
+	node := ring.Get(key)
+	if node == "" {
+		return "", ErrNoShards
+	}
+	return node, nil
+}
+
+// owners returns the clients of the nodes that hold key: the owner on the
+// next ring first while keys move, then the current owner. The caller must
+// hold c.mu.
+func (c *Client) owners(key string) ([]*dbclient.Client, error) {
+	current, err := c.owner(c.ring, key)
+	if err != nil {
+		return nil, err
+	}
+	if c.next != nil {
+		if next := c.next.Get(key); next != "" && next != current {
+			return []*dbclient.Client{c.nodes[next], c.nodes[current]}, nil
+		}
+	}
+	return []*dbclient.Client{c.nodes[current]}, nil
+}
+
+func (c *Client) Shards() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Nodes()
+}
+
+// Topology returns the topology the client routes by.
+func (c *Client) Topology() Topology {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.topology()
+}
+
+func (c *Client) topology() Topology {
+	t := Topology{Version: c.version, Shards: c.ring.Nodes()}
+	if c.next != nil {
+		t.Next = c.next.Nodes()
+	}
+	return t
+}
+
+// Get reads key from the next owner while it moves, falling back to the
+// current owner until the key has been copied.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	err := c.read(key, func(node *dbclient.Client) (err error) {
+		value, err = node.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// GetItem is Get with the value as the db sent it.
+func (c *Client) GetItem(ctx context.Context, key string) (dbclient.Item, error) {
+	var item dbclient.Item
+	err := c.read(key, func(node *dbclient.Client) (err error) {
+		item, err = node.GetItem(ctx, key)
+		return err
+	})
+	return item, err
+}
+
+// read applies fn to the owners of key, the next one first, until one of
+// them has the key.
+func (c *Client) read(key string, fn func(node *dbclient.Client) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes, err := c.owners(key)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes[:len(nodes)-1] {
+		if err := fn(node); !errors.Is(err, dbclient.ErrNotFound) {
+			return err
+		}
+	}
+	return fn(nodes[len(nodes)-1])
+}
+
+// Put writes key to its owner, and while it moves to both owners.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.write(key, func(node *dbclient.Client) error { return node.Put(ctx, key, value) })
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.write(key, func(node *dbclient.Client) error { return node.Delete(ctx, key) })
+}
+
+// write applies fn to the owners of key, the current one first: a reshard
+// copies from it, and copies again if the key changed meanwhile.
+func (c *Client) write(key string, fn func(node *dbclient.Client) error) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes, err := c.owners(key)
+	if err != nil {
+		return err
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if err := fn(nodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh loads the newest topology stored on the known nodes and switches
+// to it.
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mu.RLock()
+	var nodes []*dbclient.Client
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+
+	var newest *Topology
+	var firstErr error
+	for _, node := range nodes {
+		t, err := loadTopology(ctx, node)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to load the topology from %s: %w", node.BaseURL(), err)
+			}
+			continue
+		}
+		if t != nil && (newest == nil || t.Version > newest.Version) {
+			newest = t
+		}
+	}
+	if newest == nil {
+		// Before the first reshard no node has a topology.
+		return firstErr
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if newest.Version > c.version {
+		c.use(*newest)
+	}
+	return nil
+}
+
+func loadTopology(ctx context.Context, node *dbclient.Client) (*Topology, error) {
+	data, err := node.Get(ctx, RingKey)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t Topology
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, fmt.Errorf("bad topology: %w", err)
+	}
+	return &t, nil
+}
+
+// use switches to t. The caller must hold c.mu for writing.
+func (c *Client) use(t Topology) {
+	c.version = t.Version
+	c.ring = hashring.New(hashring.DefaultReplicas, t.Shards...)
+	c.next = nil
+	if len(t.Next) > 0 {
+		c.next = hashring.New(hashring.DefaultReplicas, t.Next...)
+	}
+	known := slices.Concat(t.Shards, t.Next)
+	for _, shard := range known {
+		c.node(shard)
+	}
+	for shard := range c.nodes {
+		if !slices.Contains(known, shard) {
+			delete(c.nodes, shard)
+		}
+	}
+}
+
+// AddShard adds a node and moves the keys it now owns onto it.
+func (c *Client) AddShard(ctx context.Context, shard string) error {
+	shard = strings.TrimSuffix(shard, "/")
+	c.reshardMu.Lock()
+	defer c.reshardMu.Unlock()
+	current := c.Topology()
+	if slices.Contains(current.Shards, shard) && current.Next == nil {
+		return nil
+	}
+	next := hashring.New(hashring.DefaultReplicas, current.Shards...)
+	next.Add(shard)
+	return c.reshard(ctx, next)
+}
+
+// RemoveShard moves every key off a node and then drops it from the ring.
+func (c *Client) RemoveShard(ctx context.Context, shard string) error {
+	shard = strings.TrimSuffix(shard, "/")
+	c.reshardMu.Lock()
+	defer c.reshardMu.Unlock()
+	current := c.Topology()
+	if !slices.Contains(current.Shards, shard) {
+		return fmt.Errorf("%w: %s", ErrUnknownShard, shard)
+	}
+	if len(current.Shards) == 1 {
+		return ErrLastShard
+	}
+	next := hashring.New(hashring.DefaultReplicas, current.Shards...)
+	next.Remove(shard)
+	return c.reshard(ctx, next)
+}
+
+type move struct {
+	key, from, to string
+}
+
+// reshard moves the keys to the next ring in three steps, each announced to
+// the other clients through a new topology version: writes start going to
+// both owners, the moved keys are copied, and the clients switch to the next
+// ring. A final cleanup deletes the copies left on the old owners. A failed
+// reshard leaves the clients writing to both owners, and can be run again.
+// The caller must hold c.reshardMu.
+func (c *Client) reshard(ctx context.Context, next *hashring.Ring) error {
+	current := c.Topology()
+	moving := Topology{Version: current.Version + 1, Shards: current.Shards, Next: next.Nodes()}
+	if err := c.publish(ctx, moving); err != nil {
+		return err
+	}
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+
+	moves, err := c.moves(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range moves {
+		if err := c.copyKey(ctx, m); err != nil {
+			return fmt.Errorf("failed to move %q from %s to %s: %w", m.key, m.from, m.to, err)
+		}
+	}
+
+	if err := c.publish(ctx, Topology{Version: moving.Version + 1, Shards: moving.Next}); err != nil {
+		return err
+	}
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.cleanup(ctx, moving.Shards)
+}
+
+// publish stores t on every node of both rings and of the ring in use, and
+// switches to it.
+func (c *Client) publish(ctx context.Context, t Topology) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	nodes := c.clients(slices.Concat(t.Shards, t.Next, c.Shards()))
+	for shard, node := range nodes {
+		if err := node.Put(ctx, RingKey, string(data)); err != nil {
+			return fmt.Errorf("failed to store topology %d on %s: %w", t.Version, shard, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.use(t)
+	return nil
+}
+
+// clients returns a client for every shard, reusing those of the rings.
+func (c *Client) clients(shards []string) map[string]*dbclient.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes := make(map[string]*dbclient.Client)
+	for _, shard := range shards {
+		node, ok := c.nodes[shard]
+		if !ok {
+			node = dbclient.New(shard, c.opts...)
+		}
+		nodes[shard] = node
+	}
+	return nodes
+}
+
+// wait gives the other clients time to load the topology just published.
+func (c *Client) wait(ctx context.Context) error {
+	if c.settle <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(c.settle)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// moves lists the keys whose owner differs between the rings.
+func (c *Client) moves(ctx context.Context) ([]move, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var moves []move
+	for _, node := range c.ring.Nodes() {
+		keys, err := c.nodes[node].Keys(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list keys of %s: %w", node, err)
+		}
+		for _, key := range keys {
+			// A key the node does not own is a leftover of an
+			// interrupted move; the owner has the current value.
+			if key == RingKey || c.ring.Get(key) != node {
+				continue
+			}
+			if to := c.next.Get(key); to != node {
+				moves = append(moves, move{key: key, from: node, to: to})
+			}
+		}
+	}
+	return moves, nil
+}
+
+// copyKey copies a key to its next owner as raw bytes, since the JSON API
+// cannot carry values that are not valid UTF-8. Clients write to the current
+// owner first, so a value that changed during the copy is copied again.
+func (c *Client) copyKey(ctx context.Context, m move) error {
+	c.mu.RLock()
+	from, to := c.nodes[m.from], c.nodes[m.to]
+	c.mu.RUnlock()
+
+	value, err := getRaw(ctx, from, m.key)
+	if err != nil {
+		return err
+	}
+	for range copyAttempts {
+		if value == nil {
+			err = to.Delete(ctx, m.key)
+		} else {
+			err = to.PutBytes(ctx, m.key, value)
+		}
+		if err != nil {
+			return err
+		}
+		after, err := getRaw(ctx, from, m.key)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(after, value) && (after == nil) == (value == nil) {
+			return nil
+		}
+		value = after
+	}
+	return ErrKeyBusy
+}
+
+// getRaw returns nil for a missing key.
+func getRaw(ctx context.Context, node *dbclient.Client, key string) ([]byte, error) {
+	value, err := node.GetBytes(ctx, key)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Cleanup deletes the keys that nodes hold without owning them, left over by
+// a reshard that failed after copying. It must not run while keys move.
+func (c *Client) Cleanup(ctx context.Context) error {
+	c.reshardMu.Lock()
+	defer c.reshardMu.Unlock()
+	if c.Topology().Next != nil {
+		return errors.New("keys are moving, finish the reshard first")
+	}
+	return c.cleanup(ctx, nil)
+}
+
+// cleanup deletes every key that a node of the ring or one of the extra
+// nodes does not own. The caller must hold c.reshardMu.
+func (c *Client) cleanup(ctx context.Context, extra []string) error {
+	c.mu.RLock()
+	ring := c.ring
+	c.mu.RUnlock()
+
+	var firstErr error
+	for shard, node := range c.clients(slices.Concat(ring.Nodes(), extra)) {
+		keys, err := node.Keys(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to list keys of %s: %w", shard, err)
+		}
+		for _, key := range keys {
+			if key == RingKey || ring.Get(key) == shard {
+				continue
+			}
+			if err := node.Delete(ctx, key); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to delete moved key %q from %s: %w", key, shard, err)
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,290 @@
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DmytroHalai/achitecture-practice-5/dbclient"
+	"github.com/DmytroHalai/achitecture-practice-5/hashring"
+)
+
+// fakeNode serves the subset of the cmd/db API the client uses.
+type fakeNode struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if r.URL.Path == "/keys" {
+		keys := []string{}
+		for key := range n.data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	raw := r.Header.Get("Accept") == "application/octet-stream"
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := n.data[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if raw {
+			io.WriteString(w, value)
+			return
+		}
+		json.NewEncoder(w).Encode(dbclient.Item{Key: key, Value: value})
+	case http.MethodPost, http.MethodPut:
+		if raw {
+			value, _ := io.ReadAll(r.Body)
+			n.data[key] = string(value)
+		} else {
+			var req struct{ Value string }
+			json.NewDecoder(r.Body).Decode(&req)
+			n.data[key] = req.Value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(n.data, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (n *fakeNode) value(key string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.data[key]
+}
+
+// len counts the stored keys besides the topology.
+func (n *fakeNode) len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.data[RingKey]
+	if ok {
+		return len(n.data) - 1
+	}
+	return len(n.data)
+}
+
+func startFakeNodes(t *testing.T, count int) ([]string, map[string]*fakeNode) {
+	t.Helper()
+	var urls []string
+	nodes := make(map[string]*fakeNode)
+	for i := 0; i < count; i++ {
+		node := &fakeNode{data: make(map[string]string)}
+		ts := httptest.NewServer(node)
+		t.Cleanup(ts.Close)
+		urls = append(urls, ts.URL)
+		nodes[ts.URL] = node
+	}
+	return urls, nodes
+}
+
+func TestClientRoutesKeys(t *testing.T) {
+	urls, nodes := startFakeNodes(t, 3)
+	client := NewClient(urls)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key/%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, url := range urls {
+		if nodes[url].len() == 0 {
+			t.Errorf("node %s got no keys", url)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key/%d", i)
+		owner, _ := client.Shard(key)
+		if got := nodes[owner].value(key); got != fmt.Sprint(i) {
+			t.Errorf("%s is not stored on its shard %s", key, owner)
+		}
+		if value, err := client.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+			t.Errorf("get %s: %q, %v", key, value, err)
+		}
+	}
+
+	if err := client.Delete(ctx, "key/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "key/1"); !errors.Is(err, dbclient.ErrNotFound) {
+		t.Errorf("deleted key: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientAddRemoveShard(t *testing.T) {
+	urls, nodes := startFakeNodes(t, 4)
+	client := NewClient(urls[:3])
+	client.SetSettle(0)
+	ctx := context.Background()
+
+	const keys = 300
+	for i := 0; i < keys; i++ {
+		if err := client.Put(ctx, fmt.Sprintf("key-%d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkAll := func() {
+		t.Helper()
+		total := 0
+		for _, node := range nodes {
+			total += node.len()
+		}
+		if total != keys {
+			t.Errorf("%d keys stored, want %d", total, keys)
+		}
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if value, err := client.Get(ctx, key); err != nil || value != fmt.Sprint(i) {
+				t.Fatalf("get %s: %q, %v", key, value, err)
+			}
+		}
+	}
+
+	if err := client.AddShard(ctx, urls[3]); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[urls[3]].len() == 0 {
+		t.Error("no keys moved to the new shard")
+	}
+	checkAll()
+
+	if err := client.RemoveShard(ctx, urls[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := nodes[urls[0]].len(); n != 0 {
+		t.Errorf("removed shard still holds %d keys", n)
+	}
+	checkAll()
+
+	if err := client.RemoveShard(ctx, urls[0]); !errors.Is(err, ErrUnknownShard) {
+		t.Errorf("removing an unknown shard: got %v", err)
+	}
+}
+
+func TestReshardMovesRawBytes(t *testing.T) {
+	urls, nodes := startFakeNodes(t, 2)
+	client := NewClient(urls[:1])
+	client.SetSettle(0)
+	value := "\xff\xfe binary \x00"
+	for i := 0; i < 20; i++ {
+		nodes[urls[0]].data[fmt.Sprintf("key-%d", i)] = value
+	}
+	if err := client.AddShard(context.Background(), urls[1]); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[urls[1]].len() == 0 {
+		t.Fatal("no keys moved to the new shard")
+	}
+	for key, got := range nodes[urls[1]].data {
+		if key != RingKey && got != value {
+			t.Errorf("%s moved as %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestReshardKeepsOtherClientsInStep(t *testing.T) {
+	urls, nodes := startFakeNodes(t, 3)
+	resharder := NewClient(urls[:2])
+	resharder.SetSettle(0)
+	server := NewClient(urls[:2])
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := server.Put(ctx, fmt.Sprintf("key-%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := hashring.New(hashring.DefaultReplicas, urls...)
+	var moved string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner, _ := server.Shard(key); next.Get(key) != owner {
+			moved = key
+			break
+		}
+	}
+
+	// The server learns about the move and writes to both owners.
+	if err := resharder.publish(ctx, Topology{Version: 1, Shards: urls[:2], Next: urls}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.Topology(); got.Version != 1 || len(got.Next) != 3 {
+		t.Fatalf("server topology after refresh: %+v", got)
+	}
+	if value, err := server.Get(ctx, moved); err != nil || value != "old" {
+		t.Errorf("get %s before the copy: %q, %v", moved, value, err)
+	}
+	moves, err := resharder.moves(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range moves {
+		if err := resharder.copyKey(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A write after the copy is not lost when the old owner lets go.
+	if err := server.Put(ctx, moved, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := resharder.publish(ctx, Topology{Version: 2, Shards: urls}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resharder.cleanup(ctx, urls[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := server.Get(ctx, moved); err != nil || value != "new" {
+		t.Errorf("get %s after the move: %q, %v", moved, value, err)
+	}
+	if shards := server.Shards(); len(shards) != 3 {
+		t.Errorf("server shards after the move: %v", shards)
+	}
+
+	total := 0
+	for _, node := range nodes {
+		total += node.len()
+	}
+	if total != 100 {
+		t.Errorf("%d keys stored after cleanup, want 100", total)
+	}
+
+	// Cleanup also removes leftovers of an interrupted move.
+	for _, url := range urls {
+		if url != next.Get("stray") {
+			nodes[url].data["stray"] = "leftover"
+		}
+	}
+	if err := resharder.Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range urls {
+		if _, ok := nodes[url].data["stray"]; ok {
+			t.Errorf("leftover key survived cleanup on %s", url)
+		}
+	}
+}